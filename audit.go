@@ -0,0 +1,650 @@
+package silo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditStore = "store"
+	AuditRemove = "remove"
+	AuditAppend = "append"
+	AuditCopy = "copy"
+	AuditRename = "rename"
+	AuditDenied = "denied"
+
+	// rotated audit files are named <file>.<time> with the time in this format, so they sort in order
+	auditRotateFormat = "20060102T150405.000000000"
+
+	// the head is written alongside the current file, as <file>.head, padded to this size so it can be
+	// overwritten in place
+	auditHeadSuffix = ".head"
+	auditHeadBytes = 256
+)
+
+// Settings for the audit log. The audit log is only written if File is set.
+//
+type auditSettings struct {
+	File string
+
+	// rotate the file once it reaches this size (0 never rotates)
+	MaxBytes int64
+}
+
+// A single entry in the audit log.
+//  Each record holds the hash of the record before it, & its own hash is a keyed HMAC over its contents,
+//  so records can't be altered, removed or inserted without breaking the chain.
+//
+type AuditRecord struct {
+	Seq uint64
+	Time time.Time
+	Role string
+	Action string
+	Key string
+	Size int64 `json:",omitempty"`
+	Checksum string `json:",omitempty"` // sha256 of the data stored
+	Detail string `json:",omitempty"`
+	Prev string
+	Hash string
+}
+
+// Filters for querying the audit log, zero values match everything
+//
+type AuditQuery struct {
+	Role string
+	Prefix string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// The last record written, kept alongside the log & signed, so records removed from the end of the log are
+// noticed even though the chain itself can't show it.
+//
+type auditHead struct {
+	Seq uint64
+	Hash string
+	Mac string
+}
+
+// Append only, hash chained log of data mutations & permission denials
+//
+type auditLog struct {
+	lock sync.Mutex
+	settings *auditSettings
+	key []byte
+
+	file *os.File
+	head *os.File
+	size int64
+	seq uint64
+	last string
+}
+
+// Open the audit log, picking up the chain from the last record written (if any).
+//
+func openAuditLog(settings *auditSettings, key *[32]byte) (*auditLog, error) {
+	a := &auditLog{settings: settings, key: auditKey(key)}
+
+	err := repairAuditFile(settings.File)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+
+	// find the last record written, which may be in a rotated file if the current one is empty
+	var last *AuditRecord
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err = lastAuditRecord(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			a.seq = last.Seq
+			a.last = last.Hash
+			break
+		}
+	}
+
+	// the head is written after each record, so it's either the last record or (if we stopped in between)
+	// the one before it; anything else means records have been removed
+	head, err := readAuditHead(settings.File, a.key)
+	if err != nil {
+		return nil, err
+	}
+	if head != nil {
+		current := last != nil && head.Seq == last.Seq && head.Hash == last.Hash
+		behind := last != nil && head.Seq + 1 == last.Seq && head.Hash == last.Prev
+		if !current && !behind {
+			return nil, fmt.Errorf(
+				"audit log %s ends at record %d but its head is record %d: records may have been removed, see 'silo audit verify' (remove %s to start again from the log as it is)",
+				settings.File, a.seq, head.Seq, settings.File + auditHeadSuffix,
+			)
+		}
+	}
+
+	err = a.open()
+	if err != nil {
+		return nil, err
+	}
+	if a.seq > 0 {
+		err = a.writeHead()
+		if err != nil {
+			a.close()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Remove a partly written last record from the given file (eg. if we stopped mid write), so that the next
+// record starts on a line of its own.
+//
+func repairAuditFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// look back from the end for the last complete line
+	end := info.Size()
+	buf := make([]byte, 64 * 1024)
+	for end > 0 {
+		n := min(end, int64(len(buf)))
+		_, err = f.ReadAt(buf[:n], end - n)
+		if err != nil {
+			return err
+		}
+		i := bytes.LastIndexByte(buf[:n], '\n')
+		if i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == info.Size() {
+		return nil
+	}
+
+	slog.Warn("removing a partly written record from the end of the audit log", "file", filename, "bytes", info.Size() - end)
+	err = f.Truncate(end)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Read & check the signature of the head written alongside the given audit file, if there is one.
+//
+func readAuditHead(filename string, key []byte) (*auditHead, error) {
+	data, err := os.ReadFile(filename + auditHeadSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// created when the log is opened, so it's empty until the first record is written
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	head := &auditHead{}
+	err = json.Unmarshal(data, head)
+	if err != nil {
+		return nil, fmt.Errorf("%s%s: %v", filename, auditHeadSuffix, err)
+	}
+	if !hmac.Equal([]byte(head.Mac), []byte(auditHeadMac(key, head.Seq, head.Hash))) {
+		return nil, fmt.Errorf("%s%s has been altered", filename, auditHeadSuffix)
+	}
+	return head, nil
+}
+
+func auditHeadMac(key []byte, seq uint64, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "silo audit head:%d:%s", seq, hash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record the last record written as the head.
+//  Nb. the caller is expected to hold the lock (or not yet have shared the log).
+//
+func (a *auditLog) writeHead() error {
+	data, err := json.Marshal(&auditHead{Seq: a.seq, Hash: a.last, Mac: auditHeadMac(a.key, a.seq, a.last)})
+	if err != nil {
+		return err
+	}
+
+	// padded to a fixed size & written in one go, so each write replaces the last entirely
+	padded := bytes.Repeat([]byte(" "), auditHeadBytes)
+	padded[auditHeadBytes - 1] = '\n'
+	copy(padded, data)
+	_, err = a.head.WriteAt(padded, 0)
+	return err
+}
+
+// Derive the audit HMAC key from our encryption key, so the two are never used for the same thing
+//
+func auditKey(key *[32]byte) []byte {
+	h := sha256.Sum256(append([]byte("silo audit log:"), key[:]...))
+	return h[:]
+}
+
+// Open the current file for appending
+//
+func (a *auditLog) open() error {
+	err := os.MkdirAll(filepath.Dir(a.settings.File), 0750)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.settings.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if a.head == nil {
+		a.head, err = os.OpenFile(a.settings.File + auditHeadSuffix, os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// Return all audit log files, oldest first. The current file is always last.
+//
+func (a *auditLog) files() ([]string, error) {
+	return auditFiles(a.settings.File)
+}
+
+func auditFiles(current string) ([]string, error) {
+	matches, err := filepath.Glob(current + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	// only rotated files, not the head
+	rotated := []string{}
+	for _, filename := range matches {
+		_, err = time.Parse(auditRotateFormat, strings.TrimPrefix(filename, current + "."))
+		if err == nil {
+			rotated = append(rotated, filename)
+		}
+	}
+	sort.Strings(rotated)
+
+	_, err = os.Stat(current)
+	if err == nil {
+		rotated = append(rotated, current)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return rotated, nil
+}
+
+// Move the current file aside & start a new one. The chain carries on into the new file.
+//  Nb. the caller is expected to hold the lock.
+//
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(a.settings.File, a.settings.File + "." + time.Now().UTC().Format(auditRotateFormat))
+	if err != nil {
+		return err
+	}
+
+	return a.open()
+}
+
+// Compute the HMAC of a record, over everything but the hash itself
+//
+func (a *auditLog) hash(rec *AuditRecord) (string, error) {
+	return hashAuditRecord(a.key, rec)
+}
+
+func hashAuditRecord(key []byte, rec *AuditRecord) (string, error) {
+	unhashed := *rec
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Append a record to the log
+//
+func (a *auditLog) write(rec *AuditRecord) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+
+	if a.settings.MaxBytes > 0 && a.size >= a.settings.MaxBytes {
+		err := a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	rec.Seq = a.seq + 1
+	rec.Time = time.Now().UTC()
+	rec.Prev = a.last
+
+	var err error
+	rec.Hash, err = a.hash(rec)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	// a single write per record, so records are never interleaved
+	n, err := a.file.Write(append(data, '\n'))
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	a.seq = rec.Seq
+	a.last = rec.Hash
+	return a.writeHead()
+}
+
+// Return records matching the query, oldest first
+//
+func (a *auditLog) query(q *AuditQuery) ([]*AuditRecord, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*AuditRecord{}
+	for _, filename := range files {
+		err = readAuditFile(filename, func(rec *AuditRecord) bool {
+			if q.matches(rec) {
+				result = append(result, rec)
+			}
+			return q.Limit <= 0 || len(result) < q.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if q.Limit > 0 && len(result) >= q.Limit {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func (a *auditLog) close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	errs := []error{a.file.Sync(), a.file.Close(), a.head.Sync(), a.head.Close()}
+	a.file = nil
+	a.head = nil
+	return errors.Join(errs...)
+}
+
+func (q *AuditQuery) matches(rec *AuditRecord) bool {
+	if q.Role != "" && rec.Role != q.Role {
+		return false
+	}
+	if q.Prefix != "" && !strings.HasPrefix(rec.Key, q.Prefix) {
+		return false
+	}
+	if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && rec.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Read each record in the given file, calling fn for each until it returns false.
+//  An unterminated last line is a record that was never completely written (eg. we stopped mid write), so
+//  is skipped.
+//
+func readAuditFile(filename string, fn func(*AuditRecord) bool) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64 * 1024)
+	lineno := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		lineno++
+
+		rec := &AuditRecord{}
+		err = json.Unmarshal(line, rec)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+
+		if !fn(rec) {
+			return nil
+		}
+	}
+}
+
+// Return the last record in the given file, if any
+//
+func lastAuditRecord(filename string) (*AuditRecord, error) {
+	var last *AuditRecord
+	err := readAuditFile(filename, func(rec *AuditRecord) bool {
+		last = rec
+		return true
+	})
+	return last, err
+}
+
+// Check the audit log described by the config is intact: each record's hash is correct, sequence numbers
+// are contiguous from the first record & each record holds the hash of the record before it, and the log
+// reaches the head written alongside it (so records removed from the end are noticed too).
+//  Returns the number of records checked. Rotated files must all be kept for the log to verify.
+//
+func VerifyAudit(config *Config) (int, error) {
+	if config.Audit == nil || config.Audit.File == "" {
+		return 0, fmt.Errorf("no audit log is configured")
+	}
+
+	key, err := toKey(config.Misc.EncryptionKey)
+	if err != nil {
+		return 0, err
+	}
+	hkey := auditKey(key)
+
+	files, err := auditFiles(config.Audit.File)
+	if err != nil {
+		return 0, err
+	}
+
+	head, err := readAuditHead(config.Audit.File, hkey)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var prev *AuditRecord
+	for _, filename := range files {
+		var problem error
+		err = readAuditFile(filename, func(rec *AuditRecord) bool {
+			expect, err := hashAuditRecord(hkey, rec)
+			if err != nil {
+				problem = err
+				return false
+			}
+
+			if !hmac.Equal([]byte(expect), []byte(rec.Hash)) {
+				problem = fmt.Errorf("%s: record %d has been altered", filename, rec.Seq)
+			} else if prev == nil && rec.Seq != 1 {
+				problem = fmt.Errorf("%s: records before %d are missing", filename, rec.Seq)
+			} else if prev == nil && rec.Prev != "" {
+				problem = fmt.Errorf("%s: record %d should be the first record", filename, rec.Seq)
+			} else if head != nil && rec.Seq == head.Seq && rec.Hash != head.Hash {
+				problem = fmt.Errorf("%s: record %d is not the record at the head", filename, rec.Seq)
+			} else if prev != nil && rec.Seq != prev.Seq + 1 {
+				problem = fmt.Errorf("%s: expected record %d, found %d", filename, prev.Seq + 1, rec.Seq)
+			} else if prev != nil && rec.Prev != prev.Hash {
+				problem = fmt.Errorf("%s: record %d does not follow record %d", filename, rec.Seq, prev.Seq)
+			}
+			if problem != nil {
+				return false
+			}
+
+			prev = rec
+			count++
+			return true
+		})
+		if err != nil {
+			return count, err
+		}
+		if problem != nil {
+			return count, problem
+		}
+	}
+
+	if head == nil && prev != nil {
+		return count, fmt.Errorf("%s%s is missing, so records may have been removed from the end", config.Audit.File, auditHeadSuffix)
+	}
+	if head != nil && prev == nil {
+		return count, fmt.Errorf("no records remain, but the head is record %d", head.Seq)
+	}
+	if head != nil && prev.Seq < head.Seq {
+		return count, fmt.Errorf("records after %d are missing, the head is record %d", prev.Seq, head.Seq)
+	}
+	return count, nil
+}
+
+// Record the outcome of a mutation in the audit log. Successful mutations & permission denials are recorded,
+// other failures are not (nothing happened). The given record need only describe the mutation (action, key &
+// the data written, if any); the rest is filled in. Watchers are told of successful mutations.
+//  Returns the original error, or if the mutation succeeded but couldn't be recorded, the error from the audit log.
+//
+func (s *Silo) recordAudit(user *Role, rec *AuditRecord, err error) error {
+	if err == nil {
+		s.notify(rec)
+	}
+	if s.auditor == nil {
+		return err
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrForbidden) {
+			s.Denied(user, rec.Action, rec.Key, err)
+		}
+		return err
+	}
+
+	rec.Role = user.Id
+	return s.auditor.write(rec)
+}
+
+// Return the size & checksum of some data, as recorded in the audit log
+//
+func auditDigest(data []byte) (int64, string) {
+	sum := sha256.Sum256(data)
+	return int64(len(data)), hex.EncodeToString(sum[:])
+}
+
+// Record that the given user was denied permission to perform some action, returning the given error.
+//  Silo records its own denials; this is for callers that make permission decisions themselves.
+//
+func (s *Silo) Denied(user *Role, action, key string, reason error) error {
+	if s.auditor == nil {
+		return reason
+	}
+
+	err := s.auditor.write(&AuditRecord{
+		Role: user.Id,
+		Action: AuditDenied,
+		Key: key,
+		Detail: fmt.Sprintf("%s: %v", action, reason),
+	})
+	if err != nil {
+		return fmt.Errorf("%w (and unable to write audit log: %v)", reason, err)
+	}
+	return reason
+}
+
+// Query the audit log. Only admins may do this.
+//
+func (s *Silo) Audit(user *Role, q *AuditQuery) ([]*AuditRecord, error) {
+	if !user.CanAdmin {
+		return nil, s.Denied(user, "audit", "", fmt.Errorf("%w: user %s is not permitted to read the audit log", ErrForbidden, user.Id))
+	}
+	if s.auditor == nil {
+		return nil, fmt.Errorf("%w: no audit log is configured", ErrNotFound)
+	}
+	return s.auditor.query(q)
+}
+
+func sameAuditSettings(a, b *auditSettings) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
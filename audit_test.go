@@ -0,0 +1,270 @@
+package silo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Return a config with an audit log, in a fresh temp dir
+//
+func testAuditConfig(t *testing.T, roles ...*Role) *Config {
+	c := testConfig(t, roles...)
+	c.Audit.File = filepath.Join(t.TempDir(), "audit.log")
+	return c
+}
+
+// Write n records to the audit log of a new silo, which is closed again
+//
+func writeAuditRecords(t *testing.T, c *Config, n int) {
+	s, err := NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user := testRole("rw", true, true, true)
+	for i := 0; i < n; i++ {
+		err = s.Store(user, fmt.Sprintf("/k%d", i), []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readLines(t *testing.T, filename string) []string {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(string(data), "\n")
+}
+
+func writeLines(t *testing.T, filename string, lines []string) {
+	err := os.WriteFile(filename, []byte(strings.Join(lines, "")), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditVerify(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+
+	cases := []struct{
+		Name string
+		Intact bool
+		Tamper func(file string, lines []string)
+	}{
+		{"intact", true, func(file string, lines []string) {}},
+		{"altered", false, func(file string, lines []string) {
+			lines[2] = strings.Replace(lines[2], "/k2", "/kx", 1)
+			writeLines(t, file, lines)
+		}},
+		{"removed from the middle", false, func(file string, lines []string) {
+			writeLines(t, file, append(lines[:2], lines[3:]...))
+		}},
+		{"removed from the start", false, func(file string, lines []string) {
+			writeLines(t, file, lines[1:])
+		}},
+		{"removed from the end", false, func(file string, lines []string) {
+			writeLines(t, file, lines[:4])
+		}},
+		{"all removed", false, func(file string, lines []string) {
+			os.Remove(file)
+		}},
+		{"reordered", false, func(file string, lines []string) {
+			lines[1], lines[2] = lines[2], lines[1]
+			writeLines(t, file, lines)
+		}},
+		{"head removed", false, func(file string, lines []string) {
+			os.Remove(file + auditHeadSuffix)
+		}},
+		{"head emptied", false, func(file string, lines []string) {
+			writeLines(t, file + auditHeadSuffix, nil)
+		}},
+		{"head altered", false, func(file string, lines []string) {
+			head := readLines(t, file + auditHeadSuffix)
+			writeLines(t, file + auditHeadSuffix, []string{strings.Replace(head[0], `"Seq":5`, `"Seq":4`, 1)})
+		}},
+	}
+	for _, tc := range cases {
+		c := testAuditConfig(t, rw)
+		writeAuditRecords(t, c, 5)
+
+		tc.Tamper(c.Audit.File, readLines(t, c.Audit.File))
+		count, err := VerifyAudit(c)
+		if tc.Intact && (err != nil || count != 5) {
+			t.Errorf("%s: expected 5 intact records, got %d %v", tc.Name, count, err)
+		} else if !tc.Intact && err == nil {
+			t.Errorf("%s: expected tampering to be found", tc.Name)
+		}
+	}
+}
+
+func TestAuditReopenedWithoutRecords(t *testing.T) {
+	c := testAuditConfig(t, testRole("rw", true, true, true))
+	writeAuditRecords(t, c, 0)
+	writeAuditRecords(t, c, 2)
+
+	count, err := VerifyAudit(c)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 intact records, got %d %v", count, err)
+	}
+}
+
+func TestAuditRemovedRecordsRefused(t *testing.T) {
+	c := testAuditConfig(t, testRole("rw", true, true, true))
+	writeAuditRecords(t, c, 3)
+
+	lines := readLines(t, c.Audit.File)
+	writeLines(t, c.Audit.File, lines[:2])
+	_, err := NewSilo(c)
+	if err == nil {
+		t.Fatalf("expected a silo whose audit log has lost records not to start")
+	}
+}
+
+func TestAuditTornRecord(t *testing.T) {
+	c := testAuditConfig(t, testRole("rw", true, true, true))
+	writeAuditRecords(t, c, 3)
+
+	// as if we stopped part way through writing a record
+	f, err := os.OpenFile(c.Audit.File, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"Seq":4,"Ti`))
+	f.Close()
+
+	count, err := VerifyAudit(c)
+	if err != nil || count != 3 {
+		t.Fatalf("expected the partial record to be skipped, got %d %v", count, err)
+	}
+
+	writeAuditRecords(t, c, 2)
+	count, err = VerifyAudit(c)
+	if err != nil || count != 5 {
+		t.Fatalf("expected the partial record to be removed & the chain to carry on, got %d %v", count, err)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	c := testAuditConfig(t, testRole("rw", true, true, true))
+	c.Audit.MaxBytes = 1
+	writeAuditRecords(t, c, 4)
+
+	files, err := auditFiles(c.Audit.File)
+	if err != nil || len(files) != 4 {
+		t.Fatalf("expected a file per record, got %v %v", files, err)
+	}
+	count, err := VerifyAudit(c)
+	if err != nil || count != 4 {
+		t.Fatalf("expected 4 intact records across files, got %d %v", count, err)
+	}
+
+	os.Remove(files[0])
+	_, err = VerifyAudit(c)
+	if err == nil {
+		t.Fatalf("expected a removed rotated file to be noticed")
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	admin := testRole("admin", true, true, true)
+	admin.CanAdmin = true
+	reader := testRole("reader", true, false, false)
+	s := openTestSilo(t, testAuditConfig(t, admin, reader))
+
+	for _, key := range []string{"/logs/a", "/logs/b", "/other"} {
+		err := s.Store(admin, key, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Store(reader, "/logs/c", []byte("data"))
+
+	cases := []struct{
+		Query AuditQuery
+		Keys string
+	}{
+		{AuditQuery{}, "/logs/a /logs/b /other /logs/c "},
+		{AuditQuery{Prefix: "/logs/"}, "/logs/a /logs/b /logs/c "},
+		{AuditQuery{Role: "reader"}, "/logs/c "},
+		{AuditQuery{Limit: 2}, "/logs/a /logs/b "},
+	}
+	for i, c := range cases {
+		records, err := s.Audit(admin, &c.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := ""
+		for _, rec := range records {
+			keys += rec.Key + " "
+		}
+		if keys != c.Keys {
+			t.Errorf("%d: expected %q, got %q", i, c.Keys, keys)
+		}
+	}
+
+	_, err := s.Audit(reader, &AuditQuery{})
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected non admins to be refused, got %v", err)
+	}
+}
+
+func TestDeniedWhenAuditFails(t *testing.T) {
+	reader := testRole("reader", true, false, false)
+	s := openTestSilo(t, testAuditConfig(t, reader))
+
+	// the log can't be written to
+	err := s.auditor.file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Denied(reader, "put", "/a", fmt.Errorf("%w: not permitted", ErrForbidden))
+	if !errors.Is(err, ErrForbidden) || !strings.Contains(err.Error(), "unable to write audit log") {
+		t.Fatalf("expected the denial to still be forbidden & mention the audit log, got %v", err)
+	}
+	_, err = s.Audit(reader, &AuditQuery{})
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected silo's own denials to be forbidden, got %v", err)
+	}
+}
+
+func TestFailedStartClosesAuditLog(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("needs /proc to count open files")
+	}
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	c := testAuditConfig(t)
+	openTestSilo(t, c).Close()
+	store, err := newFilesystemStorge(c.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(usageKey, []byte("not a ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	before := openFiles()
+	_, err = NewSilo(c)
+	if err == nil {
+		t.Fatalf("expected a corrupt usage ledger to stop us starting")
+	}
+	if after := openFiles(); after != before {
+		t.Fatalf("expected the audit log to be closed again, had %d open files & now %d", before, after)
+	}
+}
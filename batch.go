@@ -0,0 +1,198 @@
+package silo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Operations that can be included in a batch
+//
+const (
+	BatchGet = "get"
+	BatchPut = "put"
+	BatchDelete = "delete"
+	BatchExists = "exists"
+)
+
+// A single operation in a batch. Data is only used by put.
+//
+type BatchOp struct {
+	Op string
+	Key string
+	Data []byte `json:",omitempty"`
+}
+
+// The outcome of a single operation in a batch. Err is nil if the operation succeeded; Data is set by get & Exists
+// by exists.
+//
+type BatchResult struct {
+	Op string
+	Key string
+	Data []byte
+	Exists bool
+	Err error
+}
+
+// Perform a list of operations for the given user, in order, returning the outcome of each. Each operation is
+// checked & recorded just as if it were performed alone; one failing doesn't stop the rest.
+//  If atomic is set, either all operations succeed or none take effect. This requires transactional storage.
+//  An error is only returned if the batch as a whole is refused, in which case nothing was done, or if an atomic
+//  batch was committed but can't be applied yet: then the results are returned too, with an error wrapping
+//  ErrPending, & the batch is applied in the background.
+//
+func (s *Silo) Batch(user *Role, ops []*BatchOp, atomic bool) ([]*BatchResult, error) {
+	conf := s.config()
+	if conf.Misc.MaxBatchOps > 0 && len(ops) > conf.Misc.MaxBatchOps {
+		return nil, fmt.Errorf("%w: maxbatchops is currently %d", ErrTooLarge, conf.Misc.MaxBatchOps)
+	}
+
+	size := int64(0)
+	for i, op := range ops {
+		if op == nil {
+			return nil, fmt.Errorf("%w: batch operation %d is empty", ErrBadRequest, i + 1)
+		}
+		switch op.Op {
+		case BatchGet, BatchPut, BatchDelete, BatchExists:
+		default:
+			return nil, fmt.Errorf("%w: unknown batch operation %q", ErrBadRequest, op.Op)
+		}
+		size += int64(len(op.Data))
+	}
+	if conf.Misc.MaxBatchBytes > 0 && size > conf.Misc.MaxBatchBytes {
+		return nil, fmt.Errorf("%w: maxbatchbytes is currently %d", ErrTooLarge, conf.Misc.MaxBatchBytes)
+	}
+
+	if atomic {
+		return s.atomicBatch(user, ops, size, conf)
+	}
+
+	results := []*BatchResult{}
+	for _, op := range ops {
+		r := s.batchOp(user, op, &size, conf.Misc.MaxBatchBytes)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// Perform a single operation of a batch. Data read is counted towards the batch's size, which is kept under max.
+//
+func (s *Silo) batchOp(user *Role, op *BatchOp, size *int64, max int64) *BatchResult {
+	r := &BatchResult{Op: op.Op, Key: op.Key}
+
+	switch op.Op {
+	case BatchGet:
+		var info *ObjectInfo
+		info, r.Err = s.Stat(user, op.Key)
+		if r.Err != nil {
+			break
+		}
+		if max > 0 && *size + info.Size > max {
+			r.Err = fmt.Errorf("%w: maxbatchbytes is currently %d", ErrTooLarge, max)
+			break
+		}
+
+		r.Data, r.Err = s.Get(user, op.Key)
+		*size += int64(len(r.Data))
+	case BatchPut:
+		r.Err = s.Store(user, op.Key, op.Data)
+	case BatchDelete:
+		r.Err = s.Remove(user, op.Key)
+	case BatchExists:
+		// existence is itself something only readers may know
+		if !user.CanGet {
+			r.Err = s.Denied(user, "exists", op.Key, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, user.Id))
+			break
+		}
+		r.Err = s.checkKey(op.Key)
+		if r.Err == nil {
+			r.Exists, r.Err = s.Exists(op.Key)
+		}
+	}
+	return r
+}
+
+// A batch being applied atomically, in a transaction. Data read is counted towards the batch's size.
+//
+type atomicBatch struct {
+	t *Txn
+	size int64
+}
+
+// Apply a batch in a transaction, so either every operation succeeds or none take effect. If an operation fails,
+// the others report ErrAborted. If the batch is committed but can't be applied yet, the results are returned with
+// an error wrapping ErrPending (see Txn.Commit).
+//
+func (s *Silo) atomicBatch(user *Role, ops []*BatchOp, size int64, conf *Config) ([]*BatchResult, error) {
+	keys := []string{}
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	t, err := s.begin(user, keys, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &atomicBatch{t: t, size: size}
+	results := []*BatchResult{}
+	failed := -1
+	for i, op := range ops {
+		r := b.apply(op)
+		results = append(results, r)
+		if r.Err != nil {
+			failed = i
+			break
+		}
+	}
+
+	if failed < 0 {
+		err = t.Commit()
+		if errors.Is(err, ErrPending) {
+			return results, err
+		} else if err != nil {
+			return nil, err
+		}
+		return results, nil
+	}
+
+	t.Rollback()
+	for i, op := range ops {
+		if i == failed {
+			continue
+		}
+		aborted := &BatchResult{Op: op.Op, Key: op.Key, Err: fmt.Errorf("%w: operation %d of the batch failed", ErrAborted, failed + 1)}
+		if i < len(results) {
+			results[i] = aborted
+		} else {
+			results = append(results, aborted)
+		}
+	}
+	return results, nil
+}
+
+// Apply a single operation of the batch
+//
+func (b *atomicBatch) apply(op *BatchOp) *BatchResult {
+	r := &BatchResult{Op: op.Op, Key: op.Key}
+
+	switch op.Op {
+	case BatchGet:
+		_, written := b.t.written[op.Key]
+		if !written {
+			return b.t.s.batchOp(b.t.user, op, &b.size, b.t.conf.Misc.MaxBatchBytes)
+		}
+
+		r.Data, r.Err = b.t.Get(op.Key)
+		if max := b.t.conf.Misc.MaxBatchBytes; r.Err == nil && max > 0 && b.size + int64(len(r.Data)) > max {
+			r.Data = nil
+			r.Err = fmt.Errorf("%w: maxbatchbytes is currently %d", ErrTooLarge, max)
+		}
+		b.size += int64(len(r.Data))
+	case BatchExists:
+		r.Exists, r.Err = b.t.Exists(op.Key)
+	case BatchPut:
+		r.Err = b.t.Put(op.Key, op.Data)
+	case BatchDelete:
+		r.Err = b.t.Delete(op.Key)
+	}
+	return r
+}
@@ -0,0 +1,103 @@
+package silo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	reader := testRole("reader", true, false, false)
+	s := openTestSilo(t, testConfig(t, rw, reader))
+
+	err := s.Store(rw, "/a", []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each operation is checked as it would be alone, & one failing doesn't stop the rest
+	results, err := s.Batch(reader, []*BatchOp{
+		{Op: BatchGet, Key: "/a"},
+		{Op: BatchPut, Key: "/b", Data: []byte("two")},
+		{Op: BatchDelete, Key: "/a"},
+		{Op: BatchExists, Key: "/a"},
+		{Op: BatchGet, Key: "/missing"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []error{nil, ErrForbidden, ErrForbidden, nil, ErrNotFound}
+	for i, r := range results {
+		if expect[i] == nil && r.Err != nil || expect[i] != nil && !errors.Is(r.Err, expect[i]) {
+			t.Errorf("%d %s: expected %v, got %v", i, r.Op, expect[i], r.Err)
+		}
+	}
+	if string(results[0].Data) != "one" || !results[3].Exists {
+		t.Fatalf("expected the get & exists to succeed, got %q %v", results[0].Data, results[3].Exists)
+	}
+
+	// atomically, the first failure aborts the rest
+	results, err = s.Batch(rw, []*BatchOp{
+		{Op: BatchPut, Key: "/b", Data: []byte("two")},
+		{Op: BatchGet, Key: "/b"},
+		{Op: BatchDelete, Key: "/missing"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []error{ErrAborted, ErrAborted, ErrNotFound}
+	for i, r := range results {
+		if !errors.Is(r.Err, expect[i]) {
+			t.Errorf("%d %s: expected %v, got %v", i, r.Op, expect[i], r.Err)
+		}
+	}
+	_, err = s.Get(rw, "/b")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected nothing from the failed batch to be stored, got %v", err)
+	}
+}
+
+func TestBatchRefused(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	c := testConfig(t, rw)
+	c.Misc.MaxBatchOps = 2
+	c.Misc.MaxBatchBytes = 10
+	s := openTestSilo(t, c)
+
+	for _, key := range []string{"/a", "/b"} {
+		err := s.Store(rw, key, []byte("123456"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct{
+		Name string
+		Ops []*BatchOp
+		Err error
+	}{
+		{"empty operations", []*BatchOp{nil}, ErrBadRequest},
+		{"unknown operations", []*BatchOp{{Op: "copy", Key: "/a"}}, ErrBadRequest},
+		{"too many operations", []*BatchOp{{Op: BatchGet, Key: "/a"}, {Op: BatchGet, Key: "/a"}, {Op: BatchGet, Key: "/a"}}, ErrTooLarge},
+		{"too much data", []*BatchOp{{Op: BatchPut, Key: "/c", Data: []byte("123456")}, {Op: BatchPut, Key: "/d", Data: []byte("123456")}}, ErrTooLarge},
+	}
+	for _, c := range cases {
+		for _, atomic := range []bool{false, true} {
+			_, err := s.Batch(rw, c.Ops, atomic)
+			if !errors.Is(err, c.Err) {
+				t.Errorf("%s (atomic %v): expected %v, got %v", c.Name, atomic, c.Err, err)
+			}
+		}
+	}
+
+	// data read counts too, so the second get doesn't fit
+	for _, atomic := range []bool{false, true} {
+		results, err := s.Batch(rw, []*BatchOp{{Op: BatchGet, Key: "/a"}, {Op: BatchGet, Key: "/b"}}, atomic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Err != nil && !atomic || !errors.Is(results[1].Err, ErrTooLarge) {
+			t.Errorf("atomic %v: expected the second get to be too large, got %v %v", atomic, results[0].Err, results[1].Err)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package silo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"github.com/gtank/cryptopasta"
+)
+
+// Objects are stored in a chunked format, so that part of an object can be read & decrypted without the rest:
+//
+//  header: magic (8 bytes) | chunk size (uint32, big endian) | object id (16 random bytes)
+//  chunks: nonce (12 bytes) | cyphertext | tag (16 bytes), each holding up to chunk size bytes of plaintext
+//
+// Each chunk is sealed with AES-256-GCM, authenticating the format version, the object id, its index & whether it's
+// the last chunk, so chunks can't be reordered, dropped, moved between objects or the object truncated without
+// decryption failing. There's always at least one chunk.
+//
+// Objects written before the chunked format are a single cryptopasta (AES-256-GCM) cyphertext, which never begins
+// with the magic (barring a 1 in 2^64 nonce).
+//
+const (
+	chunkMagic = "silo\x00ck2"
+	chunkIdSize = 16
+	chunkHeaderSize = int64(len(chunkMagic) + 4 + chunkIdSize)
+	chunkNonceSize = 12
+	chunkOverhead = int64(chunkNonceSize + 16)
+
+	// how much plaintext new objects hold per chunk
+	defaultChunkSize = 64 * 1024
+)
+
+// Encrypts & decrypts chunks of an object
+//
+type chunkCipher struct {
+	aead cipher.AEAD
+	size int64 // plaintext bytes per chunk
+	id []byte // the object's id, from its header
+}
+
+// Return a cipher for a new object, with a new random id
+//
+func newObjectCipher(key *[32]byte, size int64) (*chunkCipher, error) {
+	id := make([]byte, chunkIdSize)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkCipher(key, size, id)
+}
+
+func newChunkCipher(key *[32]byte, size int64, id []byte) (*chunkCipher, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{aead: aead, size: size, id: id}, nil
+}
+
+// The additional data authenticated with each chunk
+//
+func (c *chunkCipher) aad(index int64, last bool) []byte {
+	aad := make([]byte, 0, len(chunkMagic) + len(c.id) + 9)
+	aad = append(aad, chunkMagic...)
+	aad = append(aad, c.id...)
+	aad = binary.BigEndian.AppendUint64(aad, uint64(index))
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// Encrypt a single chunk
+//
+func (c *chunkCipher) seal(index int64, last bool, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, chunkNonceSize, chunkNonceSize + len(plaintext) + c.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, c.aad(index, last)), nil
+}
+
+// Decrypt a single chunk
+//
+func (c *chunkCipher) open(index int64, last bool, chunk []byte) ([]byte, error) {
+	if int64(len(chunk)) < chunkOverhead {
+		return nil, fmt.Errorf("chunk %d is truncated", index)
+	}
+	return c.aead.Open(nil, chunk[:chunkNonceSize], chunk[chunkNonceSize:], c.aad(index, last))
+}
+
+// Return the header of an object in this format
+//
+func (c *chunkCipher) header() []byte {
+	h := make([]byte, chunkHeaderSize)
+	copy(h, chunkMagic)
+	binary.BigEndian.PutUint32(h[len(chunkMagic):], uint32(c.size))
+	copy(h[len(chunkMagic) + 4:], c.id)
+	return h
+}
+
+// Encrypt a whole object
+//
+func (c *chunkCipher) encrypt(data []byte) ([]byte, error) {
+	layout := &chunkLayout{chunkSize: c.size}
+	result := bytes.NewBuffer(make([]byte, 0, chunkHeaderSize + int64(len(data)) + layout.chunksFor(int64(len(data))) * chunkOverhead))
+
+	w := c.newWriter(result)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	return result.Bytes(), err
+}
+
+// Encrypts an object as it's written, writing the chunks out to w.
+//
+type chunkWriter struct {
+	c *chunkCipher
+	w io.Writer
+	buf []byte
+	index int64
+	started bool
+}
+
+func (c *chunkCipher) newWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{c: c, w: w, buf: make([]byte, 0, c.size)}
+}
+
+// Write some plaintext. Chunks are written out once full, but we always keep back the last one, since we
+// don't know it's the last until Close.
+//
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if int64(len(cw.buf)) == cw.c.size {
+			err := cw.flush(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := int(cw.c.size) - len(cw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		cw.buf = append(cw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Write out the last chunk. This doesn't close the underlying writer.
+//
+func (cw *chunkWriter) Close() error {
+	return cw.flush(true)
+}
+
+func (cw *chunkWriter) flush(last bool) error {
+	if !cw.started {
+		_, err := cw.w.Write(cw.c.header())
+		if err != nil {
+			return err
+		}
+		cw.started = true
+	}
+
+	chunk, err := cw.c.seal(cw.index, last, cw.buf)
+	if err != nil {
+		return err
+	}
+	_, err = cw.w.Write(chunk)
+	if err != nil {
+		return err
+	}
+
+	cw.index++
+	cw.buf = cw.buf[:0]
+	return nil
+}
+
+// Decrypt the given chunks of an object, the first of which has the given index.
+//
+func (c *chunkCipher) decrypt(layout *chunkLayout, first int64, stored []byte) ([]byte, error) {
+	result := []byte{}
+	stride := c.size + chunkOverhead
+	for i := int64(0); int64(len(stored)) > i * stride; i++ {
+		end := (i + 1) * stride
+		if end > int64(len(stored)) {
+			end = int64(len(stored))
+		}
+
+		index := first + i
+		plaintext, err := c.open(index, index == layout.chunks() - 1, stored[i * stride:end])
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt chunk %d: %v", index, err)
+		}
+		result = append(result, plaintext...)
+	}
+	return result, nil
+}
+
+// Where everything is in a stored object
+//
+type chunkLayout struct {
+	chunkSize int64
+	storedSize int64
+	id []byte
+}
+
+// Read the layout from the start of a stored object, returning nil if it's not in the chunked format.
+//
+func parseChunkLayout(header []byte, storedSize int64) *chunkLayout {
+	if int64(len(header)) < chunkHeaderSize || string(header[:len(chunkMagic)]) != chunkMagic {
+		return nil
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[len(chunkMagic):]))
+	if size == 0 || storedSize < chunkHeaderSize + chunkOverhead {
+		return nil
+	}
+	id := append([]byte(nil), header[len(chunkMagic) + 4:chunkHeaderSize]...)
+	return &chunkLayout{chunkSize: size, storedSize: storedSize, id: id}
+}
+
+// Return a cipher for the chunks of an object with this layout
+//
+func (l *chunkLayout) cipher(key *[32]byte) (*chunkCipher, error) {
+	return newChunkCipher(key, l.chunkSize, l.id)
+}
+
+// How many chunks hold the given number of plaintext bytes (always at least one)
+//
+func (l *chunkLayout) chunksFor(plainSize int64) int64 {
+	if plainSize == 0 {
+		return 1
+	}
+	return (plainSize + l.chunkSize - 1) / l.chunkSize
+}
+
+// How many chunks the object has
+//
+func (l *chunkLayout) chunks() int64 {
+	stride := l.chunkSize + chunkOverhead
+	return (l.storedSize - chunkHeaderSize + stride - 1) / stride
+}
+
+// How many bytes of plaintext the object holds
+//
+func (l *chunkLayout) plainSize() int64 {
+	return l.storedSize - chunkHeaderSize - l.chunks() * chunkOverhead
+}
+
+// Where the given chunk starts in the stored object
+//
+func (l *chunkLayout) offset(index int64) int64 {
+	return chunkHeaderSize + index * (l.chunkSize + chunkOverhead)
+}
+
+// Return the range of stored bytes holding the chunks that cover the given plaintext range, & the index of the
+// first of those chunks.
+//
+func (l *chunkLayout) span(offset, length int64) (int64, int64, int64) {
+	first := offset / l.chunkSize
+	last := (offset + length - 1) / l.chunkSize
+	if length == 0 {
+		last = first
+	}
+
+	start := l.offset(first)
+	end := l.offset(last + 1)
+	if end > l.storedSize {
+		end = l.storedSize
+	}
+	return first, start, end - start
+}
+
+// An identifier that changes whenever the object does. Every write re-encrypts at least the last chunk with a
+// new random nonce, so the nonce of the last chunk (& the stored size) is enough.
+//
+func chunkETag(storedSize int64, lastNonce []byte) string {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, storedSize)
+	h.Write(lastNonce)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Encrypt an object for storage, in the chunked format
+//
+func (s *Silo) encryptObject(data []byte) ([]byte, error) {
+	c, err := newObjectCipher(s.key, defaultChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return c.encrypt(data)
+}
+
+// Decrypt a whole stored object, in either format
+//
+func (s *Silo) decryptObject(stored []byte) ([]byte, error) {
+	layout := parseChunkLayout(stored, int64(len(stored)))
+	if layout == nil {
+		return cryptopasta.Decrypt(stored, s.key)
+	}
+
+	c, err := layout.cipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return c.decrypt(layout, 0, stored[chunkHeaderSize:])
+}
+
+// Return the size & etag of a stored object, along with its layout (nil if it's in the old, unchunked format).
+//  Only the header & the last chunk's nonce are read.
+//
+func (s *Silo) stat(key string) (*ObjectInfo, *chunkLayout, error) {
+	r, err := s.open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	return statObject(key, r)
+}
+
+// Return the size, etag & layout of an object opened for reading.
+//
+func statObject(key string, r ObjectReader) (*ObjectInfo, *chunkLayout, error) {
+	size := r.Size()
+	header, err := readAt(r, 0, chunkHeaderSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layout := parseChunkLayout(header, size)
+	if layout == nil {
+		// a single cyphertext, beginning with its nonce
+		if int64(len(header)) < chunkNonceSize || size < chunkOverhead {
+			return nil, nil, fmt.Errorf("stored object %s is truncated", key)
+		}
+		return &ObjectInfo{Size: size - chunkOverhead, ETag: chunkETag(size, header[:chunkNonceSize])}, nil, nil
+	}
+
+	nonce, err := readAt(r, layout.offset(layout.chunks() - 1), chunkNonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ObjectInfo{Size: layout.plainSize(), ETag: chunkETag(size, nonce)}, layout, nil
+}
+
+// Append data to a stored object, creating it if it doesn't exist. Only the last chunk is decrypted & sealed
+// again (it's no longer the last); earlier chunks are left as they are.
+//  Objects in the old format, or in storage that can't rewrite the end of an object, are rewritten in full.
+//  Nb. the caller is expected to hold the key's lock.
+//
+func (s *Silo) appendObject(key string, exists bool, layout *chunkLayout, data []byte) error {
+	if !exists {
+		cyphertext, err := s.encryptObject(data)
+		if err != nil {
+			return err
+		}
+		return s.store.Put(key, cyphertext)
+	}
+
+	appending, ok := s.store.(AppendingStorage)
+	if layout != nil && ok {
+		c, err := layout.cipher(s.key)
+		if err != nil {
+			return err
+		}
+
+		last := layout.chunks() - 1
+		start := layout.offset(last)
+		stored, err := s.store.GetRange(key, start, layout.storedSize - start)
+		if err != nil {
+			return err
+		}
+		plaintext, err := c.decrypt(layout, last, stored)
+		if err != nil {
+			return err
+		}
+
+		// carry on writing from the last chunk, as if we'd never stopped
+		size := int64(len(plaintext) + len(data))
+		tail := bytes.NewBuffer(make([]byte, 0, size + layout.chunksFor(size) * chunkOverhead))
+		cw := c.newWriter(tail)
+		cw.index = last
+		cw.started = true
+		cw.Write(plaintext)
+		cw.Write(data)
+		err = cw.Close()
+		if err != nil {
+			return err
+		}
+
+		err = appending.ReplaceTail(key, start, tail.Bytes())
+		if err != errNotSupported {
+			return err
+		}
+	}
+
+	cyphertext, err := s.store.Get(key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := s.decryptObject(cyphertext)
+	if err != nil {
+		return err
+	}
+	cyphertext, err = s.encryptObject(append(plaintext, data...))
+	if err != nil {
+		return err
+	}
+	return s.store.Put(key, cyphertext)
+}
+
+// Decrypt a stored object a chunk at a time, calling fn with each chunk's plaintext, so that large objects needn't
+// be held in memory. Objects in the old format are decrypted in one go.
+//
+func (s *Silo) readChunks(key string, fn func([]byte) error) error {
+	r, err := s.open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, layout, err := statObject(key, r)
+	if err != nil {
+		return err
+	}
+
+	if layout == nil {
+		cyphertext, err := readAt(r, 0, r.Size())
+		if err != nil {
+			return err
+		}
+		data, err := cryptopasta.Decrypt(cyphertext, s.key)
+		if err != nil {
+			return err
+		}
+		return fn(data)
+	}
+
+	c, err := layout.cipher(s.key)
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < layout.chunks(); i++ {
+		stored, err := readAt(r, layout.offset(i), layout.chunkSize + chunkOverhead)
+		if err != nil {
+			return err
+		}
+
+		plaintext, err := c.decrypt(layout, i, stored)
+		if err != nil {
+			return err
+		}
+
+		err = fn(plaintext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open a stored object for reading. Where the storage supports it the object is opened once, so that reading it in
+// several pieces is consistent even if it's replaced meanwhile; otherwise each read goes to storage.
+//
+func (s *Silo) open(key string) (ObjectReader, error) {
+	opening, ok := s.store.(OpeningStorage)
+	if ok {
+		r, err := opening.Open(key)
+		if err != errNotSupported {
+			return r, err
+		}
+	}
+
+	size, err := s.store.Size(key)
+	if err != nil {
+		return nil, err
+	}
+	return &storedObject{store: s.store, key: key, size: size}, nil
+}
+
+// An object read from storage that can't open objects, a range at a time
+//
+type storedObject struct {
+	store Storage
+	key string
+	size int64
+}
+
+func (o *storedObject) ReadAt(p []byte, offset int64) (int, error) {
+	data, err := o.store.GetRange(o.key, offset, int64(len(p)))
+	n := copy(p, data)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *storedObject) Size() int64 {
+	return o.size
+}
+
+func (o *storedObject) Close() error {
+	return nil
+}
+
+// Read up to length bytes from offset, fewer if the object ends first.
+//
+func readAt(r ObjectReader, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	n, err := r.ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:n], err
+}
@@ -0,0 +1,386 @@
+package silo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"github.com/gtank/cryptopasta"
+)
+
+var testKey = &[32]byte{1, 2, 3}
+
+func randomBytes(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Encrypt data in chunks of the given size, returning the stored object & its layout
+//
+func testChunked(t *testing.T, size int64, data []byte) (*chunkCipher, []byte, *chunkLayout) {
+	c, err := newObjectCipher(testKey, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := c.encrypt(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := parseChunkLayout(stored, int64(len(stored)))
+	if layout == nil {
+		t.Fatalf("expected the chunked format")
+	}
+	return c, stored, layout
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	const size = 16
+	cases := []struct{
+		Len int
+		Chunks int64
+	}{
+		{0, 1},
+		{1, 1},
+		{size - 1, 1},
+		{size, 1},
+		{size + 1, 2},
+		{3 * size, 3},
+		{3 * size + 5, 4},
+	}
+	for _, tc := range cases {
+		data := randomBytes(t, tc.Len)
+		c, stored, layout := testChunked(t, size, data)
+
+		if layout.chunks() != tc.Chunks || layout.plainSize() != int64(tc.Len) {
+			t.Errorf("%d bytes: expected %d chunks, got %d chunks of %d bytes", tc.Len, tc.Chunks, layout.chunks(), layout.plainSize())
+		}
+		plaintext, err := c.decrypt(layout, 0, stored[chunkHeaderSize:])
+		if err != nil || !bytes.Equal(plaintext, data) {
+			t.Errorf("%d bytes: round trip failed: %v", tc.Len, err)
+		}
+
+		// written a little at a time
+		buf := &bytes.Buffer{}
+		w := c.newWriter(buf)
+		for i := range data {
+			w.Write(data[i:i + 1])
+		}
+		w.Close()
+		plaintext, err = c.decrypt(layout, 0, buf.Bytes()[chunkHeaderSize:])
+		if err != nil || !bytes.Equal(plaintext, data) || buf.Len() != len(stored) {
+			t.Errorf("%d bytes: round trip of small writes failed: %v", tc.Len, err)
+		}
+	}
+}
+
+func TestChunkTampering(t *testing.T) {
+	const size = 16
+	data := randomBytes(t, 3 * size)
+	c, stored, layout := testChunked(t, size, data)
+	stride := int(size + chunkOverhead)
+	header := int(chunkHeaderSize)
+	chunk := func(i int) []byte { return stored[header + i * stride:header + (i + 1) * stride] }
+
+	cases := []struct{
+		Name string
+		Stored []byte
+	}{
+		{"truncated at a chunk boundary", stored[:header + 2 * stride]},
+		{"truncated mid chunk", stored[:len(stored) - 5]},
+		{"chunks reordered", bytes.Join([][]byte{stored[:header], chunk(1), chunk(0), chunk(2)}, nil)},
+		{"chunk dropped", bytes.Join([][]byte{stored[:header], chunk(0), chunk(2)}, nil)},
+		{"last chunk repeated", bytes.Join([][]byte{stored[:header], chunk(0), chunk(1), chunk(2), chunk(2)}, nil)},
+		{"bit flipped", append(append([]byte{}, stored[:header + 20]...), append([]byte{stored[header + 20] ^ 1}, stored[header + 21:]...)...)},
+	}
+	for _, tc := range cases {
+		l := parseChunkLayout(tc.Stored, int64(len(tc.Stored)))
+		if l == nil {
+			continue // not even recognised, which is also a failure to read
+		}
+		_, err := c.decrypt(l, 0, tc.Stored[chunkHeaderSize:])
+		if err == nil {
+			t.Errorf("%s: expected decryption to fail", tc.Name)
+		}
+	}
+
+	// or moved between objects encrypted with the same key
+	_, other, _ := testChunked(t, size, data)
+	spliced := bytes.Join([][]byte{stored[:header], chunk(0), other[header + stride:header + 2 * stride], chunk(2)}, nil)
+	_, err := c.decrypt(layout, 0, spliced[chunkHeaderSize:])
+	if err == nil {
+		t.Errorf("expected a chunk from another object to fail to decrypt")
+	}
+	withOtherId := append(append([]byte{}, other[:header]...), stored[header:]...)
+	l := parseChunkLayout(withOtherId, int64(len(withOtherId)))
+	oc, err := l.cipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = oc.decrypt(l, 0, withOtherId[chunkHeaderSize:])
+	if err == nil {
+		t.Errorf("expected chunks to fail to decrypt under another object's header")
+	}
+
+	// each chunk is bound to its index & whether it's last
+	_, err = c.open(0, true, chunk(0))
+	if err == nil {
+		t.Errorf("expected a chunk to fail to open as the last chunk when it isn't")
+	}
+	_, err = c.open(1, false, chunk(0))
+	if err == nil {
+		t.Errorf("expected a chunk to fail to open at another index")
+	}
+	_, err = c.open(2, true, chunk(2))
+	if err != nil || layout.chunks() != 3 {
+		t.Errorf("expected the last chunk to open as the last chunk, got %v", err)
+	}
+}
+
+func TestChunkSpan(t *testing.T) {
+	layout := &chunkLayout{chunkSize: 10, storedSize: chunkHeaderSize + 3 * (10 + chunkOverhead)}
+	stride := 10 + chunkOverhead
+	cases := []struct{
+		Offset, Length int64
+		First, Start, Size int64
+	}{
+		{0, 10, 0, chunkHeaderSize, stride},
+		{9, 2, 0, chunkHeaderSize, 2 * stride},
+		{10, 10, 1, chunkHeaderSize + stride, stride},
+		{25, 5, 2, chunkHeaderSize + 2 * stride, stride},
+		{5, 0, 0, chunkHeaderSize, stride},
+	}
+	for _, c := range cases {
+		first, start, size := layout.span(c.Offset, c.Length)
+		if first != c.First || start != c.Start || size != c.Size {
+			t.Errorf("%d+%d: expected chunk %d at %d+%d, got %d at %d+%d", c.Offset, c.Length, c.First, c.Start, c.Size, first, start, size)
+		}
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, r))
+	data := randomBytes(t, 3 * defaultChunkSize + 100)
+	err := s.Store(r, "/a", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{
+		Offset, Length int64
+	}{
+		{0, 0},
+		{0, 1},
+		{0, int64(len(data))},
+		{defaultChunkSize - 1, 2},
+		{defaultChunkSize, defaultChunkSize},
+		{defaultChunkSize - 10, 2 * defaultChunkSize + 20},
+		{int64(len(data)) - 1, 1},
+		{int64(len(data)), 0},
+	}
+	for _, c := range cases {
+		got, err := s.GetRange(r, "/a", c.Offset, c.Length)
+		if err != nil || !bytes.Equal(got, data[c.Offset:c.Offset + c.Length]) {
+			t.Errorf("%d+%d: expected the range, got %d bytes %v", c.Offset, c.Length, len(got), err)
+		}
+	}
+
+	for _, c := range [][2]int64{{-1, 1}, {0, int64(len(data)) + 1}, {int64(len(data)), 1}} {
+		_, err := s.GetRange(r, "/a", c[0], c[1])
+		if !errors.Is(err, ErrRangeNotSatisfiable) {
+			t.Errorf("%d+%d: expected range not satisfiable, got %v", c[0], c[1], err)
+		}
+	}
+
+	info, err := s.Stat(r, "/a")
+	if err != nil || info.Size != int64(len(data)) {
+		t.Fatalf("expected the plaintext size, got %+v %v", info, err)
+	}
+}
+
+func TestOpenReadsOneVersion(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, r))
+	data := randomBytes(t, 3 * defaultChunkSize + 100)
+	err := s.Store(r, "/a", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s.Open(r, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	info := obj.Info()
+
+	// replaced part way through reading it
+	first, err := obj.ReadRange(0, defaultChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Store(r, "/a", randomBytes(t, 4 * defaultChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := obj.ReadRange(defaultChunkSize, info.Size - defaultChunkSize)
+	if err != nil || !bytes.Equal(append(first, rest...), data) {
+		t.Fatalf("expected to read the object as it was opened, got %d bytes %v", len(first) + len(rest), err)
+	}
+
+	now, err := s.Stat(r, "/a")
+	if err != nil || now.ETag == info.ETag {
+		t.Fatalf("expected the replacement to have a new etag, got %+v %v", now, err)
+	}
+}
+
+func TestOldFormat(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, r))
+	data := randomBytes(t, 100)
+
+	// as written before the chunked format
+	stored, err := cryptopasta.Encrypt(data, s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.store.Put("/old", stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get(r, "/old")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected old objects to be read, got %v", err)
+	}
+	got, err = s.GetRange(r, "/old", 10, 20)
+	if err != nil || !bytes.Equal(got, data[10:30]) {
+		t.Fatalf("expected ranges of old objects to be read, got %v", err)
+	}
+	info, err := s.Stat(r, "/old")
+	if err != nil || info.Size != 100 {
+		t.Fatalf("expected the size of old objects, got %+v %v", info, err)
+	}
+}
+
+// Storage recording how appends are written: the size of each tail replaced, & how many whole objects are put
+//
+type tailRecorder struct {
+	Storage
+	tails []int
+	puts int
+}
+
+func (r *tailRecorder) ReplaceTail(key string, offset int64, data []byte) error {
+	r.tails = append(r.tails, len(data))
+	return r.Storage.(AppendingStorage).ReplaceTail(key, offset, data)
+}
+
+func (r *tailRecorder) Put(key string, data []byte) error {
+	r.puts++
+	return r.Storage.Put(key, data)
+}
+
+func TestAppendReplacesTail(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	r.CanAppend = true
+	s := openTestSilo(t, testConfig(t, r))
+	data := randomBytes(t, 8 * defaultChunkSize + 100)
+	err := s.Store(r, "/a", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &tailRecorder{Storage: s.store}
+	s.store = recorder
+	for i := 0; i < 3; i++ {
+		more := randomBytes(t, 1000)
+		err = s.Append(r, "/a", more)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, more...)
+	}
+
+	// only the last chunk & what was appended are written by silo; the rest is copied by the storage
+	if recorder.puts != 0 || len(recorder.tails) != 3 {
+		t.Fatalf("expected every append to replace the tail, got %d puts & %d tails", recorder.puts, len(recorder.tails))
+	}
+	for _, n := range recorder.tails {
+		if int64(n) > defaultChunkSize + 1000 + 2 * chunkOverhead {
+			t.Fatalf("expected at most the last chunk to be written again, got %d bytes", n)
+		}
+	}
+	got, err := s.Get(r, "/a")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected every append, got %d bytes %v", len(got), err)
+	}
+}
+
+func TestAppendWhileReading(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	r.CanAppend = true
+	s := openTestSilo(t, testConfig(t, r))
+
+	// appends don't line up with chunks, so each one rewrites the last chunk
+	block := bytes.Repeat([]byte("0123456789abcdef"), 500)
+	appends := 200
+	expect := bytes.Repeat(block, appends)
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for i := 0; i < appends; i++ {
+			err := s.Append(r, "/log", block)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	reads := 0
+	for reading := true; reading; reads++ {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		info, err := s.Stat(r, "/log")
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		// the object only grows, so whatever size we saw can be read, & is what was appended
+		got, err := s.GetRange(r, "/log", 0, info.Size)
+		if err != nil {
+			t.Fatalf("read %d: %v", reads, err)
+		}
+		if !bytes.Equal(got, expect[:info.Size]) {
+			t.Fatalf("read %d: expected the first %d bytes appended", reads, info.Size)
+		}
+
+		err = s.readChunks("/log", func(plaintext []byte) error { return nil })
+		if err != nil {
+			t.Fatalf("read %d: %v", reads, err)
+		}
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	got, err := s.Get(r, "/log")
+	if err != nil || !bytes.Equal(got, expect) {
+		t.Fatalf("expected every append, got %d bytes %v", len(got), err)
+	}
+}
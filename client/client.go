@@ -0,0 +1,599 @@
+/*
+Package client is a Go client for the silo server.
+
+	c, err := client.New("https://silo.example.com:8080", "someone", "password")
+	...
+	err = c.Put(ctx, "/some/key", data)
+	data, err = c.Get(ctx, "/some/key")
+
+Errors returned by the server wrap the same errors silo itself uses, so can be tested with errors.Is, eg.
+errors.Is(err, silo.ErrNotFound).
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/voidshard/silo"
+)
+
+const (
+	// paths under here are the server's API, rather than keys
+	urlApi = "/_silo/"
+	urlList = urlApi + "list"
+	urlBatch = urlApi + "batch"
+
+	// retry defaults; the delay doubles (with jitter) on each retry, up to maxRetryDelay
+	defaultRetries = 3
+	defaultRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 10 * time.Second
+
+	// data larger than this is sent as a multipart upload; silo's default MaxDataBytes
+	defaultPartSize = 1000000
+)
+
+// A client of a silo server. A Client is safe for concurrent use & keeps connections open for reuse, so should be
+// created once & shared.
+//
+type Client struct {
+	base *url.URL
+	username string
+	password string
+
+	http *http.Client
+	tlsConfig *tls.Config
+
+	retries int
+	retryDelay time.Duration
+
+	partSize int64
+}
+
+// Configures a Client
+//
+type Option func(*Client)
+
+// Use the given http client, rather than one of our own.
+//
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) {
+		c.http = h
+	}
+}
+
+// Use the given TLS config to connect. Ignored if WithHTTPClient is given.
+//
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// Trust the server's certificate if it's signed by one of the given CAs (eg. a self signed development CA).
+// Ignored if WithHTTPClient or WithTLSConfig is given.
+//
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *Client) {
+		if c.tlsConfig == nil {
+			c.tlsConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		}
+	}
+}
+
+// Retry failed requests up to the given number of times, waiting delay before the first retry & doubling it for
+// each retry after. Zero retries disables retrying.
+//
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryDelay = delay
+	}
+}
+
+// Send data larger than size as a multipart upload, in parts of that size. This must be no more than the server's
+// MaxDataBytes, so should be given if the server's is less than the default (1000000).
+//
+func WithPartSize(size int64) Option {
+	return func(c *Client) {
+		c.partSize = size
+	}
+}
+
+// Create a client of the silo server at the given url (eg. https://localhost:8080), authenticating as the
+// given role.
+//
+func New(endpoint, username, password string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q, expected http or https", base.Scheme)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	c := &Client{
+		base: base,
+		username: username,
+		password: password,
+		retries: defaultRetries,
+		retryDelay: defaultRetryDelay,
+		partSize: defaultPartSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = 16
+		if c.tlsConfig != nil {
+			transport.TLSClientConfig = c.tlsConfig
+		}
+		c.http = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+// Fetch the data stored under key.
+//
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	body, err := c.GetStream(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// Fetch the data stored under key as a stream, which the caller must close. Only the request is retried; an
+// error reading the stream isn't.
+//
+func (c *Client) GetStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath(key), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Store data under key, replacing it if it exists. Replacing requires the role to have permission to remove.
+//  Data larger than the part size (see WithPartSize) is sent as a multipart upload.
+//
+func (c *Client) Put(ctx context.Context, key string, data []byte) error {
+	if int64(len(data)) > c.partSize {
+		return c.putParts(ctx, key, bytes.NewReader(data), int64(len(data)))
+	}
+
+	err := c.write(ctx, http.MethodPut, key, data)
+	if !cantReplace(err) {
+		return err
+	}
+
+	// nothing to replace, so create it; if someone beat us to that, replace theirs
+	err = c.write(ctx, http.MethodPost, key, data)
+	if errors.Is(err, silo.ErrExists) {
+		err = c.write(ctx, http.MethodPut, key, data)
+	}
+	return err
+}
+
+// Store size bytes read from r under key as a multipart upload. Each part is read into memory, so it can be retried;
+// if the upload fails it's abandoned.
+//
+func (c *Client) putParts(ctx context.Context, key string, r io.Reader, size int64) (err error) {
+	started := struct{
+		UploadId string
+	}{}
+	err = c.doJson(ctx, http.MethodPost, keyPath(key), url.Values{"uploads": {""}}, nil, &started)
+	if err != nil {
+		return err
+	}
+
+	upload := url.Values{"uploadId": {started.UploadId}}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// even if we were cancelled; if this fails too, the server removes abandoned uploads eventually
+		resp, abortErr := c.do(context.WithoutCancel(ctx), http.MethodDelete, keyPath(key), upload, nil, nil, 0)
+		if abortErr == nil {
+			drain(resp)
+		}
+	}()
+
+	var resp *http.Response
+	buf := make([]byte, c.partSize)
+	for number := 1; size > 0; number++ {
+		part := buf[:min(size, c.partSize)]
+		_, err = io.ReadFull(r, part)
+		if err != nil {
+			return err
+		}
+		size -= int64(len(part))
+
+		query := url.Values{"uploadId": {started.UploadId}, "partNumber": {strconv.Itoa(number)}}
+		body := func() io.Reader { return bytes.NewReader(part) }
+		resp, err = c.do(ctx, http.MethodPut, keyPath(key), query, nil, body, int64(len(part)))
+		if err != nil {
+			return err
+		}
+		err = drain(resp)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err = c.do(ctx, http.MethodPost, keyPath(key), upload, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// Whether a PUT failed because there's nothing to replace, or the role may not replace anything (but may yet be
+// able to create the key)
+//
+func cantReplace(err error) bool {
+	return errors.Is(err, silo.ErrNotFound) || errors.Is(err, silo.ErrForbidden)
+}
+
+// Store data under key, which must not already exist (else ErrExists).
+//
+func (c *Client) Create(ctx context.Context, key string, data []byte) error {
+	return c.write(ctx, http.MethodPost, key, data)
+}
+
+// Store size bytes read from r under key, replacing it if it exists. The stream can't be read twice, so this isn't
+// retried, unless it's larger than the part size (see WithPartSize) & so sent as a multipart upload, a part at a time.
+//  As with Put, the stream is first sent to replace key & if that's refused, to create it. Requests are sent with
+//  "Expect: 100-continue", so the server refuses them before any of the stream is sent; with an http client that
+//  doesn't wait for the server (see http.Transport.ExpectContinueTimeout) the first refusal is returned instead.
+//
+func (c *Client) PutStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size > c.partSize {
+		return c.putParts(ctx, key, r, size)
+	}
+
+	counted := &countingReader{Reader: r}
+	expect := http.Header{"Expect": {"100-continue"}}
+
+	err := c.writeStream(ctx, http.MethodPut, key, counted, size, expect)
+	if cantReplace(err) && counted.n == 0 {
+		// nothing to replace, so create it; if someone beat us to that, replace theirs
+		err = c.writeStream(ctx, http.MethodPost, key, counted, size, expect)
+		if errors.Is(err, silo.ErrExists) && counted.n == 0 {
+			err = c.writeStream(ctx, http.MethodPut, key, counted, size, nil)
+		}
+	}
+	return err
+}
+
+// Store size bytes read from r under key, which must not already exist (else ErrExists). The stream can't be read
+// twice, so this isn't retried.
+//
+func (c *Client) CreateStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	return c.writeStream(ctx, http.MethodPost, key, r, size, nil)
+}
+
+// Return the size & current etag of the data stored under key.
+//
+func (c *Client) Stat(ctx context.Context, key string) (*silo.ObjectInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, keyPath(key), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// a HEAD response's ContentLength is -1 if it's been compressed or sent chunked by a proxy, so read the header
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("silo: size of %s unknown, as the response has no valid Content-Length", key)
+	}
+
+	etag, err := strconv.Unquote(resp.Header.Get("ETag"))
+	if err != nil {
+		etag = resp.Header.Get("ETag")
+	}
+	return &silo.ObjectInfo{Size: size, ETag: etag}, nil
+}
+
+// Copy the data stored under src to dst on the server, replacing dst if it exists.
+//
+func (c *Client) Copy(ctx context.Context, src, dst string) error {
+	return c.transfer(ctx, "COPY", src, dst)
+}
+
+// Move the data stored under src to dst on the server, replacing dst if it exists.
+//
+func (c *Client) Rename(ctx context.Context, src, dst string) error {
+	return c.transfer(ctx, "MOVE", src, dst)
+}
+
+func (c *Client) transfer(ctx context.Context, method, src, dst string) error {
+	// the server takes the destination's path as it would the request's, so it's under our base path & escaped
+	destination := &url.URL{Path: c.base.Path + keyPath(dst)}
+	header := http.Header{"Destination": {destination.EscapedPath()}}
+	resp, err := c.do(ctx, method, keyPath(src), nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// Remove the data stored under key.
+//
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, keyPath(key), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// Return whether anything is stored under key.
+//
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	batch := map[string]interface{}{
+		"Ops": []*silo.BatchOp{{Op: silo.BatchExists, Key: keyPath(key)}},
+	}
+
+	results := struct{
+		Results []struct{
+			Status int
+			Code string
+			Message string
+			Exists bool
+		}
+	}{}
+	err := c.doJson(ctx, http.MethodPost, urlBatch, nil, batch, &results)
+	if err != nil {
+		return false, err
+	}
+	if len(results.Results) != 1 {
+		return false, fmt.Errorf("silo: expected 1 batch result, got %d", len(results.Results))
+	}
+
+	r := results.Results[0]
+	if r.Status != http.StatusOK {
+		return false, resultError(r.Status, r.Code, r.Message)
+	}
+	return r.Exists, nil
+}
+
+// Return every key beginning with prefix, in order.
+//
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	after := ""
+	for {
+		page := struct{
+			Keys []string
+			More bool
+		}{}
+
+		query := url.Values{"prefix": {prefix}}
+		if after != "" {
+			query.Set("after", after)
+		}
+		err := c.doJson(ctx, http.MethodGet, urlList, query, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, page.Keys...)
+		if !page.More || len(page.Keys) == 0 {
+			return keys, nil
+		}
+		after = page.Keys[len(page.Keys) - 1]
+	}
+}
+
+// Write data to key with the given method
+//
+func (c *Client) write(ctx context.Context, method, key string, data []byte) error {
+	body := func() io.Reader { return bytes.NewReader(data) }
+	resp, err := c.do(ctx, method, keyPath(key), nil, nil, body, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// Write size bytes from r to key with the given method & extra headers (if any), without retrying.
+//
+func (c *Client) writeStream(ctx context.Context, method, key string, r io.Reader, size int64, header http.Header) error {
+	used := false
+	body := func() io.Reader {
+		if used {
+			return nil
+		}
+		used = true
+		return r
+	}
+
+	resp, err := c.do(ctx, method, keyPath(key), nil, header, body, size)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// Counts the bytes read through it
+//
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Make a request sending & receiving json. A nil in sends no body.
+//
+func (c *Client) doJson(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body func() io.Reader
+	size := int64(0)
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = func() io.Reader { return bytes.NewReader(data) }
+		size = int64(len(data))
+	}
+
+	resp, err := c.do(ctx, method, path, query, nil, body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Make a request, retrying on 429 responses (which weren't acted on), & on 5xx responses & network errors if the
+// method is idempotent (eg. a POST may have taken effect before the server or connection failed).
+//  Body returns the request body for each attempt; if it returns nil after the first, the body can't be sent again
+//  so we don't retry. Unsuccessful responses are returned as an error; otherwise the caller must close the
+//  response body.
+//
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body func() io.Reader, size int64) (*http.Response, error) {
+	u := *c.base
+	u.Path = c.base.Path + path
+	u.RawQuery = query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = body()
+			if reader == nil {
+				return nil, fmt.Errorf("silo: %s %s failed & the request body can't be sent again", method, path)
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.ContentLength = size
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.SetBasicAuth(c.username, c.password)
+
+		resp, err := c.http.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		var retryAfter time.Duration
+		if err == nil {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			err = responseError(resp)
+			resp.Body.Close()
+			if !retryable(method, resp.StatusCode) {
+				return nil, err
+			}
+		} else if ctx.Err() != nil || !idempotent(method) {
+			return nil, err
+		}
+
+		if attempt >= c.retries {
+			return nil, err
+		}
+		err = sleep(ctx, c.backoff(attempt, retryAfter))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// How long to wait before the given retry; the server's Retry-After if it gave one, else exponential backoff with
+// jitter.
+//
+func (c *Client) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+
+	delay := c.retryDelay << attempt
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay / 2 + time.Duration(rand.Int63n(int64(delay / 2) + 1))
+}
+
+// Whether making a request with the given method twice has the same effect as making it once
+//
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, "COPY":
+		return true
+	}
+	return false
+}
+
+// Whether a request with the given method that got the given status is worth retrying
+//
+func retryable(method string, status int) bool {
+	return status == http.StatusTooManyRequests ||
+		(idempotent(method) && status >= 500 && status != http.StatusNotImplemented && status != http.StatusInsufficientStorage)
+}
+
+// Parse a Retry-After header given in seconds (the http date form isn't used by silo)
+//
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Wait for the given time, or until the context is done
+//
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Read & discard the rest of a response body, so the connection can be reused
+//
+func drain(resp *http.Response) error {
+	defer resp.Body.Close()
+	_, err := io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// Keys are paths on the server, so begin with a slash
+//
+func keyPath(key string) string {
+	if strings.HasPrefix(key, "/") {
+		return key
+	}
+	return "/" + key
+}
@@ -0,0 +1,295 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/voidshard/silo"
+	"github.com/voidshard/silo/server"
+)
+
+const (
+	testEncryptionKey = "a key used only by tests, long enough to be accepted"
+	testPassword = "pw"
+)
+
+// Build a role with the given permissions & testPassword, hashed cheaply.
+//
+func testRole(id string, get, put, rm bool) *silo.Role {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	r, err := silo.NewRoleFromHash(id, string(hash))
+	if err != nil {
+		panic(err)
+	}
+	r.CanGet = get
+	r.CanPut = put
+	r.CanRm = rm
+	return r
+}
+
+// Serve a silo stored in a fresh temp dir with the given roles, until the test ends.
+//
+func testServer(t *testing.T, roles ...*silo.Role) (*silo.Silo, *httptest.Server) {
+	return testServerWith(t, nil, roles...)
+}
+
+// Serve a silo as testServer does, with the given server options.
+//
+func testServerWith(t *testing.T, opts []server.Option, roles ...*silo.Role) (*silo.Silo, *httptest.Server) {
+	c := silo.NewConfig()
+	c.RemoveDefaultRoles()
+	c.Misc.EncryptionKey = testEncryptionKey
+	c.Store.Location = t.TempDir()
+	for _, r := range roles {
+		c.User[r.Id] = r
+	}
+
+	repo, err := silo.NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	srv := httptest.NewServer(server.New(repo, opts...))
+	t.Cleanup(srv.Close)
+	return repo, srv
+}
+
+// Create a client of srv as the given role, retrying quickly.
+//
+func testClient(t *testing.T, srv *httptest.Server, user string) *Client {
+	c, err := New(srv.URL, user, testPassword, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPutGet(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	writer := testRole("writer", false, true, false)
+	_, srv := testServer(t, rw, writer)
+	c := testClient(t, srv, "rw")
+	ctx := context.Background()
+
+	for _, data := range []string{"created", "replaced"} {
+		err := c.Put(ctx, "a", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Get(ctx, "/a")
+		if err != nil || string(got) != data {
+			t.Fatalf("expected %q, got %q %v", data, got, err)
+		}
+	}
+
+	err := c.Create(ctx, "/a", []byte("again"))
+	if !errors.Is(err, silo.ErrExists) {
+		t.Fatalf("expected creating an existing key to fail, got %v", err)
+	}
+	_, err = c.Get(ctx, "/missing")
+	if !errors.Is(err, silo.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// a role that may only write can create keys, but not replace them
+	w := testClient(t, srv, "writer")
+	err = w.Put(ctx, "/b", []byte("b"))
+	if err != nil {
+		t.Fatalf("expected a writer to create a key, got %v", err)
+	}
+	err = w.Put(ctx, "/b", []byte("b"))
+	if !errors.Is(err, silo.ErrForbidden) {
+		t.Fatalf("expected a writer not to replace a key, got %v", err)
+	}
+}
+
+func TestPutStream(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	writer := testRole("writer", false, true, false)
+	repo, srv := testServer(t, rw, writer)
+	ctx := context.Background()
+
+	cases := []struct{
+		User string
+		Data string
+		Err error
+	}{
+		{"rw", "created", nil},
+		{"rw", "replaced", nil},
+		{"writer", "not permitted to replace", silo.ErrForbidden},
+	}
+	for _, c := range cases {
+		err := testClient(t, srv, c.User).PutStream(ctx, "/a", bytes.NewReader([]byte(c.Data)), int64(len(c.Data)))
+		if c.Err == nil && err != nil || c.Err != nil && !errors.Is(err, c.Err) {
+			t.Errorf("%s %q: expected %v, got %v", c.User, c.Data, c.Err, err)
+		}
+	}
+
+	// the writer can't read, so mustn't need to know if the key exists
+	data := "new key"
+	err := testClient(t, srv, "writer").PutStream(ctx, "/b", bytes.NewReader([]byte(data)), int64(len(data)))
+	if err != nil {
+		t.Fatalf("expected a writer to create a key, got %v", err)
+	}
+
+	for key, expect := range map[string]string{"/a": "replaced", "/b": "new key"} {
+		got, err := repo.Get(rw, key)
+		if err != nil || string(got) != expect {
+			t.Errorf("expected %s to hold %q, got %q %v", key, expect, got, err)
+		}
+	}
+}
+
+func TestCopyRename(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	repo, srv := testServerWith(t, []server.Option{server.WithPrefix("/silo")}, rw)
+	c, err := New(srv.URL + "/silo/", "rw", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	err = c.Put(ctx, "/a", []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// destinations are under the base path, & escaped
+	odd := "/dir/with space?and#more%20"
+	err = c.Copy(ctx, "/a", odd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rename(ctx, odd, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, exists := range map[string]bool{"/a": true, odd: false, "/b": true} {
+		data, err := repo.Get(rw, key)
+		if exists && (err != nil || string(data) != "one") || !exists && !errors.Is(err, silo.ErrNotFound) {
+			t.Errorf("expected %s to exist (%v), got %q %v", key, exists, data, err)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var status, attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	c := testClient(t, srv, "rw")
+	ctx := context.Background()
+
+	cases := []struct{
+		Name string
+		Status int32
+		Attempts int32
+		Fn func() error
+	}{
+		{"idempotent requests are retried", http.StatusServiceUnavailable, 3, func() error { _, err := c.Get(ctx, "/a"); return err }},
+		{"as are puts", http.StatusInternalServerError, 3, func() error { return c.write(ctx, http.MethodPut, "/a", nil) }},
+		{"posts may have taken effect", http.StatusInternalServerError, 1, func() error { return c.Create(ctx, "/a", nil) }},
+		{"but weren't if rate limited", http.StatusTooManyRequests, 3, func() error { return c.Create(ctx, "/a", nil) }},
+		{"errors of ours aren't retried", http.StatusNotFound, 1, func() error { _, err := c.Get(ctx, "/a"); return err }},
+		{"nor is being unsupported", http.StatusNotImplemented, 1, func() error { _, err := c.Get(ctx, "/a"); return err }},
+	}
+	for _, tc := range cases {
+		status.Store(tc.Status)
+		attempts.Store(0)
+		err := tc.Fn()
+		if err == nil || attempts.Load() != tc.Attempts {
+			t.Errorf("%s: expected %d attempts & an error, got %d %v", tc.Name, tc.Attempts, attempts.Load(), err)
+		}
+	}
+}
+
+func TestStatSize(t *testing.T) {
+	var length atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l := length.Load().(string); l != "" {
+			w.Header().Set("Content-Length", l)
+		}
+		w.Header().Set("ETag", `"abc"`)
+	}))
+	t.Cleanup(srv.Close)
+	c := testClient(t, srv, "rw")
+
+	length.Store("5")
+	info, err := c.Stat(context.Background(), "/a")
+	if err != nil || info.Size != 5 || info.ETag != "abc" {
+		t.Fatalf("expected the size & etag, got %+v %v", info, err)
+	}
+
+	// eg. stripped by a proxy
+	length.Store("")
+	info, err = c.Stat(context.Background(), "/a")
+	if err == nil {
+		t.Fatalf("expected an unknown size to be an error, got %+v", info)
+	}
+}
+
+func TestPutLarge(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	writer := testRole("writer", false, true, false)
+	repo, srv := testServer(t, rw, writer)
+	ctx := context.Background()
+	c := testClient(t, srv, "rw")
+
+	// larger than the server's MaxDataBytes, so only possible as a multipart upload
+	data := bytes.Repeat([]byte("0123456789"), 250001)
+	err := c.Put(ctx, "/put", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PutStream(ctx, "/stream", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replacing, in parts of our choosing
+	small, err := New(srv.URL, "rw", testPassword, WithPartSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = small.PutStream(ctx, "/stream", bytes.NewReader(data[:4500]), 4500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expect := range map[string][]byte{"/put": data, "/stream": data[:4500]} {
+		got, err := repo.Get(rw, key)
+		if err != nil || !bytes.Equal(got, expect) {
+			t.Errorf("expected %s to hold %d bytes, got %d %v", key, len(expect), len(got), err)
+		}
+	}
+
+	// a failed upload is abandoned, so doesn't count against the role
+	err = testClient(t, srv, "writer").PutStream(ctx, "/put", bytes.NewReader(data), int64(len(data)))
+	if !errors.Is(err, silo.ErrForbidden) {
+		t.Fatalf("expected a writer not to replace a key, got %v", err)
+	}
+	if u := repo.Usage(writer).Usage; u.Bytes != 0 {
+		t.Fatalf("expected the failed upload to be abandoned, got %+v", u)
+	}
+
+	// as is one whose stream ends early
+	err = c.PutStream(ctx, "/short", bytes.NewReader(data[:100]), int64(len(data)))
+	if err == nil {
+		t.Fatalf("expected a short stream to fail")
+	}
+	if u := repo.Usage(rw).Usage; u.Bytes != int64(len(data) + 4500) {
+		t.Fatalf("expected only the stored keys to count, got %+v", u)
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"github.com/voidshard/silo"
+)
+
+// An error returned by the silo server. It wraps the matching silo error, so test for these with errors.Is, eg.
+//  errors.Is(err, silo.ErrNotFound)
+//
+type Error struct {
+	Status int
+	Code string
+	Message string
+
+	err error
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if e.err != nil {
+		// eg. a HEAD request, whose response has no body
+		return e.err.Error()
+	}
+	return fmt.Sprintf("silo: %d %s", e.Status, http.StatusText(e.Status))
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// silo's errors for each http status, for responses without a code we understand (eg. from a proxy)
+//
+var statusErrors = map[int]error{
+	http.StatusForbidden: silo.ErrForbidden,
+	http.StatusUnauthorized: silo.ErrUnauthorized,
+	http.StatusNotFound: silo.ErrNotFound,
+	http.StatusConflict: silo.ErrExists,
+	http.StatusRequestEntityTooLarge: silo.ErrTooLarge,
+	http.StatusRequestURITooLong: silo.ErrKeyTooLong,
+	http.StatusInsufficientStorage: silo.ErrQuotaExceeded,
+	http.StatusBadRequest: silo.ErrBadRequest,
+	http.StatusRequestedRangeNotSatisfiable: silo.ErrRangeNotSatisfiable,
+	http.StatusNotImplemented: silo.ErrUnsupported,
+	http.StatusFailedDependency: silo.ErrAborted,
+}
+
+// Build an error from an unsuccessful response, consuming the body.
+//
+func responseError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64 * 1024))
+	msg := struct{
+		Code string
+		Message string
+	}{}
+	if json.Unmarshal(body, &msg) == nil {
+		e.Code = msg.Code
+		e.Message = msg.Message
+	}
+
+	e.err = silo.CodeError(e.Code)
+	if e.err == nil {
+		e.err = statusErrors[resp.StatusCode]
+	}
+	return e
+}
+
+// Build an error from a single result of a batch
+//
+func resultError(status int, code, message string) error {
+	e := &Error{Status: status, Code: code, Message: message, err: silo.CodeError(code)}
+	if e.err == nil {
+		e.err = statusErrors[status]
+	}
+	return e
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"github.com/voidshard/silo"
+)
+
+// Handle the 'audit' subcommand.
+//
+//  silo audit verify [-config silo.ini]
+//
+func auditMain(args []string) {
+	if len(args) < 1 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: silo audit verify [-config silo.ini]")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	configPtr := flags.String("config", "silo.ini", "Config file")
+	flags.Parse(args[1:])
+
+	config, err := parseConfig(*configPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	count, err := silo.VerifyAudit(config.SiloConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit log is NOT intact after %d records: %v\n", count, err)
+		os.Exit(1)
+	}
+	fmt.Printf("audit log is intact: %d records verified\n", count)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the CA is written alongside the server certificate with these names
+	caCertFile = "ca.cert"
+	caKeyFile = "ca.key"
+)
+
+// names the server certificate is always valid for, in addition to any given
+var defaultCertHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// What to generate. The CA is reused if one already exists alongside the server certificate.
+//
+type certRequest struct {
+	certFile string
+	keyFile string
+	hosts []string
+	clients []string
+	validFor time.Duration
+}
+
+// Generate a CA (unless there's one already), a server certificate signed by it & any client certificates asked for.
+//
+func generateCerts(r *certRequest) error {
+	dir := filepath.Dir(r.certFile)
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return err
+	}
+
+	ca, caKey, err := loadOrCreateCA(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile), r.validFor)
+	if err != nil {
+		return err
+	}
+
+	cert, key, err := signCert(ca, caKey, "silo", r.hosts, x509.ExtKeyUsageServerAuth, r.validFor)
+	if err != nil {
+		return err
+	}
+	err = writePair(r.certFile, r.keyFile, cert, key)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range r.clients {
+		cert, key, err = signCert(ca, caKey, name, nil, x509.ExtKeyUsageClientAuth, r.validFor)
+		if err != nil {
+			return err
+		}
+		err = writePair(filepath.Join(dir, "client-" + name + ".cert"), filepath.Join(dir, "client-" + name + ".key"), cert, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read the CA from the given files, or if neither exists, create a new one & write it there. If only one of them
+// exists we stop, rather than replace a CA that may have signed certificates in use.
+//
+func loadOrCreateCA(certFile, keyFile string, validFor time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	if fileExists(certFile) != fileExists(keyFile) {
+		return nil, nil, fmt.Errorf("only one of %s and %s exists; restore the other, or remove both to create a new CA", certFile, keyFile)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok || !ca.IsCA {
+			return nil, nil, fmt.Errorf("%s is not a CA certificate", certFile)
+		}
+		return ca, signer, nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := certTemplate("silo development CA", validFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, writePair(certFile, keyFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPem)
+}
+
+// Create a certificate signed by the CA, returning the PEM encoded certificate & key.
+//  Hosts may be DNS names or IP addresses.
+//
+func signCert(ca *x509.Certificate, caKey crypto.Signer, name string, hosts []string, usage x509.ExtKeyUsage, validFor time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := certTemplate(name, validFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	for _, h := range hosts {
+		ip := net.ParseIP(h)
+		if ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err := encodeKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPem, err
+}
+
+func certTemplate(name string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: name, Organization: []string{"silo"}},
+		NotBefore: now.Add(-5 * time.Minute), // allow for a little clock skew
+		NotAfter: now.Add(validFor),
+	}, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Write out a certificate & key. The key is only readable by us.
+//
+func writePair(certFile, keyFile string, cert, key []byte) error {
+	err := os.WriteFile(keyFile, key, 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, cert, 0644)
+}
+
+// Generate certificates for any TLS listeners whose certificate & key don't exist yet. Used on first start in
+// development, so there's no need to create certificates by hand.
+//
+func autoGenerateCerts(listeners map[string]*listenerSettings, validFor time.Duration) error {
+	for name, l := range listeners {
+		if l.SSLCert == "" || fileExists(l.SSLCert) || fileExists(l.SSLKey) {
+			continue
+		}
+
+		hosts := defaultCertHosts
+		host, _, err := net.SplitHostPort(l.Address)
+		if err == nil && host != "" && !slices.Contains(hosts, host) {
+			hosts = append([]string{host}, hosts...)
+		}
+
+		err = generateCerts(&certRequest{certFile: l.SSLCert, keyFile: l.SSLKey, hosts: hosts, validFor: validFor})
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", name, err)
+		}
+		slog.Warn("generated a self signed certificate, for development only", "listener", name, "certificate", l.SSLCert, "hosts", strings.Join(hosts, ","))
+	}
+	return nil
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// Handle the 'certs' subcommand.
+//
+//  silo certs generate [-config silo.ini] [-hosts a.example.com,10.0.0.1] [-clients alice,bob] [-days 365] [-force]
+//
+// Certificates are written where the config file expects them (or ssl.cert & ssl.key if there's no config file),
+// with the CA & client certificates alongside.
+//
+func certsMain(args []string) {
+	if len(args) < 1 || args[0] != "generate" {
+		fmt.Fprintln(os.Stderr, "usage: silo certs generate [-config silo.ini] [-hosts names] [-clients names] [-days 365] [-force]")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("certs generate", flag.ExitOnError)
+	configPtr := flags.String("config", "silo.ini", "Config file, giving where certificates should be written")
+	hostsPtr := flags.String("hosts", "", "Comma separated DNS names & IP addresses the server certificate is valid for, in addition to localhost")
+	clientsPtr := flags.String("clients", "", "Comma separated names to generate client certificates for")
+	daysPtr := flags.Int("days", 365, "How many days the certificates are valid for")
+	forcePtr := flags.Bool("force", false, "Overwrite existing server certificates")
+	flags.Parse(args[1:])
+
+	// write wherever the TLS listeners in the config expect, if there is a config
+	targets := map[string]*listenerSettings{defaultListener: &listenerSettings{SSLCert: "ssl.cert", SSLKey: "ssl.key"}}
+	if fileExists(*configPtr) {
+		fcfg, err := readConfigFile(*configPtr)
+		if err == nil {
+			targets, err = buildListeners(fcfg)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	hosts := append(splitList(*hostsPtr), defaultCertHosts...)
+	clients := splitList(*clientsPtr)
+
+	names := []string{}
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	generated := map[string]bool{}
+	for _, name := range names {
+		l := targets[name]
+		if l.SSLCert == "" || generated[l.SSLCert] {
+			continue
+		}
+		if !*forcePtr && (fileExists(l.SSLCert) || fileExists(l.SSLKey)) {
+			fmt.Fprintf(os.Stderr, "%s or %s already exists, use -force to overwrite\n", l.SSLCert, l.SSLKey)
+			os.Exit(1)
+		}
+
+		err := generateCerts(&certRequest{
+			certFile: l.SSLCert,
+			keyFile: l.SSLKey,
+			hosts: hosts,
+			clients: clients,
+			validFor: time.Duration(*daysPtr) * 24 * time.Hour,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		generated[l.SSLCert] = true
+
+		dir := filepath.Dir(l.SSLCert)
+		fmt.Printf("listener %s: wrote %s & %s, signed by %s\n", name, l.SSLCert, l.SSLKey, filepath.Join(dir, caCertFile))
+		for _, c := range clients {
+			fmt.Printf("listener %s: wrote client certificate %s\n", name, filepath.Join(dir, "client-" + c + ".cert"))
+		}
+	}
+
+	if len(generated) == 0 {
+		fmt.Fprintln(os.Stderr, "no listeners use TLS, nothing to generate")
+		os.Exit(1)
+	}
+}
+
+func splitList(s string) []string {
+	result := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
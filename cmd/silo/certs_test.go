@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerateCerts(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ssl.cert")
+	keyFile := filepath.Join(dir, "ssl.key")
+	err := generateCerts(&certRequest{certFile: certFile, keyFile: keyFile, hosts: []string{"silo.example.com", "10.0.0.1"}, clients: []string{"alice"}, validFor: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPem, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+
+	cases := []struct{
+		Cert string
+		Key string
+		Name string
+		Usage x509.ExtKeyUsage
+	}{
+		{certFile, keyFile, "silo.example.com", x509.ExtKeyUsageServerAuth},
+		{certFile, keyFile, "10.0.0.1", x509.ExtKeyUsageServerAuth},
+		{filepath.Join(dir, "client-alice.cert"), filepath.Join(dir, "client-alice.key"), "", x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range cases {
+		pair, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(pair.Certificate[0])
+		_, err = cert.Verify(x509.VerifyOptions{DNSName: c.Name, Roots: roots, KeyUsages: []x509.ExtKeyUsage{c.Usage}})
+		if err != nil {
+			t.Errorf("%s %s: expected to be signed by the CA, got %v", c.Cert, c.Name, err)
+		}
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the key to be readable only by us, got %v %v", info.Mode(), err)
+	}
+
+	// the CA is reused
+	before, _ := os.ReadFile(filepath.Join(dir, caKeyFile))
+	err = generateCerts(&certRequest{certFile: certFile, keyFile: keyFile, validFor: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if string(before) != string(after) {
+		t.Fatalf("expected the existing CA to be reused")
+	}
+}
+
+func TestHalfAMissingCA(t *testing.T) {
+	for _, missing := range []string{caCertFile, caKeyFile} {
+		dir := t.TempDir()
+		certFile := filepath.Join(dir, "ssl.cert")
+		keyFile := filepath.Join(dir, "ssl.key")
+		err := generateCerts(&certRequest{certFile: certFile, keyFile: keyFile, validFor: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove(filepath.Join(dir, missing))
+		kept := caCertFile
+		if missing == caCertFile {
+			kept = caKeyFile
+		}
+		before, _ := os.ReadFile(filepath.Join(dir, kept))
+
+		err = generateCerts(&certRequest{certFile: certFile, keyFile: keyFile, validFor: time.Hour})
+		if err == nil {
+			t.Errorf("%s missing: expected generating certificates to fail", missing)
+		}
+		after, _ := os.ReadFile(filepath.Join(dir, kept))
+		if string(before) != string(after) || fileExists(filepath.Join(dir, missing)) {
+			t.Errorf("%s missing: expected the CA to be left as it was", missing)
+		}
+	}
+}
+
+func TestAutoGenerateCerts(t *testing.T) {
+	dir := t.TempDir()
+	listeners := map[string]*listenerSettings{
+		"tls": &listenerSettings{SSLCert: filepath.Join(dir, "ssl.cert"), SSLKey: filepath.Join(dir, "ssl.key")},
+		"plain": &listenerSettings{},
+	}
+	err := autoGenerateCerts(listeners, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tls.LoadX509KeyPair(listeners["tls"].SSLCert, listeners["tls"].SSLKey)
+	if err != nil {
+		t.Fatalf("expected a certificate to be generated, got %v", err)
+	}
+
+	// existing certificates are left alone
+	before, _ := os.ReadFile(listeners["tls"].SSLCert)
+	err = autoGenerateCerts(listeners, time.Hour)
+	after, _ := os.ReadFile(listeners["tls"].SSLCert)
+	if err != nil || string(before) != string(after) {
+		t.Fatalf("expected the existing certificate to be kept, got %v", err)
+	}
+}
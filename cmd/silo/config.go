@@ -1,7 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"time"
 	"github.com/voidshard/silo"
+	"github.com/voidshard/silo/server"
 	"gopkg.in/gcfg.v1"
 )
 
@@ -10,6 +19,12 @@ type Config struct {
 	// settings specific to the HTTP server
 	Server *serverSettings
 
+	// where we accept connections, by name
+	Listener map[string]*listenerSettings
+
+	// settings for our own logging
+	Log *logSettings
+
 	// settings intended for silo
 	SiloConfig *silo.Config
 }
@@ -18,17 +33,95 @@ type Config struct {
 // basic structure of the config file read in by this service
 type fileConfig struct {
 	Server serverSettings
+	Listener map[string]*listenerSettings
+	Log logSettings
 	Misc miscSettings
 	Store storageSettings
 	Role map[string]*entity
+	Quota map[string]*quotaSettings
+	Htpasswd map[string]*htpasswdSettings
+	Audit auditSettings
 }
 
 // -- sections of the config file --
 type serverSettings struct {
+	// if no listeners are configured, a single TLS listener is built from these
 	HttpHost string
 	HttpPort int
 	SSLCert string
 	SSLKey string
+
+	// where metrics & health checks are served, these don't require authentication
+	MetricsPath string
+	LivenessPath string
+	ReadinessPath string
+
+	// on SIGINT or SIGTERM, how long to wait for in flight requests to finish before closing them
+	ShutdownTimeout duration
+
+	// how long a client has to send request headers, the whole request & to read the response (0 is no limit)
+	ReadHeaderTimeout duration
+	ReadTimeout duration
+	WriteTimeout duration
+	// how long to keep idle keep-alive connections open
+	IdleTimeout duration
+	// the largest request line & headers accepted; this includes the key, so must be well over MaxKeyBytes
+	MaxHeaderBytes int
+	// read & write timeouts are extended for large objects, to allow sending them at this many bytes per second
+	MinTransferRate int64
+
+	// TLS settings for every listener using TLS
+	TLSPolicy string // modern, intermediate (default) or old
+	TLSMinVersion string // 1.2 or 1.3, overriding the policy
+	TLSCurves []string // X25519, P256, P384 or P521, in order of preference
+}
+
+// A time.Duration that can be read from the config file, eg. "30s"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+const (
+	// handler groups that a listener can expose
+	HandlerData = server.HandlerData
+	HandlerAdmin = server.HandlerAdmin
+	HandlerMetrics = server.HandlerMetrics
+
+	// the listener built from HttpHost & HttpPort, if no listeners are configured
+	defaultListener = "default"
+
+	// what a listener serves
+	ProtocolHttp = "http"
+	ProtocolGrpc = "grpc"
+)
+
+var allHandlers = []string{HandlerData, HandlerAdmin, HandlerMetrics}
+
+// Somewhere we accept connections. Without SSLCert & SSLKey the listener serves plain HTTP.
+//
+type listenerSettings struct {
+	Network string // tcp (default) or unix
+	Address string // host:port, or a socket path for unix
+	Protocol string // http (default) or grpc
+	SSLCert string
+	SSLKey string
+	ClientCA string // grpc only: accept client certificates signed by this CA, their common name is the role
+	Handlers []string // which handler groups to serve, all of them if none are given (http only)
+}
+
+type logSettings struct {
+	Level string // debug, info, warn or error
+	Destination string // stderr, stdout or a file path
+	Format string // json or text
 }
 
 type storageSettings struct {
@@ -40,20 +133,75 @@ type miscSettings struct {
 	MaxDataBytes int
 	MaxKeyBytes int
 	EncryptionKey string
+
+	// multipart uploads
+	MaxUploadBytes int64
+	UploadExpiry duration
+	MaxUploads int
+
+	// batches
+	MaxBatchOps int
+	MaxBatchBytes int64
 }
 
 type entity struct {
 	Id string
+
+	// exactly one of these should be given
 	Password string
+	PasswordHash string // bcrypt or argon2 hash
+	PasswordFile string // file containing the password
+	PasswordEnv string // environment variable containing the password
+
+	Get bool
+	Put bool
+	Del bool
+	Append bool
+	Admin bool
+	MaxBytes int64
+	MaxObjects int64
+}
+
+// roles imported from an htpasswd file, all granted the same permissions
+type htpasswdSettings struct {
+	File string
 	Get bool
 	Put bool
 	Del bool
+	Append bool
+	Admin bool
+	MaxBytes int64
+	MaxObjects int64
+}
+
+type auditSettings struct {
+	File string // the audit log is only written if this is set
+	MaxBytes int64 // rotate the file once it reaches this size
+}
+
+type quotaSettings struct {
+	Prefix string
+	MaxBytes int64
+	MaxObjects int64
 }
 // -- end sections of config file
 
 
 func readConfigFile(filename string) (*fileConfig, error) {
-	fcfg := &fileConfig{}
+	fcfg := &fileConfig{
+		Server: serverSettings{
+			MetricsPath: "/_silo/metrics",
+			LivenessPath: "/_silo/live",
+			ReadinessPath: "/_silo/ready",
+			ShutdownTimeout: duration{30 * time.Second},
+			ReadHeaderTimeout: duration{10 * time.Second},
+			ReadTimeout: duration{30 * time.Second},
+			WriteTimeout: duration{30 * time.Second},
+			IdleTimeout: duration{60 * time.Second},
+			MaxHeaderBytes: 64 * 1024,
+			MinTransferRate: 64 * 1024,
+		},
+	}
 	return fcfg, gcfg.ReadFileInto(fcfg, filename)
 }
 
@@ -82,11 +230,26 @@ func parseConfig(filename string) (*Config, error) {
 	if fcfg.Misc.MaxDataBytes > 0 {
 		siloConfig.Misc.MaxDataBytes = fcfg.Misc.MaxDataBytes
 	}
+	if fcfg.Misc.MaxUploadBytes > 0 {
+		siloConfig.Misc.MaxUploadBytes = fcfg.Misc.MaxUploadBytes
+	}
+	if fcfg.Misc.UploadExpiry.Duration > 0 {
+		siloConfig.Misc.UploadExpiry = fcfg.Misc.UploadExpiry.Duration
+	}
+	if fcfg.Misc.MaxUploads > 0 {
+		siloConfig.Misc.MaxUploads = fcfg.Misc.MaxUploads
+	}
+	if fcfg.Misc.MaxBatchOps > 0 {
+		siloConfig.Misc.MaxBatchOps = fcfg.Misc.MaxBatchOps
+	}
+	if fcfg.Misc.MaxBatchBytes > 0 {
+		siloConfig.Misc.MaxBatchBytes = fcfg.Misc.MaxBatchBytes
+	}
 
-	if len(fcfg.Role) > 0 {
+	if len(fcfg.Role) > 0 || len(fcfg.Htpasswd) > 0 {
 		susers := map[string]*silo.Role{}
 		for _, u := range fcfg.Role {
-			su, err := silo.NewRole(u.Id, u.Password)
+			su, err := buildRole(u)
 			if err != nil {
 				return nil, err
 			}
@@ -94,14 +257,164 @@ func parseConfig(filename string) (*Config, error) {
 			su.CanGet = u.Get
 			su.CanPut = u.Put
 			su.CanRm = u.Del
+			su.CanAppend = u.Append
+			su.CanAdmin = u.Admin
+			su.MaxBytes = u.MaxBytes
+			su.MaxObjects = u.MaxObjects
 
 			susers[u.Id] = su
 		}
+
+		for name, h := range fcfg.Htpasswd {
+			roles, err := silo.ReadHtpasswd(h.File)
+			if err != nil {
+				return nil, fmt.Errorf("htpasswd %s: %v", name, err)
+			}
+
+			for _, su := range roles {
+				_, ok := susers[su.Id]
+				if ok {
+					return nil, fmt.Errorf("htpasswd %s: role %s is defined more than once", name, su.Id)
+				}
+
+				su.CanGet = h.Get
+				su.CanPut = h.Put
+				su.CanRm = h.Del
+				su.CanAppend = h.Append
+				su.CanAdmin = h.Admin
+				su.MaxBytes = h.MaxBytes
+				su.MaxObjects = h.MaxObjects
+
+				susers[su.Id] = su
+			}
+		}
 		siloConfig.User = susers
 	}
 
+	siloConfig.Audit.File = fcfg.Audit.File
+	siloConfig.Audit.MaxBytes = fcfg.Audit.MaxBytes
+
+	for name, q := range fcfg.Quota {
+		siloConfig.Quota[name] = &silo.Quota{
+			Prefix: q.Prefix,
+			MaxBytes: q.MaxBytes,
+			MaxObjects: q.MaxObjects,
+		}
+	}
+
+	listeners, err := buildListeners(fcfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
 		Server: &fcfg.Server,
+		Listener: listeners,
+		Log: &fcfg.Log,
 		SiloConfig: siloConfig,
 	}, nil
 }
+
+// Build a silo role from a role section of the config, reading the password from wherever we've been told to.
+//
+func buildRole(u *entity) (*silo.Role, error) {
+	given := 0
+	for _, v := range []string{u.Password, u.PasswordHash, u.PasswordFile, u.PasswordEnv} {
+		if v != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return nil, fmt.Errorf("role %s: exactly one of Password, PasswordHash, PasswordFile or PasswordEnv is required", u.Id)
+	}
+
+	if u.PasswordHash != "" {
+		return silo.NewRoleFromHash(u.Id, u.PasswordHash)
+	}
+
+	password := u.Password
+	if u.PasswordFile != "" {
+		data, err := ioutil.ReadFile(u.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %v", u.Id, err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	} else if u.PasswordEnv != "" {
+		value, ok := os.LookupEnv(u.PasswordEnv)
+		if !ok {
+			return nil, fmt.Errorf("role %s: environment variable %s is not set", u.Id, u.PasswordEnv)
+		}
+		password = value
+	}
+
+	if password == "" {
+		return nil, fmt.Errorf("role %s: password is empty", u.Id)
+	}
+	return silo.NewRole(u.Id, password)
+}
+
+// Return the configured listeners, or if there are none, a single TLS listener built from HttpHost & HttpPort
+// serving everything. The default listener always uses TLS, so SSLCert & SSLKey are required for it; plain HTTP
+// is only served by a listener configured to.
+//
+func buildListeners(fcfg *fileConfig) (map[string]*listenerSettings, error) {
+	if len(fcfg.Listener) == 0 {
+		if fcfg.Server.SSLCert == "" || fcfg.Server.SSLKey == "" {
+			return nil, fmt.Errorf("SSLCert and SSLKey are required, unless listeners are configured")
+		}
+		return map[string]*listenerSettings{
+			defaultListener: &listenerSettings{
+				Network: "tcp",
+				Address: net.JoinHostPort(fcfg.Server.HttpHost, strconv.Itoa(fcfg.Server.HttpPort)),
+				Protocol: ProtocolHttp,
+				SSLCert: fcfg.Server.SSLCert,
+				SSLKey: fcfg.Server.SSLKey,
+				Handlers: allHandlers,
+			},
+		}, nil
+	}
+
+	for name, l := range fcfg.Listener {
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		if l.Network != "tcp" && l.Network != "unix" {
+			return nil, fmt.Errorf("listener %s: Network must be tcp or unix, got %q", name, l.Network)
+		}
+		if l.Address == "" {
+			return nil, fmt.Errorf("listener %s: Address is required", name)
+		}
+		if (l.SSLCert == "") != (l.SSLKey == "") {
+			return nil, fmt.Errorf("listener %s: SSLCert and SSLKey must be given together", name)
+		}
+
+		if l.Protocol == "" {
+			l.Protocol = ProtocolHttp
+		}
+		if l.Protocol == ProtocolGrpc {
+			if len(l.Handlers) > 0 {
+				return nil, fmt.Errorf("listener %s: Handlers can't be given for a grpc listener, it serves the data API only", name)
+			}
+			if l.ClientCA != "" && l.SSLCert == "" {
+				return nil, fmt.Errorf("listener %s: ClientCA requires SSLCert and SSLKey", name)
+			}
+			continue
+		}
+		if l.Protocol != ProtocolHttp {
+			return nil, fmt.Errorf("listener %s: Protocol must be http or grpc, got %q", name, l.Protocol)
+		}
+		if l.ClientCA != "" {
+			return nil, fmt.Errorf("listener %s: ClientCA is only supported for grpc listeners", name)
+		}
+
+		if len(l.Handlers) == 0 {
+			l.Handlers = allHandlers
+		}
+		for _, h := range l.Handlers {
+			if !slices.Contains(allHandlers, h) {
+				return nil, fmt.Errorf("listener %s: unknown handler group %q, expected one of %s", name, h, strings.Join(allHandlers, ", "))
+			}
+		}
+	}
+	return fcfg.Listener, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"github.com/voidshard/silo"
+	"github.com/voidshard/silo/rpc"
+	"github.com/voidshard/silo/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// A listener & the server running on it
+//
+type listener struct {
+	name string
+	settings *listenerSettings
+	certs *certLoader // nil if serving plain HTTP
+	srv *http.Server
+	grpc *grpc.Server // instead of srv, for grpc listeners
+	ln net.Listener
+}
+
+// Start listening, without yet serving anything
+//
+func openListener(name string, settings *listenerSettings, repo *silo.Silo, config *Config) (*listener, error) {
+	l := &listener{name: name, settings: settings}
+
+	var err error
+	if settings.SSLCert != "" {
+		l.certs, err = newCertLoader(name, settings.SSLCert, settings.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", name, err)
+		}
+	}
+
+	if settings.Protocol == ProtocolGrpc {
+		err = l.setupGrpc(repo, config)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", name, err)
+		}
+	} else {
+		err = l.setupHttp(repo, config)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", name, err)
+		}
+	}
+
+	if settings.Network == "unix" {
+		err = removeStaleSocket(settings.Address)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", name, err)
+		}
+	}
+
+	l.ln, err = net.Listen(settings.Network, settings.Address)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", name, err)
+	}
+
+	if l.certs == nil && settings.Network == "tcp" && !isLoopback(settings.Address) {
+		slog.Warn("serving without TLS on a non loopback address, credentials will be sent in the clear", "listener", name)
+	}
+	slog.Info(
+		"listening",
+		"listener", name,
+		"network", settings.Network,
+		"address", settings.Address,
+		"protocol", settings.Protocol,
+		"tls", l.certs != nil,
+		"handlers", strings.Join(settings.Handlers, ","),
+	)
+	return l, nil
+}
+
+// Serve the HTTP API
+//
+func (l *listener) setupHttp(repo *silo.Silo, config *Config) error {
+	// Nb. The default http.ListenAndServe funcs do not allow setting of most of these vars
+	l.srv = &http.Server{
+		Handler: server.New(
+			repo,
+			server.WithHandlers(l.settings.Handlers...),
+			server.WithHealthPaths(config.Server.MetricsPath, config.Server.LivenessPath, config.Server.ReadinessPath),
+			server.WithTransferTimeouts(config.Server.ReadTimeout.Duration, config.Server.WriteTimeout.Duration, config.Server.MinTransferRate),
+		),
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout.Duration,
+		ReadTimeout: config.Server.ReadTimeout.Duration,
+		WriteTimeout: config.Server.WriteTimeout.Duration,
+		IdleTimeout: config.Server.IdleTimeout.Duration,
+		MaxHeaderBytes: config.Server.MaxHeaderBytes,
+	}
+	if l.certs != nil {
+		var err error
+		l.srv.TLSConfig, err = newTLSConfig(config.Server, l.certs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve the gRPC API. Nb. only the server's connection timeouts apply; calls are limited by their own deadlines.
+//
+func (l *listener) setupGrpc(repo *silo.Silo, config *Config) error {
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: config.Server.IdleTimeout.Duration}),
+	}
+	if config.Server.ReadHeaderTimeout.Duration > 0 {
+		opts = append(opts, grpc.ConnectionTimeout(config.Server.ReadHeaderTimeout.Duration))
+	}
+
+	if l.certs != nil {
+		tlsConfig, err := newTLSConfig(config.Server, l.certs)
+		if err != nil {
+			return err
+		}
+
+		if l.settings.ClientCA != "" {
+			pem, err := ioutil.ReadFile(l.settings.ClientCA)
+			if err != nil {
+				return err
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in ClientCA %s", l.settings.ClientCA)
+			}
+			// certificates are optional, as credentials can be given in metadata instead
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	l.grpc = rpc.NewGRPCServer(repo, opts...)
+	return nil
+}
+
+// Serve on the listener until it's shut down
+//
+func (l *listener) serve() error {
+	if l.grpc != nil {
+		err := l.grpc.Serve(l.ln)
+		if err == nil {
+			// stopped, as http.Server.Serve reports it
+			err = http.ErrServerClosed
+		}
+		return err
+	}
+	if l.certs != nil {
+		return l.srv.ServeTLS(l.ln, "", "")
+	}
+	return l.srv.Serve(l.ln)
+}
+
+// Stop accepting connections & wait for in flight requests to finish, until ctx is done
+//
+func (l *listener) shutdown(ctx context.Context) error {
+	if l.grpc == nil {
+		return l.srv.Shutdown(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.grpc.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close every connection, without waiting for requests to finish
+//
+func (l *listener) close() error {
+	if l.grpc == nil {
+		return l.srv.Close()
+	}
+	l.grpc.Stop()
+	return nil
+}
+
+// A socket left behind by a previous run would stop us listening, so remove it. A socket something is still
+// listening on (eg. another instance) & anything else at the path are left alone, so listening will fail.
+//
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode() & os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%s may be in use: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
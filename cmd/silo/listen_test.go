@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"github.com/voidshard/silo"
+)
+
+func TestBuildListeners(t *testing.T) {
+	cases := []struct{
+		Name string
+		Listener listenerSettings
+		Ok bool
+	}{
+		{"defaults", listenerSettings{Address: "127.0.0.1:9000"}, true},
+		{"unix", listenerSettings{Network: "unix", Address: "/run/silo.sock", Handlers: []string{HandlerData}}, true},
+		{"grpc", listenerSettings{Address: ":9151", Protocol: ProtocolGrpc, SSLCert: "c", SSLKey: "k", ClientCA: "ca"}, true},
+		{"bad network", listenerSettings{Network: "udp", Address: ":9000"}, false},
+		{"no address", listenerSettings{}, false},
+		{"cert without key", listenerSettings{Address: ":9000", SSLCert: "c"}, false},
+		{"bad protocol", listenerSettings{Address: ":9000", Protocol: "ftp"}, false},
+		{"bad handler", listenerSettings{Address: ":9000", Handlers: []string{"everything"}}, false},
+		{"grpc handlers", listenerSettings{Address: ":9151", Protocol: ProtocolGrpc, Handlers: []string{HandlerData}}, false},
+		{"grpc client CA without TLS", listenerSettings{Address: ":9151", Protocol: ProtocolGrpc, ClientCA: "ca"}, false},
+		{"http client CA", listenerSettings{Address: ":9000", SSLCert: "c", SSLKey: "k", ClientCA: "ca"}, false},
+	}
+	for _, c := range cases {
+		l := c.Listener
+		listeners, err := buildListeners(&fileConfig{Listener: map[string]*listenerSettings{"test": &l}})
+		if c.Ok != (err == nil) {
+			t.Errorf("%s: expected ok %v, got %v", c.Name, c.Ok, err)
+			continue
+		}
+		if c.Ok && (listeners["test"].Network == "" || listeners["test"].Protocol == "") {
+			t.Errorf("%s: expected defaults to be filled in, got %+v", c.Name, listeners["test"])
+		}
+	}
+
+	// the default listener always uses TLS
+	defaults := []struct{
+		Name string
+		Cert string
+		Key string
+		Ok bool
+	}{
+		{"tls", "c", "k", true},
+		{"no certificate", "", "", false},
+		{"cert without key", "c", "", false},
+		{"key without cert", "", "k", false},
+	}
+	for _, c := range defaults {
+		listeners, err := buildListeners(&fileConfig{Server: serverSettings{HttpHost: "0.0.0.0", HttpPort: 9000, SSLCert: c.Cert, SSLKey: c.Key}})
+		if c.Ok != (err == nil) {
+			t.Errorf("default %s: expected ok %v, got %v", c.Name, c.Ok, err)
+			continue
+		}
+		if c.Ok && (listeners[defaultListener] == nil || listeners[defaultListener].Address != "0.0.0.0:9000") {
+			t.Errorf("default %s: expected a listener from HttpHost & HttpPort, got %v", c.Name, listeners)
+		}
+	}
+}
+
+func TestListenersChanged(t *testing.T) {
+	running := map[string]*listener{
+		"a": &listener{settings: &listenerSettings{Network: "tcp", Address: ":1", Protocol: ProtocolHttp, Handlers: allHandlers}},
+	}
+	same := func() *listenerSettings {
+		return &listenerSettings{Network: "tcp", Address: ":1", Protocol: ProtocolHttp, Handlers: allHandlers}
+	}
+
+	cases := []struct{
+		Name string
+		Change func(l *listenerSettings)
+		Changed bool
+	}{
+		{"unchanged", func(l *listenerSettings) {}, false},
+		{"address", func(l *listenerSettings) { l.Address = ":2" }, true},
+		{"handlers", func(l *listenerSettings) { l.Handlers = []string{HandlerData} }, true},
+		{"tls", func(l *listenerSettings) { l.SSLCert, l.SSLKey = "c", "k" }, true},
+		{"protocol", func(l *listenerSettings) { l.Protocol = ProtocolGrpc }, true},
+	}
+	for _, c := range cases {
+		l := same()
+		c.Change(l)
+		if listenersChanged(running, map[string]*listenerSettings{"a": l}) != c.Changed {
+			t.Errorf("%s: expected changed to be %v", c.Name, c.Changed)
+		}
+	}
+	if !listenersChanged(running, map[string]*listenerSettings{"b": same()}) {
+		t.Errorf("expected a renamed listener to be a change")
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1:9000": true,
+		"[::1]:9000": true,
+		"localhost:9000": true,
+		"0.0.0.0:9000": false,
+		":9000": false,
+		"example.com:9000": false,
+	}
+	for address, expect := range cases {
+		if isLoopback(address) != expect {
+			t.Errorf("%s: expected %v", address, expect)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "silo.sock")
+
+	// a socket left behind is replaced, anything else isn't
+	err := os.WriteFile(socket, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = removeStaleSocket(socket)
+	if err == nil {
+		t.Fatalf("expected a file that isn't a socket to be left alone")
+	}
+	os.Remove(socket)
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	c := silo.NewConfig()
+	c.RemoveDefaultRoles()
+	c.Misc.EncryptionKey = "a key used only by tests, long enough to be accepted"
+	c.Store.Location = filepath.Join(dir, "data")
+	repo, err := silo.NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	settings := &listenerSettings{Network: "unix", Address: socket, Protocol: ProtocolHttp, Handlers: []string{HandlerMetrics}}
+	l, err := openListener("unix", settings, repo, &Config{Server: &serverSettings{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.serve()
+	defer l.shutdown(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://silo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(data) != "Ok" {
+		t.Fatalf("expected the liveness check over the socket, got %d %q", resp.StatusCode, data)
+	}
+	// a socket in use isn't taken over
+	err = removeStaleSocket(socket)
+	if err == nil {
+		t.Fatalf("expected a socket in use to be left alone")
+	}
+	_, err = os.Stat(socket)
+	if err != nil {
+		t.Fatalf("expected the socket to still exist, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// the current log level, kept separately so it can be changed on reload
+var logLevel = &slog.LevelVar{}
+
+// Set up the default logger according to the given settings.
+//  The returned closer should be called on exit, it closes the log file (if any).
+//
+func setupLogging(settings *logSettings) (io.Closer, error) {
+	err := setLogLevel(settings.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.WriteCloser
+	switch settings.Destination {
+	case "", "stderr":
+		out = nopCloser{os.Stderr}
+	case "stdout":
+		out = nopCloser{os.Stdout}
+	default:
+		out, err = os.OpenFile(settings.Destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch settings.Format {
+	case "", "json":
+		handler = slog.NewJSONHandler(out, opts)
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %s, expected json or text", settings.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return out, nil
+}
+
+// Set the log level from its name (debug, info, warn or error)
+//
+func setLogLevel(name string) error {
+	level, err := parseLogLevel(name)
+	if err != nil {
+		return err
+	}
+
+	logLevel.Set(level)
+	return nil
+}
+
+// Return the log level with the given name, defaulting to info
+//
+func parseLogLevel(name string) (slog.Level, error) {
+	if name == "" {
+		name = "info"
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	if err != nil {
+		return level, fmt.Errorf("unknown log level %s: %v", name, err)
+	}
+	return level, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer setLogLevel("info")
+
+	filename := filepath.Join(t.TempDir(), "silo.log")
+	cases := []struct{
+		Settings logSettings
+		Ok bool
+		Expect string
+	}{
+		{logSettings{Level: "warn", Destination: filename, Format: "text"}, true, "level=WARN msg=logged"},
+		{logSettings{Level: "debug", Destination: filename}, true, `"level":"DEBUG","msg":"logged"`},
+		{logSettings{Level: "loud", Destination: filename}, false, ""},
+		{logSettings{Destination: filename, Format: "xml"}, false, ""},
+	}
+	for i, c := range cases {
+		os.Remove(filename)
+		closer, err := setupLogging(&c.Settings)
+		if !c.Ok {
+			if err == nil {
+				closer.Close()
+				t.Errorf("%d: expected %+v to be refused", i, c.Settings)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+
+		slog.Info("not logged")
+		level, _ := parseLogLevel(c.Settings.Level)
+		slog.Log(nil, level, "logged")
+		closer.Close()
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), c.Expect) || (level > slog.LevelInfo && strings.Contains(string(data), "not logged")) {
+			t.Errorf("%d: unexpected log output %q", i, data)
+		}
+	}
+}
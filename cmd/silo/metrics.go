@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/voidshard/silo"
+	"github.com/voidshard/silo/metrics"
+)
+
+// Register gauges that report on what silo currently holds
+//
+func registerSiloMetrics(repo *silo.Silo) {
+	metrics.Default.NewGaugeFunc("silo_objects", "Number of objects stored.", func() float64 {
+		objects, _ := repo.Totals()
+		return float64(objects)
+	})
+	metrics.Default.NewGaugeFunc("silo_stored_bytes", "Total bytes stored (before encryption).", func() float64 {
+		_, bytes := repo.Totals()
+		return float64(bytes)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// transfers smaller than this don't get a progress bar
+	progressMinBytes = 1024 * 1024
+
+	// how often progress is redrawn
+	progressInterval = 200 * time.Millisecond
+
+	progressWidth = 30
+)
+
+// Progress of a single transfer, drawn on stderr
+//
+type progress struct {
+	label string
+	total int64
+	done int64
+	started time.Time
+	drawn time.Time
+}
+
+// Return a progress bar for a transfer of total bytes (-1 if unknown), or nil if one shouldn't be shown: if it's
+// small, we've been asked to be quiet, or stderr isn't a terminal.
+//
+func newProgress(label string, total int64, quiet bool) *progress {
+	if quiet || (total >= 0 && total < progressMinBytes) || !isTerminal(os.Stderr) {
+		return nil
+	}
+	return &progress{label: label, total: total, started: time.Now()}
+}
+
+// Wrap a reader, so reading from it advances the progress bar
+//
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{Reader: r, p: p}
+}
+
+type progressReader struct {
+	io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.p.add(int64(n))
+	return n, err
+}
+
+func (p *progress) add(n int64) {
+	p.done += n
+	if time.Since(p.drawn) >= progressInterval {
+		p.draw()
+	}
+}
+
+func (p *progress) draw() {
+	p.drawn = time.Now()
+	rate := float64(p.done) / time.Since(p.started).Seconds()
+
+	if p.total <= 0 {
+		fmt.Fprintf(os.Stderr, "\r%s %s %s/s\033[K", p.label, humanBytes(p.done), humanBytes(int64(rate)))
+		return
+	}
+
+	filled := int(int64(progressWidth) * p.done / p.total)
+	bar := make([]byte, progressWidth)
+	for i := range bar {
+		bar[i] = ' '
+		if i < filled {
+			bar[i] = '='
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\r%s [%s] %3d%% %s/%s %s/s\033[K", p.label, bar, 100 * p.done / p.total,
+		humanBytes(p.done), humanBytes(p.total), humanBytes(int64(rate)))
+}
+
+// Draw the final state & move past the progress bar
+//
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+}
+
+// Return whether the file is a terminal (rather than a pipe or file)
+//
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
+
+// Format a number of bytes for people
+//
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n) / float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+	"github.com/voidshard/silo"
+)
+
+// Reloads config on SIGHUP (or when the config file changes, if watching) & applies it to the running server.
+//
+type reloader struct {
+	filename string
+	insecure bool
+	bootstrap bool
+
+	repo *silo.Silo
+	listeners map[string]*listener
+	log *logSettings
+}
+
+// Read the config file & apply command line flags to it.
+//
+func loadConfig(filename string, insecure, bootstrap bool) (*Config, error) {
+	config, err := parseConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config.SiloConfig.Misc.AllowInsecureDefaults = insecure
+	if bootstrap {
+		// the bootstrapped admin replaces the well known default roles
+		config.SiloConfig.RemoveDefaultRoles()
+	}
+
+	return config, nil
+}
+
+// Re-read & apply the config. If anything is wrong with the new config, the old one is kept.
+//
+func (r *reloader) reload() {
+	slog.Info("reloading config", "file", r.filename)
+
+	config, err := loadConfig(r.filename, r.insecure, r.bootstrap)
+	if err != nil {
+		slog.Error("reload failed, keeping current config", "error", err)
+		return
+	}
+
+	if listenersChanged(r.listeners, config.Listener) {
+		slog.Warn("reload: adding, removing or changing listeners (other than their certificates) requires a restart, ignoring")
+	}
+
+	if config.Log.Destination != r.log.Destination || config.Log.Format != r.log.Format {
+		slog.Warn("reload: changing log Destination or Format requires a restart, ignoring")
+	}
+
+	// check everything before applying anything, so a mistake doesn't leave us half reloaded
+	certs := map[*certLoader]*loadedCert{}
+	for name, l := range r.listeners {
+		settings, ok := config.Listener[name]
+		if !ok || l.certs == nil || settings.SSLCert == "" {
+			continue
+		}
+		certs[l.certs], err = readCert(settings.SSLCert, settings.SSLKey)
+		if err != nil {
+			slog.Error("reload failed, keeping current config: unable to load certificate", "listener", name, "error", err)
+			return
+		}
+	}
+
+	level, err := parseLogLevel(config.Log.Level)
+	if err != nil {
+		slog.Error("reload failed, keeping current config", "error", err)
+		return
+	}
+
+	// silo checks its config before applying any of it
+	changes, err := r.repo.Reload(config.SiloConfig)
+	if err != nil {
+		slog.Error("reload failed, keeping current config", "error", err)
+		return
+	}
+
+	for _, change := range changes {
+		slog.Info("reload: config changed", "change", change)
+	}
+	for loader, loaded := range certs {
+		loader.use(loaded)
+	}
+	if config.Log.Level != r.log.Level {
+		logLevel.Set(level)
+		slog.Info("reload: config changed", "change", fmt.Sprintf("log Level %s -> %s", r.log.Level, config.Log.Level))
+	}
+
+	slog.Info("reloaded config")
+	r.log = config.Log
+}
+
+// Return if the listeners in a new config differ from those we're running, ignoring certificate paths
+// (certificates can be reloaded, but whether a listener uses TLS can't).
+//
+func listenersChanged(running map[string]*listener, configured map[string]*listenerSettings) bool {
+	if len(running) != len(configured) {
+		return true
+	}
+	for name, l := range running {
+		settings, ok := configured[name]
+		if !ok {
+			return true
+		}
+		if settings.Network != l.settings.Network || settings.Address != l.settings.Address {
+			return true
+		}
+		if settings.Protocol != l.settings.Protocol || settings.ClientCA != l.settings.ClientCA {
+			return true
+		}
+		if (settings.SSLCert != "") != (l.certs != nil) || !slices.Equal(settings.Handlers, l.settings.Handlers) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload whenever we get a SIGHUP. If interval is given, the config file is also checked for changes
+// that often & reloaded when it's modified.
+//
+func (r *reloader) run(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+
+	modified := r.modTime()
+	for {
+		select {
+		case <-hup:
+			r.reload()
+			modified = r.modTime()
+		case <-tick:
+			m := r.modTime()
+			if m.After(modified) {
+				modified = m
+				r.reload()
+			}
+		}
+	}
+}
+
+// Return when the config file was last modified
+//
+func (r *reloader) modTime() time.Time {
+	info, err := os.Stat(r.filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
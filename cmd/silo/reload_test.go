@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/voidshard/silo"
+)
+
+const testConfigFile = `
+[Listener "tls"]
+Address=127.0.0.1:0
+SSLCert=%[1]s/ssl.cert
+SSLKey=%[1]s/ssl.key
+
+[Log]
+Level=%[2]s
+
+[Misc]
+EncryptionKey=%[3]s
+
+[Store]
+Location=%[1]s/data
+
+[Role "admin"]
+Id=admin
+PasswordHash=%[4]s
+Get=true
+`
+
+func TestReloadAppliesNothingOnError(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "silo.ini")
+	certFile := filepath.Join(dir, "ssl.cert")
+	keyFile := filepath.Join(dir, "ssl.key")
+	key := "a key used only by tests, long enough to be accepted"
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(level, encryptionKey string) {
+		err := os.WriteFile(filename, []byte(fmt.Sprintf(testConfigFile, dir, level, encryptionKey, hash)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	newCert := func() {
+		err := generateCerts(&certRequest{certFile: certFile, keyFile: keyFile, validFor: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("info", key)
+	newCert()
+	config, err := loadConfig(filename, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := silo.NewSilo(config.SiloConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	loader, err := newCertLoader("tls", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := loader.cert
+
+	r := &reloader{
+		filename: filename,
+		repo: repo,
+		listeners: map[string]*listener{"tls": &listener{name: "tls", settings: config.Listener["tls"], certs: loader}},
+		log: config.Log,
+	}
+	defer setLogLevel("info")
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+
+	// a new certificate & log level, but a change silo refuses
+	newCert()
+	write("debug", "a different key, which can't be changed without a restart")
+	r.reload()
+	if loader.cert != original {
+		t.Fatalf("expected the certificate to be kept when silo refuses the config")
+	}
+	if logLevel.Level() != slog.LevelInfo || r.log.Level != "info" {
+		t.Fatalf("expected the log level to be kept when silo refuses the config")
+	}
+
+	// a bad log level
+	write("loud", key)
+	r.reload()
+	if loader.cert != original {
+		t.Fatalf("expected the certificate to be kept when the log level is bad")
+	}
+
+	write("debug", key)
+	r.reload()
+	if loader.cert == original {
+		t.Fatalf("expected the new certificate once the config is good")
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("expected the new log level once the config is good")
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"github.com/voidshard/silo"
+	"github.com/voidshard/silo/client"
+	"gopkg.in/gcfg.v1"
+)
+
+const (
+	// in cp, remote keys are written with this prefix, eg. silo:/some/key
+	remotePrefix = "silo:"
+
+	outputRaw = "raw"
+	outputJson = "json"
+)
+
+// A profiles file, giving the servers & credentials the client subcommands can use
+//
+//  [Profile "default"]
+//  Url=https://localhost:8080
+//  User=someone
+//  PasswordEnv=SILO_PASSWORD
+//  CA=/etc/silo/ca.cert
+//  PartSize=1000000
+//
+type profilesFile struct {
+	Profile map[string]*profileSettings
+}
+
+type profileSettings struct {
+	Url string
+	User string
+
+	// at most one of these should be given
+	Password string
+	PasswordFile string
+	PasswordEnv string
+
+	// trust certificates signed by this CA, or any certificate at all (development only)
+	CA string
+	Insecure bool
+
+	// files larger than this are uploaded in parts of this size; the server's MaxDataBytes
+	PartSize int64
+}
+
+// Where profiles are read from, unless told otherwise
+//
+func defaultProfilesFile() string {
+	if f := os.Getenv("SILO_PROFILES"); f != "" {
+		return f
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".silo", "profiles.ini")
+}
+
+// Load the named profile from the profiles file (if it exists), then apply any settings from the environment:
+// SILO_URL, SILO_USER, SILO_PASSWORD, SILO_CA & SILO_INSECURE.
+//
+func loadProfile(filename, name string, named bool) (*profileSettings, error) {
+	p := &profileSettings{}
+	if filename != "" && fileExists(filename) {
+		pf := &profilesFile{}
+		err := gcfg.ReadFileInto(pf, filename)
+		if err != nil {
+			return nil, err
+		}
+
+		found, ok := pf.Profile[name]
+		if ok {
+			p = found
+		} else if named {
+			return nil, fmt.Errorf("no profile %q in %s", name, filename)
+		}
+	} else if named {
+		return nil, fmt.Errorf("no profiles file %s", filename)
+	}
+
+	given := 0
+	for _, v := range []string{p.Password, p.PasswordFile, p.PasswordEnv} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, fmt.Errorf("profile %s: at most one of Password, PasswordFile or PasswordEnv may be given", name)
+	}
+
+	if p.PasswordFile != "" {
+		data, err := ioutil.ReadFile(p.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		p.Password = strings.TrimRight(string(data), "\r\n")
+	} else if p.PasswordEnv != "" {
+		value, ok := os.LookupEnv(p.PasswordEnv)
+		if !ok {
+			return nil, fmt.Errorf("profile %s: environment variable %s is not set", name, p.PasswordEnv)
+		}
+		p.Password = value
+	}
+
+	for env, setting := range map[string]*string{"SILO_URL": &p.Url, "SILO_USER": &p.User, "SILO_PASSWORD": &p.Password, "SILO_CA": &p.CA} {
+		if value := os.Getenv(env); value != "" {
+			*setting = value
+		}
+	}
+	if value := os.Getenv("SILO_INSECURE"); value == "1" || value == "true" {
+		p.Insecure = true
+	}
+
+	if p.Url == "" || p.User == "" {
+		return nil, fmt.Errorf("no server given; set Url & User in profile %s of %s, or SILO_URL & SILO_USER", name, filename)
+	}
+	return p, nil
+}
+
+// Build a client from the profile
+//
+func (p *profileSettings) client() (*client.Client, error) {
+	opts := []client.Option{}
+	if p.PartSize > 0 {
+		opts = append(opts, client.WithPartSize(p.PartSize))
+	}
+	if p.Insecure {
+		opts = append(opts, client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	} else if p.CA != "" {
+		pem, err := ioutil.ReadFile(p.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", p.CA)
+		}
+		opts = append(opts, client.WithRootCAs(pool))
+	}
+	return client.New(p.Url, p.User, p.Password, opts...)
+}
+
+// Running a client subcommand
+//
+type remote struct {
+	ctx context.Context
+	c *client.Client
+
+	output string
+	recursive bool
+	quiet bool
+
+	// set if anything failed, so we exit non zero
+	failed bool
+}
+
+// The outcome of an operation on a single key, as written in json output
+//
+type remoteMessage struct {
+	Key string
+	File string `json:",omitempty"`
+	Size int64 `json:",omitempty"`
+	ETag string `json:",omitempty"`
+	Data []byte `json:",omitempty"`
+}
+
+var remoteUsage = `usage:
+  silo get [flags] KEY [FILE]         fetch KEY to FILE (default stdout)
+  silo get -r [flags] PREFIX DIR      fetch every key under PREFIX into DIR
+  silo put [flags] FILE KEY           store FILE (- for stdin) under KEY
+  silo put -r [flags] DIR PREFIX      store every file under DIR, under PREFIX
+  silo rm [flags] KEY...              remove keys (with -r, every key under each prefix)
+  silo ls [flags] [PREFIX]            list keys
+  silo stat [flags] KEY...            show size & etag of keys
+  silo cp [flags] SRC DST             copy between local files & keys, written silo:/some/key
+
+The server & credentials come from a profile in the profiles file, overridden by SILO_URL, SILO_USER, SILO_PASSWORD,
+SILO_CA & SILO_INSECURE.
+
+flags:
+`
+
+// Run one of the client subcommands against a remote silo
+//
+func remoteMain(command string, args []string) {
+	profile := os.Getenv("SILO_PROFILE")
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, remoteUsage)
+		flags.PrintDefaults()
+	}
+	profilePtr := flags.String("profile", "default", "Profile to use from the profiles file (or set SILO_PROFILE)")
+	profilesPtr := flags.String("profiles", defaultProfilesFile(), "Profiles file (or set SILO_PROFILES)")
+	outputPtr := flags.String("o", outputRaw, "Output format: raw or json (one json object per line)")
+	recursivePtr := flags.Bool("r", false, "Transfer or remove everything under a directory or key prefix")
+	quietPtr := flags.Bool("q", false, "Don't show progress")
+	flags.Parse(args)
+
+	named := profile != ""
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "profile" {
+			profile = f.Value.String()
+			named = true
+		}
+	})
+	if profile == "" {
+		profile = *profilePtr
+	}
+
+	if *outputPtr != outputRaw && *outputPtr != outputJson {
+		fmt.Fprintf(os.Stderr, "unknown output format %q, expected raw or json\n", *outputPtr)
+		os.Exit(2)
+	}
+
+	settings, err := loadProfile(*profilesPtr, profile, named)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c, err := settings.client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	r := &remote{ctx: ctx, c: c, output: *outputPtr, recursive: *recursivePtr, quiet: *quietPtr}
+	args = flags.Args()
+	for i, arg := range args {
+		switch {
+		case command == "cp" && strings.HasPrefix(arg, remotePrefix):
+			args[i] = remotePrefix + remoteKey(strings.TrimPrefix(arg, remotePrefix))
+		case command == "cp", command == "put" && i == 0, command == "get" && i == 1:
+			// a local file
+		default:
+			args[i] = remoteKey(arg)
+		}
+	}
+
+	ok := true
+	switch command {
+	case "get":
+		ok = len(args) == 1 || len(args) == 2
+		if ok {
+			r.get(args)
+		}
+	case "put":
+		ok = len(args) == 2
+		if ok {
+			r.put(args[0], args[1])
+		}
+	case "rm":
+		ok = len(args) > 0
+		if ok {
+			r.rm(args)
+		}
+	case "ls":
+		ok = len(args) <= 1
+		if ok {
+			r.ls(append(args, "")[0])
+		}
+	case "stat":
+		ok = len(args) > 0
+		if ok {
+			r.stat(args)
+		}
+	case "cp":
+		ok = len(args) == 2
+		if ok {
+			r.cp(args[0], args[1])
+		}
+	}
+	if !ok {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if r.failed {
+		os.Exit(1)
+	}
+}
+
+// Keys stored over http begin with /, as they're the path of the url, so allow it to be left off
+//
+func remoteKey(key string) string {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return key
+	}
+	return "/" + key
+}
+
+// Report a failure with a key or file & carry on
+//
+func (r *remote) fail(name string, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	r.failed = true
+}
+
+// Write out the outcome of an operation. In raw output, line is written (if not empty).
+//
+func (r *remote) report(msg *remoteMessage, line string) {
+	if r.output == outputJson {
+		data, _ := json.Marshal(msg)
+		fmt.Println(string(data))
+	} else if line != "" {
+		fmt.Println(line)
+	}
+}
+
+func (r *remote) get(args []string) {
+	if r.recursive {
+		if len(args) != 2 {
+			r.fail("get", fmt.Errorf("-r requires a key prefix & a directory"))
+			return
+		}
+		r.downloadTree(args[0], args[1])
+		return
+	}
+
+	file := "-"
+	if len(args) == 2 {
+		file = args[1]
+	}
+	r.download(args[0], file)
+}
+
+func (r *remote) put(file, key string) {
+	if r.recursive {
+		r.uploadTree(file, key)
+		return
+	}
+	r.upload(file, key)
+}
+
+func (r *remote) rm(keys []string) {
+	for _, key := range keys {
+		targets := []string{key}
+		if r.recursive {
+			var err error
+			targets, err = r.c.List(r.ctx, key)
+			if err != nil {
+				r.fail(key, err)
+				continue
+			}
+		}
+
+		for _, target := range targets {
+			err := r.c.Delete(r.ctx, target)
+			if err != nil {
+				r.fail(target, err)
+				continue
+			}
+			r.report(&remoteMessage{Key: target}, "")
+		}
+	}
+}
+
+func (r *remote) ls(prefix string) {
+	keys, err := r.c.List(r.ctx, prefix)
+	if err != nil {
+		r.fail("ls", err)
+		return
+	}
+	for _, key := range keys {
+		r.report(&remoteMessage{Key: key}, key)
+	}
+}
+
+func (r *remote) stat(keys []string) {
+	for _, key := range keys {
+		info, err := r.c.Stat(r.ctx, key)
+		if err != nil {
+			r.fail(key, err)
+			continue
+		}
+		r.report(&remoteMessage{Key: key, Size: info.Size, ETag: info.ETag}, fmt.Sprintf("%s\t%d\t%s", key, info.Size, info.ETag))
+	}
+}
+
+// Copy between local files & keys; keys are given as silo:/some/key. With both remote, the copy is made by the
+// server.
+//
+func (r *remote) cp(src, dst string) {
+	srcKey, srcRemote := strings.CutPrefix(src, remotePrefix)
+	dstKey, dstRemote := strings.CutPrefix(dst, remotePrefix)
+
+	switch {
+	case srcRemote && dstRemote:
+		r.copyRemote(srcKey, dstKey)
+	case srcRemote:
+		r.get([]string{srcKey, dst})
+	case dstRemote:
+		r.put(src, dstKey)
+	default:
+		r.fail("cp", fmt.Errorf("one of %s or %s must be a key, written %s/some/key", src, dst, remotePrefix))
+	}
+}
+
+// Copy keys on the server
+//
+func (r *remote) copyRemote(src, dst string) {
+	if !r.recursive {
+		err := r.c.Copy(r.ctx, src, dst)
+		if err != nil {
+			r.fail(src, err)
+			return
+		}
+		r.report(&remoteMessage{Key: dst}, "")
+		return
+	}
+
+	keys, err := r.c.List(r.ctx, src)
+	if err != nil {
+		r.fail(src, err)
+		return
+	}
+	for _, key := range keys {
+		target := dst + strings.TrimPrefix(key, src)
+		err := r.c.Copy(r.ctx, key, target)
+		if err != nil {
+			r.fail(key, err)
+			continue
+		}
+		r.report(&remoteMessage{Key: target}, "")
+	}
+}
+
+// Fetch a key to a file, or stdout if file is -. Files are written under a temp name & renamed into place, so an
+// interrupted download never leaves a partial file.
+//
+func (r *remote) download(key, file string) {
+	info, err := r.c.Stat(r.ctx, key)
+	if err != nil {
+		r.fail(key, err)
+		return
+	}
+
+	body, err := r.c.GetStream(r.ctx, key)
+	if err != nil {
+		r.fail(key, err)
+		return
+	}
+	defer body.Close()
+
+	p := newProgress(key, info.Size, r.quiet)
+	in := p.reader(body)
+
+	if file == "-" {
+		if r.output == outputJson {
+			data, err := io.ReadAll(in)
+			p.finish()
+			if err != nil {
+				r.fail(key, err)
+				return
+			}
+			r.report(&remoteMessage{Key: key, Size: int64(len(data)), ETag: info.ETag, Data: data}, "")
+			return
+		}
+
+		_, err = io.Copy(os.Stdout, in)
+		p.finish()
+		if err != nil {
+			r.fail(key, err)
+		}
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		r.fail(file, err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "." + filepath.Base(file) + ".part-")
+	if err != nil {
+		r.fail(file, err)
+		return
+	}
+
+	n, err := io.Copy(tmp, in)
+	p.finish()
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		r.fail(key, err)
+		return
+	}
+	r.report(&remoteMessage{Key: key, File: file, Size: n, ETag: info.ETag}, "")
+}
+
+// Store a file, or stdin if file is -, under key.
+//
+func (r *remote) upload(file, key string) {
+	if file == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			r.fail("stdin", err)
+			return
+		}
+		err = r.c.Put(r.ctx, key, data)
+		if err != nil {
+			r.fail(key, err)
+			return
+		}
+		r.report(&remoteMessage{Key: key, Size: int64(len(data))}, "")
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		r.fail(file, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		r.fail(file, err)
+		return
+	}
+	if info.IsDir() {
+		r.fail(file, fmt.Errorf("is a directory, use -r"))
+		return
+	}
+
+	p := newProgress(file, info.Size(), r.quiet)
+	err = r.c.PutStream(r.ctx, key, p.reader(f), info.Size())
+	p.finish()
+	if err != nil {
+		r.fail(key, err)
+		return
+	}
+	r.report(&remoteMessage{Key: key, File: file, Size: info.Size()}, "")
+}
+
+// Store every file under dir, under the key prefix, keeping their paths
+//
+func (r *remote) uploadTree(dir, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			r.fail(path, err)
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			r.fail(path, err)
+			return nil
+		}
+		r.upload(path, prefix + "/" + filepath.ToSlash(rel))
+		return r.ctx.Err()
+	})
+	if err != nil {
+		r.fail(dir, err)
+	}
+}
+
+// Fetch every key under the prefix into dir, keeping their paths
+//
+func (r *remote) downloadTree(prefix, dir string) {
+	keys, err := r.c.List(r.ctx, prefix)
+	if err != nil {
+		r.fail(prefix, err)
+		return
+	}
+
+	for _, key := range keys {
+		rel := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+		path := filepath.FromSlash(rel)
+		if rel == "" || !filepath.IsLocal(path) {
+			r.fail(key, fmt.Errorf("%w: key can't be written under %s", silo.ErrBadRequest, dir))
+			continue
+		}
+
+		r.download(key, filepath.Join(dir, path))
+		if errors.Is(r.ctx.Err(), context.Canceled) {
+			return
+		}
+	}
+}
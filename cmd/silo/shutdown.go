@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Serve on all listeners until one fails or we're asked to stop with SIGINT or SIGTERM.
+//  We then stop accepting connections on every listener & wait up to timeout for in flight requests to finish,
+//  after which any that remain are closed. A second signal skips the wait.
+//
+func serveUntilSignalled(listeners map[string]*listener, timeout time.Duration) error {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	failed := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			err := l.serve()
+			if !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("listener failed", "listener", l.name, "error", err)
+			}
+			failed <- err
+		}(l)
+	}
+
+	var err error
+	select {
+	case err = <-failed:
+		slog.Info("shutting down, draining connections", "timeout", timeout.String())
+	case sig := <-stop:
+		slog.Info("shutting down, draining connections", "signal", sig.String(), "timeout", timeout.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			slog.Warn("second signal received, closing connections")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			shutdownErr := l.shutdown(ctx)
+			if errors.Is(shutdownErr, context.DeadlineExceeded) || errors.Is(shutdownErr, context.Canceled) {
+				slog.Warn("requests still in flight, closing connections", "listener", l.name)
+				shutdownErr = l.close()
+			}
+			if shutdownErr != nil {
+				slog.Error("unable to shut down listener", "listener", l.name, "error", shutdownErr)
+			}
+		}(l)
+	}
+	wg.Wait()
+
+	// serve returns http.ErrServerClosed once shutdown begins
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Serve handler on a loopback listener, as the server would
+//
+func testListener(t *testing.T, handler http.Handler) *listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &listener{name: "test", srv: &http.Server{Handler: handler}, ln: ln}
+}
+
+// A handler that blocks until released, telling us when a request has arrived
+//
+func blockingHandler(started chan<- bool, release <-chan bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("done"))
+	})
+}
+
+func TestShutdownDrains(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	l := testListener(t, blockingHandler(started, release))
+
+	served := make(chan error, 1)
+	go func() { served <- serveUntilSignalled(map[string]*listener{"test": l}, 10 * time.Second) }()
+
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.ln.Addr().String() + "/")
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		response <- string(data)
+	}()
+
+	// once a request is in flight, we're listening for signals
+	<-started
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := net.Dial("tcp", l.ln.Addr().String())
+	if err == nil {
+		t.Errorf("expected new connections to be refused once shutting down")
+	}
+
+	close(release)
+	if got := <-response; got != "done" {
+		t.Fatalf("expected the in flight request to finish, got %q", got)
+	}
+	err = <-served
+	if err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	defer close(release)
+	l := testListener(t, blockingHandler(started, release))
+
+	served := make(chan error, 1)
+	go func() { served <- serveUntilSignalled(map[string]*listener{"test": l}, 100 * time.Millisecond) }()
+	go http.Get("http://" + l.ln.Addr().String() + "/")
+
+	<-started
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected requests still in flight after the timeout to be closed")
+	}
+}
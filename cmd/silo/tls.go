@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+	"github.com/voidshard/silo/metrics"
+)
+
+const (
+	// how often certificate files are checked for changes, at most
+	certCheckInterval = 10 * time.Second
+
+	// TLS policies, after Mozilla's server side TLS recommendations
+	TLSPolicyModern = "modern" // TLS 1.3 only
+	TLSPolicyIntermediate = "intermediate" // TLS 1.2 & 1.3, forward secret AEAD ciphers only
+	TLSPolicyOld = "old" // TLS 1.2 & 1.3, also allowing CBC & non forward secret ciphers for old clients
+)
+
+var (
+	certExpiry = metrics.Default.NewGaugeVec(
+		"silo_tls_certificate_expiry_timestamp_seconds",
+		"When the certificate served by each listener expires, as a unix timestamp.",
+		"listener",
+	)
+
+	intermediateCiphers = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	oldCiphers = append([]uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	}, intermediateCiphers...)
+
+	tlsVersions = map[string]uint16{
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256": tls.CurveP256,
+		"P384": tls.CurveP384,
+		"P521": tls.CurveP521,
+	}
+)
+
+// Build the TLS config for a listener from the [Server] TLS settings.
+//
+func newTLSConfig(settings *serverSettings, certs *certLoader) (*tls.Config, error) {
+	config := &tls.Config{
+		// certificates come from GetCertificate, so they can be reloaded
+		GetCertificate: certs.GetCertificate,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+
+	// Nb. Go doesn't allow configuring TLS 1.3 ciphers, they're all considered secure
+	switch settings.TLSPolicy {
+	case TLSPolicyModern:
+		config.MinVersion = tls.VersionTLS13
+	case TLSPolicyIntermediate, "":
+		config.MinVersion = tls.VersionTLS12
+		config.CipherSuites = intermediateCiphers
+	case TLSPolicyOld:
+		config.MinVersion = tls.VersionTLS12
+		config.CipherSuites = oldCiphers
+	default:
+		return nil, fmt.Errorf("unknown TLSPolicy %q, expected one of %s, %s or %s", settings.TLSPolicy, TLSPolicyModern, TLSPolicyIntermediate, TLSPolicyOld)
+	}
+
+	if settings.TLSMinVersion != "" {
+		v, ok := tlsVersions[settings.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLSMinVersion %q, expected 1.2 or 1.3", settings.TLSMinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	if len(settings.TLSCurves) > 0 {
+		config.CurvePreferences = []tls.CurveID{}
+		for _, name := range settings.TLSCurves {
+			curve, ok := tlsCurves[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLSCurves value %q, expected one of X25519, P256, P384 or P521", name)
+			}
+			config.CurvePreferences = append(config.CurvePreferences, curve)
+		}
+	}
+
+	return config, nil
+}
+
+// Holds a listener's certificate so that it can be swapped out while the server is running.
+//  The certificate is reloaded when the config is, and whenever the files on disk change (eg. on renewal).
+//
+type certLoader struct {
+	name string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+	certFile string
+	keyFile string
+	modified time.Time // when the files we loaded were last modified
+	checked time.Time // when we last checked them
+}
+
+func newCertLoader(name, certFile, keyFile string) (*certLoader, error) {
+	c := &certLoader{name: name}
+	return c, c.load(certFile, keyFile)
+}
+
+// A certificate read from disk, not yet in use
+//
+type loadedCert struct {
+	cert *tls.Certificate
+	certFile string
+	keyFile string
+	modified time.Time
+}
+
+// Read & parse a certificate & key from disk, without using them.
+//
+func readCert(certFile, keyFile string) (*loadedCert, error) {
+	modified := newestModTime(certFile, keyFile)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+	return &loadedCert{cert: &cert, certFile: certFile, keyFile: keyFile, modified: modified}, nil
+}
+
+// Read the certificate & key from disk, replacing the current certificate.
+//  If either can't be read the current certificate is kept.
+//
+func (c *certLoader) load(certFile, keyFile string) error {
+	loaded, err := readCert(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.use(loaded)
+	return nil
+}
+
+// Replace the current certificate with one already read.
+//
+func (c *certLoader) use(loaded *loadedCert) {
+	leaf := loaded.cert.Leaf
+	certExpiry.Set(float64(leaf.NotAfter.Unix()), c.name)
+	if time.Until(leaf.NotAfter) < 0 {
+		slog.Warn("certificate has expired", "listener", c.name, "certificate", loaded.certFile, "expired", leaf.NotAfter)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = loaded.cert
+	c.certFile = loaded.certFile
+	c.keyFile = loaded.keyFile
+	c.modified = loaded.modified
+	c.checked = time.Now()
+}
+
+// Reload the certificate if the files have changed since we loaded them. Files are checked at most once
+// every certCheckInterval.
+//
+func (c *certLoader) refresh() {
+	c.lock.Lock()
+	if time.Since(c.checked) < certCheckInterval {
+		c.lock.Unlock()
+		return
+	}
+	c.checked = time.Now()
+	certFile, keyFile, modified := c.certFile, c.keyFile, c.modified
+	c.lock.Unlock()
+
+	if !newestModTime(certFile, keyFile).After(modified) {
+		return
+	}
+
+	// the files may be mid update (eg. the cert written but not yet the key), in which case we'll retry next check
+	err := c.load(certFile, keyFile)
+	if err != nil {
+		slog.Warn("certificate changed on disk but couldn't be loaded, keeping current certificate", "listener", c.name, "error", err)
+		return
+	}
+	slog.Info("reloaded certificate", "listener", c.name, "certificate", certFile)
+}
+
+// Return the current certificate.
+// Set as tls.Config.GetCertificate so that each new handshake picks up the latest certificate.
+//
+func (c *certLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.refresh()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// Return when the most recently modified of the given files was modified, or the zero time if none can be read.
+//
+func newestModTime(filenames ...string) time.Time {
+	newest := time.Time{}
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest
+}
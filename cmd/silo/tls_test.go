@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Generate a server certificate (& CA) in a fresh temp dir, returning the cert & key files
+//
+func testCerts(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ssl.cert")
+	keyFile := filepath.Join(dir, "ssl.key")
+	err := generateCerts(&certRequest{certFile: certFile, keyFile: keyFile, hosts: defaultCertHosts, validFor: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSPolicies(t *testing.T) {
+	cases := []struct{
+		Settings serverSettings
+		Ok bool
+		MinVersion uint16
+		Ciphers int
+	}{
+		{serverSettings{}, true, tls.VersionTLS12, len(intermediateCiphers)},
+		{serverSettings{TLSPolicy: TLSPolicyModern}, true, tls.VersionTLS13, 0},
+		{serverSettings{TLSPolicy: TLSPolicyOld}, true, tls.VersionTLS12, len(oldCiphers)},
+		{serverSettings{TLSPolicy: TLSPolicyOld, TLSMinVersion: "1.3"}, true, tls.VersionTLS13, len(oldCiphers)},
+		{serverSettings{TLSPolicy: "ancient"}, false, 0, 0},
+		{serverSettings{TLSMinVersion: "1.1"}, false, 0, 0},
+		{serverSettings{TLSCurves: []string{"P256", "X448"}}, false, 0, 0},
+	}
+	for i, c := range cases {
+		config, err := newTLSConfig(&c.Settings, &certLoader{})
+		if c.Ok != (err == nil) {
+			t.Errorf("%d: expected ok %v, got %v", i, c.Ok, err)
+			continue
+		}
+		if c.Ok && (config.MinVersion != c.MinVersion || len(config.CipherSuites) != c.Ciphers) {
+			t.Errorf("%d: expected min version %x with %d ciphers, got %x with %d", i, c.MinVersion, c.Ciphers, config.MinVersion, len(config.CipherSuites))
+		}
+	}
+
+	config, err := newTLSConfig(&serverSettings{TLSCurves: []string{"P384", "X25519"}}, &certLoader{})
+	if err != nil || len(config.CurvePreferences) != 2 || config.CurvePreferences[0] != tls.CurveP384 {
+		t.Fatalf("expected the given curves in order, got %v %v", config.CurvePreferences, err)
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	certFile, keyFile := testCerts(t)
+	loader, err := newCertLoader("test", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newTLSConfig(&serverSettings{TLSPolicy: TLSPolicyModern}, loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	srv.TLS = config
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion: version,
+			MaxVersion: version,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		if (version == tls.VersionTLS13) != (err == nil) {
+			t.Errorf("version %x: expected only TLS 1.3 to be accepted, got %v", version, err)
+		}
+	}
+}
+
+func TestCertificateReloaded(t *testing.T) {
+	certFile, keyFile := testCerts(t)
+	loader, err := newCertLoader("test", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := loader.GetCertificate(nil)
+
+	// unchanged files aren't reloaded
+	loader.checked = time.Time{}
+	same, _ := loader.GetCertificate(nil)
+	if same != original {
+		t.Fatalf("expected the certificate to be kept while the files are unchanged")
+	}
+
+	// renewed, but checked too recently to notice
+	time.Sleep(10 * time.Millisecond)
+	err = generateCerts(&certRequest{certFile: certFile, keyFile: keyFile, validFor: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, _ = loader.GetCertificate(nil)
+	if same != original {
+		t.Fatalf("expected files to be checked at most every %v", certCheckInterval)
+	}
+
+	loader.checked = time.Time{}
+	renewed, _ := loader.GetCertificate(nil)
+	if renewed == original {
+		t.Fatalf("expected the renewed certificate to be picked up")
+	}
+}
@@ -1,8 +1,12 @@
 package silo
 
 import (
+	"time"
 	"path/filepath"
 	"os"
+	"fmt"
+	"sort"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Full silo config
@@ -13,53 +17,213 @@ type Config struct {
 	Store *storageSettings
 
 	User map[string]*Role
+
+	// quotas on key prefixes, by name
+	Quota map[string]*Quota
+
+	Audit *auditSettings
 }
 
+const (
+	// The encryption key used if none is configured. Silo refuses to use it unless insecure defaults are allowed.
+	DefaultEncryptionKey = "YouReallyShouldChangeThisToSomethingElse"
+)
+
 // Misc silo settings
 //
 type miscSettings struct {
 	MaxDataBytes int
 	MaxKeyBytes int
 	EncryptionKey string
+
+	// the largest object that can be assembled by a multipart upload (0 is no limit)
+	MaxUploadBytes int64
+	// multipart uploads not completed within this long are removed (0 keeps them forever)
+	UploadExpiry time.Duration
+	// how many multipart uploads each role may have in progress at once (0 is no limit)
+	MaxUploads int
+
+	// limits on a batch: how many operations it may hold, & the total data it may carry in or out
+	MaxBatchOps int
+	MaxBatchBytes int64
+
+	// permit the default encryption key & roles to be used. This is for development only.
+	AllowInsecureDefaults bool
 }
 
 // Construct a new config with some defaults.
+//  Nb. the default encryption key & roles are well known, so Validate() will reject them unless
+//  AllowInsecureDefaults is set.
 //
 func NewConfig() *Config {
-	return &Config {
+	c := &Config {
 		Misc: miscSettings{
-			EncryptionKey: "YouReallyShouldChangeThisToSomethingElse",
+			EncryptionKey: DefaultEncryptionKey,
 			MaxDataBytes: 1000000,
 			MaxKeyBytes: 100,
+			MaxUploadBytes: 10 << 30,
+			UploadExpiry: 24 * time.Hour,
+			MaxUploads: 100,
+			MaxBatchOps: 1000,
+			MaxBatchBytes: 64 << 20,
 		},
 		Store: &storageSettings{
 			Driver: "",
 			Location: filepath.Join(os.TempDir(), "silo", "store"),
 		},
+		Quota: map[string]*Quota{},
+		Audit: &auditSettings{},
 		User: map[string]*Role{
-			"read": &Role{
-				Id: "read",
-				Password: []byte("readpassword"),
-				CanGet: true,
-			},
-			"write": &Role{
-				Id: "write",
-				Password: []byte("writepassword"),
-				CanPut: true,
-			},
-			"readwrite": &Role{
-				Id: "readwrite",
-				Password: []byte("readwritepassword"),
-				CanGet: true,
-				CanPut: true,
-			},
-			"admin": &Role{
-				Id: "admin",
-				Password: []byte("adminpassword"),
-				CanRm: true,
-				CanGet: true,
-				CanPut: true,
-			},
+			"read": defaultRole("read", "readpassword", true, false, false),
+			"write": defaultRole("write", "writepassword", false, true, false),
+			"readwrite": defaultRole("readwrite", "readwritepassword", true, true, false),
+			"admin": defaultRole("admin", "adminpassword", true, true, true),
 		},
 	}
+	c.User["admin"].CanAdmin = true
+	return c
+}
+
+// Build one of the default roles.
+//  The passwords are well known so there's nothing to gain from an expensive hash, and NewConfig is called
+//  on every (re)load of the config, so we use the cheapest bcrypt cost.
+//  Hashing can only fail if bcrypt is given bad input, which our fixed passwords aren't, so we panic.
+//
+func defaultRole(name, password string, get, put, rm bool) *Role {
+	r, err := newRoleWithCost(name, password, bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+
+	r.CanGet = get
+	r.CanPut = put
+	r.CanRm = rm
+	r.isDefault = true
+	return r
+}
+
+// Remove any of the default roles from the config.
+//
+func (c *Config) RemoveDefaultRoles() {
+	for id, r := range c.User {
+		if r.isDefault {
+			delete(c.User, id)
+		}
+	}
+}
+
+// Check the config is safe to use, that is, we're not using well known credentials or keys.
+//
+func (c *Config) Validate() error {
+	if c.Misc.AllowInsecureDefaults {
+		return nil
+	}
+
+	if c.Misc.EncryptionKey == DefaultEncryptionKey {
+		return fmt.Errorf("%w: refusing to use the default encryption key, set EncryptionKey", ErrInsecure)
+	}
+
+	for id, r := range c.User {
+		if r.isDefault {
+			return fmt.Errorf("%w: refusing to use default role %s, configure roles or bootstrap", ErrInsecure, id)
+		}
+	}
+
+	return nil
+}
+
+// Describe the differences between two configs, one line per change.
+//  Nb. password hashes are salted, so a role whose password was hashed from plaintext on load will always
+//  appear to have a changed password; we don't report on passwords for that reason.
+//
+func diffConfig(old, new *Config) []string {
+	changes := []string{}
+
+	if old.Misc.MaxDataBytes != new.Misc.MaxDataBytes {
+		changes = append(changes, fmt.Sprintf("MaxDataBytes %d -> %d", old.Misc.MaxDataBytes, new.Misc.MaxDataBytes))
+	}
+	if old.Misc.MaxKeyBytes != new.Misc.MaxKeyBytes {
+		changes = append(changes, fmt.Sprintf("MaxKeyBytes %d -> %d", old.Misc.MaxKeyBytes, new.Misc.MaxKeyBytes))
+	}
+	if old.Misc.MaxUploadBytes != new.Misc.MaxUploadBytes {
+		changes = append(changes, fmt.Sprintf("MaxUploadBytes %d -> %d", old.Misc.MaxUploadBytes, new.Misc.MaxUploadBytes))
+	}
+	if old.Misc.UploadExpiry != new.Misc.UploadExpiry {
+		changes = append(changes, fmt.Sprintf("UploadExpiry %s -> %s", old.Misc.UploadExpiry, new.Misc.UploadExpiry))
+	}
+	if old.Misc.MaxUploads != new.Misc.MaxUploads {
+		changes = append(changes, fmt.Sprintf("MaxUploads %d -> %d", old.Misc.MaxUploads, new.Misc.MaxUploads))
+	}
+	if old.Misc.MaxBatchOps != new.Misc.MaxBatchOps {
+		changes = append(changes, fmt.Sprintf("MaxBatchOps %d -> %d", old.Misc.MaxBatchOps, new.Misc.MaxBatchOps))
+	}
+	if old.Misc.MaxBatchBytes != new.Misc.MaxBatchBytes {
+		changes = append(changes, fmt.Sprintf("MaxBatchBytes %d -> %d", old.Misc.MaxBatchBytes, new.Misc.MaxBatchBytes))
+	}
+
+	for id, o := range old.User {
+		n, ok := new.User[id]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("role %s: removed", id))
+			continue
+		}
+
+		for _, change := range diffRole(o, n) {
+			changes = append(changes, fmt.Sprintf("role %s: %s", id, change))
+		}
+	}
+	for id := range new.User {
+		_, ok := old.User[id]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("role %s: added", id))
+		}
+	}
+
+	for name, o := range old.Quota {
+		n, ok := new.Quota[name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("quota %s: removed", name))
+		} else if *o != *n {
+			changes = append(changes, fmt.Sprintf("quota %s: %+v -> %+v", name, *o, *n))
+		}
+	}
+	for name := range new.Quota {
+		_, ok := old.Quota[name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("quota %s: added", name))
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+// Describe the differences in permissions & limits between two versions of a role.
+//
+func diffRole(old, new *Role) []string {
+	changes := []string{}
+	flags := []struct{
+		name string
+		old, new bool
+	}{
+		{"CanGet", old.CanGet, new.CanGet},
+		{"CanPut", old.CanPut, new.CanPut},
+		{"CanRm", old.CanRm, new.CanRm},
+		{"CanAppend", old.CanAppend, new.CanAppend},
+		{"CanAdmin", old.CanAdmin, new.CanAdmin},
+		{"Disabled", old.Disabled, new.Disabled},
+	}
+	for _, f := range flags {
+		if f.old != f.new {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", f.name, f.old, f.new))
+		}
+	}
+
+	if old.MaxBytes != new.MaxBytes {
+		changes = append(changes, fmt.Sprintf("MaxBytes %d -> %d", old.MaxBytes, new.MaxBytes))
+	}
+	if old.MaxObjects != new.MaxObjects {
+		changes = append(changes, fmt.Sprintf("MaxObjects %d -> %d", old.MaxObjects, new.MaxObjects))
+	}
+	return changes
 }
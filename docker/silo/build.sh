@@ -55,6 +55,10 @@ cp -v ${TOOL_DIR}/ssl.* dist/
 mv -v ${TOOL_DIR}/ssl.* build/
 cp -v ${ROOT}*.go build/
 cp -vr ${ROOT}/cmd build/
+cp -vr ${ROOT}/metrics build/
+cp -vr ${ROOT}/client build/
+cp -vr ${ROOT}/server build/
+cp -vr ${ROOT}/rpc build/
 
 # print state of build dir
 set +e
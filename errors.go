@@ -0,0 +1,81 @@
+package silo
+
+import (
+	"errors"
+)
+
+// Errors returned by silo & its storage drivers. Errors are wrapped with more detail, so test for
+// these with errors.Is.
+//
+var (
+	ErrForbidden = errors.New("forbidden")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound = errors.New("not found")
+	ErrExists = errors.New("already exists")
+	ErrTooLarge = errors.New("too large")
+	ErrKeyTooLong = errors.New("key too long")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrInsecure = errors.New("insecure")
+	ErrBadRequest = errors.New("bad request")
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+	ErrUnsupported = errors.New("unsupported")
+	ErrAborted = errors.New("aborted")
+	ErrPending = errors.New("committed, not yet applied")
+)
+
+// returned when the storage driver doesn't implement some optional interface
+var errNotSupported = errors.New("not supported by this storage driver")
+
+// returned (wrapped) by Transaction.Commit when the transaction is committed, but couldn't be applied yet
+var errNotApplied = errors.New("transaction committed but not yet applied")
+
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// machine readable codes for each of our errors, as sent to clients
+//
+var errorCodes = []struct{
+	err error
+	code string
+}{
+	{ErrForbidden, "forbidden"},
+	{ErrUnauthorized, "unauthorized"},
+	{ErrNotFound, "not_found"},
+	{ErrExists, "exists"},
+	{ErrTooLarge, "too_large"},
+	{ErrKeyTooLong, "key_too_long"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrInsecure, "insecure"},
+	{ErrBadRequest, "bad_request"},
+	{ErrRangeNotSatisfiable, "range_not_satisfiable"},
+	{ErrUnsupported, "unsupported"},
+	{ErrAborted, "aborted"},
+	{ErrPending, "pending"},
+}
+
+// Code used for errors that aren't one of ours
+//
+const ErrorCodeInternal = "internal"
+
+// Return the machine readable code for the given error.
+//
+func ErrorCode(err error) string {
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return ErrorCodeInternal
+}
+
+// Return the error for the given machine readable code, or nil if the code isn't known.
+//
+func CodeError(code string) error {
+	for _, e := range errorCodes {
+		if e.code == code {
+			return e.err
+		}
+	}
+	return nil
+}
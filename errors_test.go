@@ -0,0 +1,26 @@
+package silo
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	for _, e := range errorCodes {
+		wrapped := fmt.Errorf("%w: some detail", e.err)
+		if ErrorCode(wrapped) != e.code {
+			t.Errorf("expected %v to have code %s, got %s", wrapped, e.code, ErrorCode(wrapped))
+		}
+		if CodeError(e.code) != e.err {
+			t.Errorf("expected code %s to give %v, got %v", e.code, e.err, CodeError(e.code))
+		}
+	}
+
+	if ErrorCode(errors.New("something else")) != ErrorCodeInternal {
+		t.Errorf("expected other errors to be internal")
+	}
+	if CodeError("nonsense") != nil || CodeError(ErrorCodeInternal) != nil {
+		t.Errorf("expected unknown codes to give no error")
+	}
+}
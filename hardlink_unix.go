@@ -0,0 +1,6 @@
+//go:build unix
+
+package silo
+
+// whether the filesystem driver copies with hard links
+const hardlinks = true
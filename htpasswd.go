@@ -0,0 +1,45 @@
+package silo
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Read roles from an htpasswd format file, that is, lines of "name:hash".
+//  Only bcrypt & argon2 hashes are supported; the older crypt, MD5 (apr1) & SHA1 schemes are rejected.
+//  Roles are returned without any permissions; it's up to the caller to grant them.
+//
+func ReadHtpasswd(filename string) ([]*Role, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	roles := []*Role{}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:hash", filename, lineno)
+		}
+
+		r, err := NewRoleFromHash(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		roles = append(roles, r)
+	}
+
+	return roles, scanner.Err()
+}
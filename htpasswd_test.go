@@ -0,0 +1,59 @@
+package silo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestReadHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{
+		Name string
+		Content string
+		Roles []string
+	}{
+		{"bcrypt & argon2", "# a comment\n\nalice:" + string(hash) + "\nbob:" + testArgon2("secret", 64, 1, 1) + "\n", []string{"alice", "bob"}},
+		{"md5 is rejected", "alice:$apr1$salt$hash\n", nil},
+		{"missing hash", "alice\n", nil},
+		{"missing name", ":" + string(hash) + "\n", nil},
+	}
+
+	for _, c := range cases {
+		filename := filepath.Join(t.TempDir(), "htpasswd")
+		err := os.WriteFile(filename, []byte(c.Content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roles, err := ReadHtpasswd(filename)
+		if c.Roles == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.Name, err)
+			continue
+		}
+
+		if len(roles) != len(c.Roles) {
+			t.Errorf("%s: expected %d roles, got %d", c.Name, len(c.Roles), len(roles))
+			continue
+		}
+		for i, r := range roles {
+			if r.Id != c.Roles[i] || !r.CheckPassword("secret") {
+				t.Errorf("%s: expected role %s with the password, got %s", c.Name, c.Roles[i], r.Id)
+			}
+			if r.CanGet || r.CanPut || r.CanRm || r.CanAdmin {
+				t.Errorf("%s: expected role %s to have no permissions", c.Name, r.Id)
+			}
+		}
+	}
+}
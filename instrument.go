@@ -0,0 +1,185 @@
+package silo
+
+import (
+	"time"
+	"github.com/voidshard/silo/metrics"
+)
+
+var (
+	storageLatency = metrics.Default.NewHistogramVec(
+		"silo_storage_operation_seconds",
+		"Time taken by storage driver operations.",
+		metrics.DefaultBuckets,
+		"driver", "op",
+	)
+	storageErrors = metrics.Default.NewCounterVec(
+		"silo_storage_errors_total",
+		"Storage driver operations that returned an error (other than not found).",
+		"driver", "op",
+	)
+)
+
+// Wraps a storage driver, recording how long each operation takes
+//
+type instrumented struct {
+	Storage
+	driver string
+}
+
+func instrument(driver string, s Storage) Storage {
+	return &instrumented{Storage: s, driver: driver}
+}
+
+// Record an operation that started at 'start' & returned err
+//
+func (i *instrumented) observe(op string, start time.Time, err error) {
+	storageLatency.Observe(time.Since(start).Seconds(), i.driver, op)
+	if err != nil && !isNotFound(err) {
+		storageErrors.Inc(i.driver, op)
+	}
+}
+
+func (i *instrumented) Put(key string, data []byte) error {
+	start := time.Now()
+	err := i.Storage.Put(key, data)
+	i.observe("put", start, err)
+	return err
+}
+
+func (i *instrumented) Exists(key string) (bool, error) {
+	start := time.Now()
+	exists, err := i.Storage.Exists(key)
+	i.observe("exists", start, err)
+	return exists, err
+}
+
+func (i *instrumented) Get(key string) ([]byte, error) {
+	start := time.Now()
+	data, err := i.Storage.Get(key)
+	i.observe("get", start, err)
+	return data, err
+}
+
+func (i *instrumented) GetRange(key string, offset, length int64) ([]byte, error) {
+	start := time.Now()
+	data, err := i.Storage.GetRange(key, offset, length)
+	i.observe("get_range", start, err)
+	return data, err
+}
+
+func (i *instrumented) Size(key string) (int64, error) {
+	start := time.Now()
+	size, err := i.Storage.Size(key)
+	i.observe("size", start, err)
+	return size, err
+}
+
+// Nb. we always implement the optional interfaces, reporting errNotSupported if the driver doesn't.
+//
+func (i *instrumented) Create(key string) (ObjectWriter, error) {
+	streaming, ok := i.Storage.(StreamingStorage)
+	if !ok {
+		return nil, errNotSupported
+	}
+
+	start := time.Now()
+	w, err := streaming.Create(key)
+	i.observe("create", start, err)
+	return w, err
+}
+
+func (i *instrumented) ReplaceTail(key string, offset int64, data []byte) error {
+	appending, ok := i.Storage.(AppendingStorage)
+	if !ok {
+		return errNotSupported
+	}
+
+	start := time.Now()
+	err := appending.ReplaceTail(key, offset, data)
+	i.observe("replace_tail", start, err)
+	return err
+}
+
+func (i *instrumented) Open(key string) (ObjectReader, error) {
+	opening, ok := i.Storage.(OpeningStorage)
+	if !ok {
+		return nil, errNotSupported
+	}
+
+	start := time.Now()
+	r, err := opening.Open(key)
+	i.observe("open", start, err)
+	return r, err
+}
+
+func (i *instrumented) Copy(src, dst string) error {
+	copying, ok := i.Storage.(CopyingStorage)
+	if !ok {
+		return errNotSupported
+	}
+
+	start := time.Now()
+	err := copying.Copy(src, dst)
+	i.observe("copy", start, err)
+	return err
+}
+
+func (i *instrumented) Rename(src, dst string) error {
+	renaming, ok := i.Storage.(RenamingStorage)
+	if !ok {
+		return errNotSupported
+	}
+
+	start := time.Now()
+	err := renaming.Rename(src, dst)
+	i.observe("rename", start, err)
+	return err
+}
+
+func (i *instrumented) List(prefix string) ([]string, error) {
+	listing, ok := i.Storage.(ListingStorage)
+	if !ok {
+		return nil, errNotSupported
+	}
+
+	start := time.Now()
+	keys, err := listing.List(prefix)
+	i.observe("list", start, err)
+	return keys, err
+}
+
+func (i *instrumented) Begin() (Transaction, error) {
+	transactional, ok := i.Storage.(TransactionalStorage)
+	if !ok {
+		return nil, errNotSupported
+	}
+
+	start := time.Now()
+	txn, err := transactional.Begin()
+	i.observe("begin", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTxn{Transaction: txn, i: i}, nil
+}
+
+// A transaction, recording metrics on commit
+//
+type instrumentedTxn struct {
+	Transaction
+	i *instrumented
+}
+
+func (t *instrumentedTxn) Commit() error {
+	start := time.Now()
+	err := t.Transaction.Commit()
+	t.i.observe("commit", start, err)
+	return err
+}
+
+func (i *instrumented) Delete(key string) error {
+	start := time.Now()
+	err := i.Storage.Delete(key)
+	i.observe("delete", start, err)
+	return err
+}
@@ -0,0 +1,373 @@
+/*
+Package metrics is a minimal implementation of counters, gauges & histograms, written out in the
+Prometheus text exposition format.
+
+Silo needs only a handful of metrics, so this avoids pulling in a full client library.
+
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default buckets for latency histograms, in seconds
+//
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// The registry everything is registered with unless otherwise stated
+//
+var Default = NewRegistry()
+
+// Something that can write itself out in text exposition format
+//
+type collector interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// A set of metrics that are exposed together
+//
+type Registry struct {
+	lock sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: []collector{}}
+}
+
+// Add a metric to the registry. Registering two metrics with the same name is a programming error, so panics.
+//
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic(fmt.Sprintf("metric %s registered twice", c.name()))
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// Write out all metrics in text exposition format
+//
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.lock.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+	for _, c := range collectors {
+		err := c.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return a handler that serves the registry's metrics
+//
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		r.Write(w)
+	})
+}
+
+// Common parts of every metric
+//
+type desc struct {
+	metric string
+	help string
+	kind string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.metric
+}
+
+func (d *desc) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metric, escapeHelp(d.help), d.metric, d.kind)
+	return err
+}
+
+// Build the {a="b",c="d"} part of a line, with optional extra label appended (eg, le for histograms)
+//
+func (d *desc) labelString(values []string, extra ...string) string {
+	pairs := []string{}
+	for i, l := range d.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabel(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Check we've been given the right number of label values & turn them into a map key
+//
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.metric, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// A counter, partitioned by label values
+//
+type CounterVec struct {
+	desc
+	lock sync.Mutex
+	values map[string]float64
+	labelValues map[string][]string
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc: desc{metric: name, help: help, kind: "counter", labels: labels},
+		values: map[string]float64{},
+		labelValues: map[string][]string{},
+	}
+	r.register(c)
+	return c
+}
+
+// Add to the counter with the given label values. Counters only go up, so v should not be negative.
+//
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	k := c.key(labelValues)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[k] += v
+	c.labelValues[k] = labelValues
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.header(w)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range sortedKeys(c.labelValues) {
+		_, err = fmt.Fprintf(w, "%s%s %s\n", c.metric, c.labelString(c.labelValues[k]), formatFloat(c.values[k]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A gauge whose value is read when metrics are written out
+//
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{metric: name, help: help, kind: "gauge"},
+		fn: fn,
+	}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	err := g.header(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s %s\n", g.metric, formatFloat(g.fn()))
+	return err
+}
+
+// A gauge, partitioned by label values
+//
+type GaugeVec struct {
+	desc
+	lock sync.Mutex
+	values map[string]float64
+	labelValues map[string][]string
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		desc: desc{metric: name, help: help, kind: "gauge", labels: labels},
+		values: map[string]float64{},
+		labelValues: map[string][]string{},
+	}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[k] = v
+	g.labelValues[k] = labelValues
+}
+
+func (g *GaugeVec) write(w io.Writer) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	err := g.header(w)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range sortedKeys(g.labelValues) {
+		_, err = fmt.Fprintf(w, "%s%s %s\n", g.metric, g.labelString(g.labelValues[k]), formatFloat(g.values[k]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A histogram, partitioned by label values
+//
+type HistogramVec struct {
+	desc
+	buckets []float64
+
+	lock sync.Mutex
+	values map[string]*histogram
+	labelValues map[string][]string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count uint64
+	sum float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	h := &HistogramVec{
+		desc: desc{metric: name, help: help, kind: "histogram", labels: labels},
+		buckets: sorted,
+		values: map[string]*histogram{},
+		labelValues: map[string][]string{},
+	}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	hist, ok := h.values[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+		h.labelValues[k] = labelValues
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	err := h.header(w)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range sortedKeys(h.labelValues) {
+		hist := h.values[k]
+		values := h.labelValues[k]
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", h.metric, h.labelString(values, "le", formatFloat(upper)), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = fmt.Fprintf(
+			w,
+			"%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.metric, h.labelString(values, "le", "+Inf"), hist.count,
+			h.metric, h.labelString(values), formatFloat(hist.sum),
+			h.metric, h.labelString(values), hist.count,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	} else if math.IsInf(v, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
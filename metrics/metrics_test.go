@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "A counter.\nTwo lines.", "method")
+	c.Inc("GET")
+	c.Add(2, `a "quoted" \ value`)
+	g := r.NewGaugeVec("test_gauge", "A gauge.", "name")
+	g.Set(1.5, "x")
+	g.Set(2.5, "x")
+	r.NewGaugeFunc("test_func", "A gauge func.", func() float64 { return 7 })
+	h := r.NewHistogramVec("test_seconds", "A histogram.", []float64{1, 0.1}, "method")
+	h.Observe(0.05, "GET")
+	h.Observe(0.5, "GET")
+	h.Observe(5, "GET")
+
+	buf := &bytes.Buffer{}
+	err := r.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# HELP test_func A gauge func.
+# TYPE test_func gauge
+test_func 7
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge{name="x"} 2.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="GET",le="0.1"} 1
+test_seconds_bucket{method="GET",le="1"} 2
+test_seconds_bucket{method="GET",le="+Inf"} 3
+test_seconds_sum{method="GET"} 5.55
+test_seconds_count{method="GET"} 3
+# HELP test_total A counter.\nTwo lines.
+# TYPE test_total counter
+test_total{method="GET"} 1
+test_total{method="a \"quoted\" \\ value"} 2
+`
+	if buf.String() != expect {
+		t.Fatalf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	cases := []struct{
+		Name string
+		Fn func(r *Registry)
+	}{
+		{"registered twice", func(r *Registry) { r.NewCounterVec("x", ""); r.NewGaugeVec("x", "") }},
+		{"too few labels", func(r *Registry) { r.NewCounterVec("x", "", "a", "b").Inc("a") }},
+		{"too many labels", func(r *Registry) { r.NewHistogramVec("x", "", DefaultBuckets).Observe(1, "a") }},
+	}
+	for _, c := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", c.Name)
+				}
+			}()
+			c.Fn(NewRegistry())
+		}()
+	}
+}
@@ -0,0 +1,573 @@
+package silo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// where the ids of uploads in progress are persisted in our own storage, each upload's state & where their
+	// parts are staged
+	uploadsKey = systemKeyPrefix + "uploads"
+	uploadStatePrefix = systemKeyPrefix + "upload-state/"
+	uploadPartPrefix = systemKeyPrefix + "upload/"
+
+	// parts are numbered 1 to this
+	MaxUploadParts = 10000
+
+	// how often we look for abandoned uploads
+	uploadReapInterval = time.Minute
+)
+
+// A multipart upload in progress. Parts can be uploaded in any order (& replaced), then are joined in order of
+// part number on completion.
+//
+type Upload struct {
+	Id string
+	Key string
+	Role string
+	Started time.Time
+	Parts map[int]*UploadPart
+
+	// set while the upload is being completed or removed, so parts can't change underneath us
+	completing bool
+	// parts being written, by number; a part is written once it's stored & the upload saved
+	writing map[int]bool
+	// held while the upload is saved, so saves are written in order
+	save *sync.Mutex
+}
+
+// A single part of a multipart upload.
+//  ETag is the sha256 of the part's data.
+//
+type UploadPart struct {
+	Number int
+	Size int64
+	ETag string
+}
+
+// Start a multipart upload of the given key, returning the upload id.
+//  Permissions are checked again on completion, when we know if the key exists.
+//
+func (s *Silo) CreateUpload(user *Role, key string) (string, error) {
+	if !user.CanPut {
+		return "", s.Denied(user, "upload", key, fmt.Errorf("%w: user %s is not permitted to write", ErrForbidden, user.Id))
+	}
+	err := s.checkKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	s.uploadLock.Lock()
+	max := s.config().Misc.MaxUploads
+	if max > 0 {
+		count := 0
+		for _, u := range s.uploads {
+			if u.Role == user.Id {
+				count++
+			}
+		}
+		if count >= max {
+			s.uploadLock.Unlock()
+			return "", fmt.Errorf("%w: role %s may have at most %d uploads in progress", ErrForbidden, user.Id, max)
+		}
+	}
+	u := &Upload{Id: id, Key: key, Role: user.Id, Started: time.Now().UTC(), Parts: map[int]*UploadPart{}, save: &sync.Mutex{}}
+	s.uploads[id] = u
+	s.uploadLock.Unlock()
+
+	err = s.saveUpload(u)
+	if err == nil {
+		err = s.saveUploadIds()
+	}
+	if err != nil {
+		s.uploadLock.Lock()
+		delete(s.uploads, id)
+		s.uploadLock.Unlock()
+		s.store.Delete(uploadStateKey(id))
+		return "", err
+	}
+	return id, nil
+}
+
+// Upload (or replace) a part of a multipart upload. Each part is limited to MaxDataBytes.
+//
+func (s *Silo) UploadPart(user *Role, key, id string, number int, data []byte) (*UploadPart, error) {
+	if number < 1 || number > MaxUploadParts {
+		return nil, fmt.Errorf("%w: part number must be between 1 and %d", ErrBadRequest, MaxUploadParts)
+	}
+	conf := s.config()
+	if len(data) > conf.Misc.MaxDataBytes {
+		return nil, fmt.Errorf("%w: maxdatabytes is currently %d", ErrTooLarge, conf.Misc.MaxDataBytes)
+	}
+	// checked again, as the role may have lost the permission since the upload was started
+	if !user.CanPut {
+		return nil, s.Denied(user, "upload", key, fmt.Errorf("%w: user %s is not permitted to write", ErrForbidden, user.Id))
+	}
+
+	sum := sha256.Sum256(data)
+	part := &UploadPart{Number: number, Size: int64(len(data)), ETag: hex.EncodeToString(sum[:])}
+	partKey := uploadPartKey(id, number)
+
+	// the part is claimed before it's written, so the upload can't be completed or removed underneath us, & it's
+	// charged to the quota while staged
+	s.uploadLock.Lock()
+	u, ok := s.uploads[id]
+	if !ok || u.Role != user.Id || u.Key != key || u.completing {
+		s.uploadLock.Unlock()
+		return nil, fmt.Errorf("%w: upload %s", ErrNotFound, id)
+	}
+	if u.writing[number] {
+		s.uploadLock.Unlock()
+		return nil, fmt.Errorf("%w: part %d of upload %s is already being written", ErrBadRequest, number, id)
+	}
+
+	// check the upload as a whole stays in bounds, so parts can't be staged without limit
+	total := part.Size
+	for n, p := range u.Parts {
+		if n != number {
+			total += p.Size
+		}
+	}
+	if conf.Misc.MaxUploadBytes > 0 && total > conf.Misc.MaxUploadBytes {
+		s.uploadLock.Unlock()
+		return nil, fmt.Errorf("%w: maxuploadbytes is currently %d", ErrTooLarge, conf.Misc.MaxUploadBytes)
+	}
+
+	undo, err := s.usage.stage(user, partKey, key, part.Size, conf.Quota)
+	if err != nil {
+		s.uploadLock.Unlock()
+		return nil, err
+	}
+	if u.writing == nil {
+		u.writing = map[int]bool{}
+	}
+	u.writing[number] = true
+	s.uploadLock.Unlock()
+
+	cyphertext, err := s.encryptObject(data)
+	if err == nil {
+		err = s.store.Put(partKey, cyphertext)
+	}
+	if err != nil {
+		s.uploadLock.Lock()
+		defer s.uploadLock.Unlock()
+		delete(u.writing, number)
+		s.partWritten.Broadcast()
+		undo()
+		return nil, err
+	}
+
+	s.uploadLock.Lock()
+	u.Parts[number] = part
+	s.uploadLock.Unlock()
+
+	// the part is stored either way, so it's kept; if saving failed it may be forgotten on restart
+	err = s.saveUpload(u)
+
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	delete(u.writing, number)
+	s.partWritten.Broadcast()
+	if err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+// List the parts uploaded so far, in order of part number.
+//
+func (s *Silo) ListParts(user *Role, key, id string) ([]*UploadPart, error) {
+	u, err := s.upload(user, key, id)
+	if err != nil {
+		return nil, err
+	}
+	return u.sortedParts(), nil
+}
+
+// Join the uploaded parts, in order of part number, into the object. This replaces the object if it exists, which
+// as with Store requires the remove permission.
+//
+func (s *Silo) CompleteUpload(user *Role, key, id string) error {
+	return s.completeUpload(user, key, id, false)
+}
+
+// Join the uploaded parts into the object as CompleteUpload does, but only if the key doesn't already exist, as with
+// Create. If it does the upload is left as it was.
+//
+func (s *Silo) CompleteCreate(user *Role, key, id string) error {
+	return s.completeUpload(user, key, id, true)
+}
+
+func (s *Silo) completeUpload(user *Role, key, id string, create bool) (err error) {
+	var size int64
+	var checksum string
+	defer func() {
+		err = s.recordAudit(user, &AuditRecord{Action: AuditStore, Key: key, Size: size, Checksum: checksum}, err)
+	}()
+
+	if !user.CanPut {
+		return fmt.Errorf("%w: user %s is not permitted to write", ErrForbidden, user.Id)
+	}
+
+	parts, err := s.startCompleting(user, key, id)
+	if err != nil {
+		return err
+	}
+	partKeys := []string{}
+	for _, p := range parts {
+		partKeys = append(partKeys, uploadPartKey(id, p.Number))
+	}
+	defer func() {
+		s.uploadLock.Lock()
+		defer s.uploadLock.Unlock()
+
+		u, ok := s.uploads[id]
+		if ok {
+			u.completing = false
+		}
+	}()
+
+	unlock := s.lockKeys(key)
+	defer unlock()
+
+	err = s.checkReplace(user, key, create)
+	if err != nil {
+		return err
+	}
+
+	conf := s.config()
+	total := int64(0)
+	for _, p := range parts {
+		total += p.Size
+	}
+	if conf.Misc.MaxUploadBytes > 0 && total > conf.Misc.MaxUploadBytes {
+		return fmt.Errorf("%w: maxuploadbytes is currently %d", ErrTooLarge, conf.Misc.MaxUploadBytes)
+	}
+
+	// the staged parts stop counting once the object does, so they aren't counted twice
+	restage := s.usage.unstage(partKeys)
+	undo, err := s.usage.record(user, key, total, conf.Quota)
+	if err != nil {
+		restage()
+		return err
+	}
+
+	checksum, err = s.assemble(key, parts, id)
+	if err != nil {
+		undo()
+		restage()
+		return err
+	}
+	size = total
+
+	err = s.removeUpload(id)
+	if err != nil {
+		// the object is written, so this isn't the caller's problem; the reaper will have another go
+		slog.Warn("unable to remove completed upload", "upload", id, "error", err)
+	}
+	return nil
+}
+
+// Abandon an upload, removing any parts uploaded.
+//
+func (s *Silo) AbortUpload(user *Role, key, id string) error {
+	s.uploadLock.Lock()
+	u, ok := s.uploads[id]
+	if !ok || u.Role != user.Id || u.Key != key || u.completing {
+		s.uploadLock.Unlock()
+		return fmt.Errorf("%w: upload %s", ErrNotFound, id)
+	}
+	u.completing = true
+	s.uploadLock.Unlock()
+
+	return s.removeUpload(id)
+}
+
+// Return a copy of the given upload, if it exists & belongs to the user.
+//  Uploads belonging to someone else are reported as not found, so ids can't be probed.
+//
+func (s *Silo) upload(user *Role, key, id string) (*Upload, error) {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok || u.Role != user.Id || u.Key != key || u.completing {
+		return nil, fmt.Errorf("%w: upload %s", ErrNotFound, id)
+	}
+
+	c := *u
+	c.Parts = map[int]*UploadPart{}
+	for n, p := range u.Parts {
+		c.Parts[n] = p
+	}
+	return &c, nil
+}
+
+// Mark the upload as being completed, returning its parts in order.
+//
+func (s *Silo) startCompleting(user *Role, key, id string) ([]*UploadPart, error) {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok || u.Role != user.Id || u.Key != key || u.completing {
+		return nil, fmt.Errorf("%w: upload %s", ErrNotFound, id)
+	}
+
+	u.completing = true
+	s.waitForParts(u)
+	if len(u.Parts) == 0 {
+		u.completing = false
+		return nil, fmt.Errorf("%w: upload %s has no parts", ErrBadRequest, id)
+	}
+	return u.sortedParts(), nil
+}
+
+// Wait for any parts being written to the upload to finish.
+//  Nb. the caller is expected to hold the upload lock, & to have set completing so no more are started.
+//
+func (s *Silo) waitForParts(u *Upload) {
+	for len(u.writing) > 0 {
+		s.partWritten.Wait()
+	}
+}
+
+func (u *Upload) sortedParts() []*UploadPart {
+	parts := []*UploadPart{}
+	for _, p := range u.Parts {
+		parts = append(parts, p)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts
+}
+
+// Write the parts out as a single object, returning the checksum of the whole.
+//  If the storage driver supports it the object is streamed, a chunk at a time, otherwise it's assembled in memory.
+//
+func (s *Silo) assemble(key string, parts []*UploadPart, id string) (string, error) {
+	c, err := newObjectCipher(s.key, defaultChunkSize)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+
+	var writer ObjectWriter
+	streaming, ok := s.store.(StreamingStorage)
+	if ok {
+		writer, err = streaming.Create(key)
+	} else {
+		err = errNotSupported
+	}
+
+	if err == errNotSupported {
+		data := []byte{}
+		for _, p := range parts {
+			err = s.readChunks(uploadPartKey(id, p.Number), func(plaintext []byte) error {
+				data = append(data, plaintext...)
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+
+		hash.Write(data)
+		cyphertext, err := c.encrypt(data)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), s.store.Put(key, cyphertext)
+	} else if err != nil {
+		return "", err
+	}
+
+	cw := c.newWriter(writer)
+	for _, p := range parts {
+		err = s.readChunks(uploadPartKey(id, p.Number), func(plaintext []byte) error {
+			hash.Write(plaintext)
+			_, err := cw.Write(plaintext)
+			return err
+		})
+		if err != nil {
+			writer.Abort()
+			return "", err
+		}
+	}
+
+	err = cw.Close()
+	if err != nil {
+		writer.Abort()
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), writer.Commit()
+}
+
+// Remove an upload & any staged parts.
+//  Nb. the caller is expected to have set completing, so no more parts are started.
+//
+func (s *Silo) removeUpload(id string) error {
+	s.uploadLock.Lock()
+	u, ok := s.uploads[id]
+	if !ok {
+		s.uploadLock.Unlock()
+		return nil
+	}
+	s.waitForParts(u)
+	delete(s.uploads, id)
+	s.uploadLock.Unlock()
+
+	err := s.saveUploadIds()
+	if err != nil {
+		return err
+	}
+
+	partKeys := []string{}
+	for n := range u.Parts {
+		partKeys = append(partKeys, uploadPartKey(id, n))
+	}
+	s.usage.unstage(partKeys)
+
+	for _, key := range append([]string{uploadStateKey(id)}, partKeys...) {
+		err = s.store.Delete(key)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove uploads that were started longer than UploadExpiry ago.
+//
+func (s *Silo) reapUploads() {
+	expiry := s.config().Misc.UploadExpiry
+	if expiry <= 0 {
+		return
+	}
+
+	s.uploadLock.Lock()
+	expired := []string{}
+	for id, u := range s.uploads {
+		if !u.completing && time.Since(u.Started) > expiry {
+			u.completing = true
+			expired = append(expired, id)
+		}
+	}
+	s.uploadLock.Unlock()
+
+	for _, id := range expired {
+		err := s.removeUpload(id)
+		if err != nil {
+			slog.Warn("unable to remove abandoned upload", "upload", id, "error", err)
+			continue
+		}
+		slog.Info("removed abandoned upload", "upload", id)
+	}
+}
+
+func uploadPartKey(id string, number int) string {
+	return fmt.Sprintf("%s%s/%d", uploadPartPrefix, id, number)
+}
+
+func uploadStateKey(id string) string {
+	return uploadStatePrefix + id
+}
+
+// Read in any uploads in progress.
+//
+func (s *Silo) loadUploads() error {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	ids := []string{}
+	_, err := s.readSystem(uploadsKey, &ids)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		u := &Upload{}
+		found, err := s.readSystem(uploadStateKey(id), u)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// removed, but not yet from the ids
+			continue
+		}
+		if u.Parts == nil {
+			u.Parts = map[int]*UploadPart{}
+		}
+		u.save = &sync.Mutex{}
+		s.uploads[id] = u
+	}
+	return nil
+}
+
+// Return the parts of every upload in progress, as charged to the usage ledger.
+//
+func (s *Silo) stagedParts() map[string]*stagedEntry {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	staged := map[string]*stagedEntry{}
+	for id, u := range s.uploads {
+		for n, p := range u.Parts {
+			staged[uploadPartKey(id, n)] = &stagedEntry{ledgerEntry: ledgerEntry{Role: u.Role, Bytes: p.Size}, Key: u.Key}
+		}
+	}
+	return staged
+}
+
+// Persist the state of a single upload. Saves of the same upload are written one at a time, each with the state
+// as of when it was written, so an older state is never written over a newer one.
+//  Nb. the caller mustn't hold the upload lock.
+//
+func (s *Silo) saveUpload(u *Upload) error {
+	u.save.Lock()
+	defer u.save.Unlock()
+
+	s.uploadLock.Lock()
+	data, err := json.Marshal(u)
+	s.uploadLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.writeSystem(uploadStateKey(u.Id), data)
+}
+
+// Persist the ids of the uploads in progress, which only change as uploads are started & removed.
+//  Nb. the caller mustn't hold the upload lock.
+//
+func (s *Silo) saveUploadIds() error {
+	s.uploadIdsLock.Lock()
+	defer s.uploadIdsLock.Unlock()
+
+	s.uploadLock.Lock()
+	ids := []string{}
+	for id := range s.uploads {
+		ids = append(ids, id)
+	}
+	s.uploadLock.Unlock()
+	sort.Strings(ids)
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return s.writeSystem(uploadsKey, data)
+}
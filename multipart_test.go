@@ -0,0 +1,350 @@
+package silo
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	writer := testRole("writer", false, true, false)
+	s := openTestSilo(t, testConfig(t, rw, writer))
+
+	id, err := s.CreateUpload(rw, "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// out of order, & one replaced
+	for _, p := range []struct{ n int; data string }{{2, "world"}, {1, "hello "}, {2, "there"}} {
+		_, err = s.UploadPart(rw, "/big", id, p.n, []byte(p.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct{
+		Name string
+		Err error
+		Fn func() error
+	}{
+		{"part numbers start at 1", ErrBadRequest, func() error { _, err := s.UploadPart(rw, "/big", id, 0, nil); return err }},
+		{"others can't see the upload", ErrNotFound, func() error { _, err := s.ListParts(writer, "/big", id); return err }},
+		{"nor for another key", ErrNotFound, func() error { _, err := s.ListParts(rw, "/other", id); return err }},
+	}
+	for _, c := range cases {
+		err := c.Fn()
+		if !errors.Is(err, c.Err) {
+			t.Errorf("%s: expected %v, got %v", c.Name, c.Err, err)
+		}
+	}
+
+	err = s.CompleteUpload(rw, "/big", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Get(rw, "/big")
+	if err != nil || string(data) != "hello there" {
+		t.Fatalf("expected the parts joined in order, got %q %v", data, err)
+	}
+	_, err = s.ListParts(rw, "/big", id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the upload to be gone once complete, got %v", err)
+	}
+}
+
+func TestUploadPartChecksPermission(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, rw))
+
+	id, err := s.CreateUpload(rw, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same role, having since lost the right to write
+	readonly := testRole("rw", true, false, false)
+	_, err = s.UploadPart(readonly, "/a", id, 1, []byte("data"))
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected a role that can't write to be refused, got %v", err)
+	}
+	parts, err := s.ListParts(rw, "/a", id)
+	if err != nil || len(parts) != 0 {
+		t.Fatalf("expected no part to be written, got %v %v", parts, err)
+	}
+}
+
+func TestUploadsSurviveRestart(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	c := testConfig(t, rw)
+	s := openTestSilo(t, c)
+
+	kept, err := s.CreateUpload(rw, "/kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted, err := s.CreateUpload(rw, "/aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UploadPart(rw, "/kept", kept, 1, []byte("hello "))
+	if err == nil {
+		_, err = s.UploadPart(rw, "/aborted", aborted, 1, []byte("gone"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AbortUpload(rw, "/aborted", aborted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTestSilo(t, c)
+	parts, err := s.ListParts(rw, "/kept", kept)
+	if err != nil || len(parts) != 1 || parts[0].Size != 6 {
+		t.Fatalf("expected the part to be remembered, got %v %v", parts, err)
+	}
+	_, err = s.ListParts(rw, "/aborted", aborted)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the aborted upload to stay gone, got %v", err)
+	}
+	_, err = s.store.Get(uploadStateKey(aborted))
+	if err == nil {
+		t.Fatalf("expected the aborted upload's state to be removed")
+	}
+
+	_, err = s.UploadPart(rw, "/kept", kept, 2, []byte("again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CompleteUpload(rw, "/kept", kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Get(rw, "/kept")
+	if err != nil || string(data) != "hello again" {
+		t.Fatalf("expected the parts from before & after the restart, got %q %v", data, err)
+	}
+}
+
+func TestCompleteCreate(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, rw))
+
+	id, err := s.CreateUpload(rw, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UploadPart(rw, "/a", id, 1, []byte("upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// created while the upload was in progress
+	err = s.Store(rw, "/a", []byte("stored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CompleteCreate(rw, "/a", id)
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("expected the upload not to replace the key, got %v", err)
+	}
+	data, err := s.Get(rw, "/a")
+	if err != nil || string(data) != "stored" {
+		t.Fatalf("expected the key to be unchanged, got %q %v", data, err)
+	}
+
+	// the upload is left as it was, so it can still be completed some other way
+	err = s.Remove(rw, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CompleteCreate(rw, "/a", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = s.Get(rw, "/a")
+	if err != nil || string(data) != "upload" {
+		t.Fatalf("expected the upload, got %q %v", data, err)
+	}
+}
+
+func TestUploadStagedAgainstQuota(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	r.MaxBytes = 10
+	c := testConfig(t, r)
+	c.Quota["logs"] = &Quota{Prefix: "/logs/", MaxBytes: 8}
+	s := openTestSilo(t, c)
+
+	id, err := s.CreateUpload(r, "/logs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UploadPart(r, "/logs/a", id, 1, []byte("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UploadPart(r, "/logs/a", id, 2, []byte("12345"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected staged parts to count against the prefix, got %v", err)
+	}
+	err = s.Store(r, "/other", []byte("123456"))
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected staged parts to count against the role, got %v", err)
+	}
+
+	report := s.Usage(r)
+	if report.Usage.Bytes != 5 || report.Usage.Objects != 0 || report.Prefixes["/logs/"].Bytes != 5 {
+		t.Fatalf("expected 5 staged bytes & no objects, got %+v %+v", report.Usage, report.Prefixes["/logs/"])
+	}
+
+	// counted once a restart has reloaded the upload, too
+	s.Close()
+	s = openTestSilo(t, c)
+	report = s.Usage(r)
+	if report.Usage.Bytes != 5 || report.Usage.Objects != 0 {
+		t.Fatalf("expected staged parts to be counted after a restart, got %+v", report.Usage)
+	}
+
+	// the object replaces the parts, rather than being counted alongside them
+	_, err = s.UploadPart(r, "/logs/a", id, 2, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CompleteUpload(r, "/logs/a", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = s.Usage(r)
+	if report.Usage.Bytes != 8 || report.Usage.Objects != 1 || report.Prefixes["/logs/"].Bytes != 8 {
+		t.Fatalf("expected one object of 8 bytes, got %+v %+v", report.Usage, report.Prefixes["/logs/"])
+	}
+
+	// & aborting frees what was staged
+	id, err = s.CreateUpload(r, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UploadPart(r, "/b", id, 1, []byte("12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AbortUpload(r, "/b", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Usage(r).Usage; u.Bytes != 8 {
+		t.Fatalf("expected aborting to free the staged part, got %+v", u)
+	}
+}
+
+func TestMaxUploads(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	other := testRole("other", true, true, true)
+	c := testConfig(t, r, other)
+	c.Misc.MaxUploads = 2
+	s := openTestSilo(t, c)
+
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := s.CreateUpload(r, "/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	_, err := s.CreateUpload(r, "/a")
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected a third upload to be refused, got %v", err)
+	}
+	_, err = s.CreateUpload(other, "/a")
+	if err != nil {
+		t.Fatalf("expected the limit to be per role, got %v", err)
+	}
+
+	err = s.AbortUpload(r, "/a", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateUpload(r, "/a")
+	if err != nil {
+		t.Fatalf("expected aborting to make room, got %v", err)
+	}
+}
+
+// Storage that blocks part writes until released, so we can complete an upload while a part is being written
+//
+type blockingPuts struct {
+	Storage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingPuts) Put(key string, data []byte) error {
+	if strings.HasPrefix(key, uploadPartPrefix) {
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return b.Storage.Put(key, data)
+}
+
+func TestCompleteWaitsForParts(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, r))
+
+	id, err := s.CreateUpload(r, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UploadPart(r, "/a", id, 1, []byte("one "))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocking := &blockingPuts{Storage: s.store, started: make(chan struct{}), release: make(chan struct{})}
+	s.store = blocking
+
+	var wg sync.WaitGroup
+	var partErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, partErr = s.UploadPart(r, "/a", id, 2, []byte("two"))
+	}()
+	<-blocking.started
+
+	completed := make(chan error, 1)
+	go func() {
+		completed <- s.CompleteUpload(r, "/a", id)
+	}()
+
+	// a second write of the same part is refused rather than interleaved
+	_, err = s.UploadPart(r, "/a", id, 2, []byte("three"))
+	if err == nil {
+		t.Fatalf("expected a part already being written to be refused")
+	}
+
+	select {
+	case err = <-completed:
+		t.Fatalf("expected completion to wait for the part being written, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(blocking.release)
+	wg.Wait()
+	if partErr != nil {
+		t.Fatal(partErr)
+	}
+	err = <-completed
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Get(r, "/a")
+	if err != nil || string(data) != "one two" {
+		t.Fatalf("expected the part written during completion to be included, got %q %v", data, err)
+	}
+}
@@ -0,0 +1,414 @@
+package silo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// where the usage ledger is persisted in our own storage
+	usageKey = systemKeyPrefix + "usage"
+
+	// how often the usage ledger is saved, if it's changed
+	usageSaveInterval = 30 * time.Second
+)
+
+// A limit on the total that may be stored under some key prefix.
+//  Zero values are taken to mean 'unlimited'.
+//
+type Quota struct {
+	Prefix string
+	MaxBytes int64
+	MaxObjects int64
+}
+
+// Current usage of some role or prefix, along with the limits (if any) that apply.
+//
+type Usage struct {
+	Bytes int64
+	Objects int64
+	MaxBytes int64
+	MaxObjects int64
+}
+
+// Usage as visible to some role; their own usage plus that of each configured prefix
+//
+type UsageReport struct {
+	Role string
+	Usage *Usage
+	Prefixes map[string]*Usage
+}
+
+// What we know about a single stored object
+//
+type ledgerEntry struct {
+	Role string
+	Bytes int64
+}
+
+// A part staged for a multipart upload of Key. Its bytes count against the role & the prefixes covering Key, but
+// it isn't an object.
+//
+type stagedEntry struct {
+	ledgerEntry
+	Key string
+}
+
+// The ledger records who wrote each key & how large it is, so that we can keep running totals
+// of bytes & objects per role and per configured prefix.
+//  Writes only change the ledger in memory; it's saved periodically & on Close, rather than on every write. If
+//  we're killed, the last saved ledger is reconciled with what's actually stored on startup.
+//
+type ledger struct {
+	lock sync.Mutex
+
+	Objects map[string]*ledgerEntry
+
+	// parts of uploads in progress, by part key. These aren't saved, as they're rebuilt from the uploads.
+	staged map[string]*stagedEntry
+
+	// set when the ledger is saved on Close, so it's known to be exact when next loaded
+	Clean bool
+
+	roles map[string]*Usage
+	prefixes map[string]*Usage
+
+	// changed since it was last saved
+	dirty bool
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		Objects: map[string]*ledgerEntry{},
+		staged: map[string]*stagedEntry{},
+		roles: map[string]*Usage{},
+		prefixes: map[string]*Usage{},
+	}
+}
+
+// Rebuild running totals from the recorded objects
+//  Nb. the caller is expected to hold the lock, or be the only user of the ledger.
+//
+func (l *ledger) tally(quotas map[string]*Quota) {
+	l.roles = map[string]*Usage{}
+	l.prefixes = map[string]*Usage{}
+	for _, q := range quotas {
+		l.prefixes[q.Prefix] = &Usage{}
+	}
+
+	for key, e := range l.Objects {
+		l.add(key, e, 1)
+	}
+	for _, e := range l.staged {
+		l.count(e.Key, e.Role, e.Bytes, 0)
+	}
+}
+
+// Rebuild running totals, for example because the configured quotas have changed.
+//
+func (l *ledger) retally(quotas map[string]*Quota) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tally(quotas)
+}
+
+// Add (sign = 1) or subtract (sign = -1) the given entry from our running totals.
+//  Nb. the caller is expected to hold the lock.
+//
+func (l *ledger) add(key string, e *ledgerEntry, sign int64) {
+	l.count(key, e.Role, sign * e.Bytes, sign)
+}
+
+// Add bytes & objects (either may be negative) to the totals of the role & each prefix covering key.
+//  Nb. the caller is expected to hold the lock.
+//
+func (l *ledger) count(key, role string, bytes, objects int64) {
+	r, ok := l.roles[role]
+	if !ok {
+		r = &Usage{}
+		l.roles[role] = r
+	}
+	r.Bytes += bytes
+	r.Objects += objects
+
+	for prefix, p := range l.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			p.Bytes += bytes
+			p.Objects += objects
+		}
+	}
+}
+
+// Record that the given role is writing 'size' bytes to key, replacing whatever was there before.
+// If this would put the role or any prefix over quota, nothing is recorded and an error is returned.
+//  On success an undo func is returned, which reverses the record (ie, if the write fails).
+//
+func (l *ledger) record(user *Role, key string, size int64, quotas map[string]*Quota) (func(), error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	old, exists := l.Objects[key]
+	e := &ledgerEntry{Role: user.Id, Bytes: size}
+
+	if exists {
+		l.add(key, old, -1)
+	}
+	l.add(key, e, 1)
+
+	err := l.check(user, key, quotas)
+	if err != nil {
+		l.add(key, e, -1)
+		if exists {
+			l.add(key, old, 1)
+		}
+		return nil, err
+	}
+
+	l.Objects[key] = e
+	l.dirty = true
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		l.dirty = true
+		l.add(key, e, -1)
+		delete(l.Objects, key)
+		if exists {
+			l.add(key, old, 1)
+			l.Objects[key] = old
+		}
+	}, nil
+}
+
+// Remove the record of the given key, returning an undo func.
+//
+func (l *ledger) forget(key string) func() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	old, exists := l.Objects[key]
+	if !exists {
+		return func() {}
+	}
+
+	l.add(key, old, -1)
+	delete(l.Objects, key)
+	l.dirty = true
+
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		l.dirty = true
+		l.add(key, old, 1)
+		l.Objects[key] = old
+	}
+}
+
+// Record that the given role is staging 'size' bytes at partKey, for an upload of key, replacing any part staged
+// there before. As with record, nothing is recorded if this would put the role or any prefix over quota, and on
+// success an undo func is returned.
+//
+func (l *ledger) stage(user *Role, partKey, key string, size int64, quotas map[string]*Quota) (func(), error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	old, exists := l.staged[partKey]
+	e := &stagedEntry{ledgerEntry: ledgerEntry{Role: user.Id, Bytes: size}, Key: key}
+
+	if exists {
+		l.count(old.Key, old.Role, -old.Bytes, 0)
+	}
+	l.count(key, e.Role, e.Bytes, 0)
+
+	err := l.check(user, key, quotas)
+	if err != nil {
+		l.count(key, e.Role, -e.Bytes, 0)
+		if exists {
+			l.count(old.Key, old.Role, old.Bytes, 0)
+		}
+		return nil, err
+	}
+
+	l.staged[partKey] = e
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		l.count(key, e.Role, -e.Bytes, 0)
+		delete(l.staged, partKey)
+		if exists {
+			l.count(old.Key, old.Role, old.Bytes, 0)
+			l.staged[partKey] = old
+		}
+	}, nil
+}
+
+// Remove the given staged parts, returning an undo func.
+//
+func (l *ledger) unstage(partKeys []string) func() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	removed := map[string]*stagedEntry{}
+	for _, partKey := range partKeys {
+		e, ok := l.staged[partKey]
+		if ok {
+			l.count(e.Key, e.Role, -e.Bytes, 0)
+			delete(l.staged, partKey)
+			removed[partKey] = e
+		}
+	}
+
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		for partKey, e := range removed {
+			l.count(e.Key, e.Role, e.Bytes, 0)
+			l.staged[partKey] = e
+		}
+	}
+}
+
+// Replace the staged parts, & rebuild running totals to match; used once uploads in progress are loaded.
+//
+func (l *ledger) restage(staged map[string]*stagedEntry, quotas map[string]*Quota) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.staged = staged
+	l.tally(quotas)
+}
+
+// Check the current totals against the role's limits & any prefix quotas that cover the key.
+//  Nb. the caller is expected to hold the lock.
+//
+func (l *ledger) check(user *Role, key string, quotas map[string]*Quota) error {
+	r := l.roles[user.Id]
+	if user.MaxBytes > 0 && r.Bytes > user.MaxBytes {
+		return fmt.Errorf("%w: role %s is limited to %d bytes", ErrForbidden, user.Id, user.MaxBytes)
+	}
+	if user.MaxObjects > 0 && r.Objects > user.MaxObjects {
+		return fmt.Errorf("%w: role %s is limited to %d objects", ErrForbidden, user.Id, user.MaxObjects)
+	}
+
+	for _, q := range quotas {
+		if !strings.HasPrefix(key, q.Prefix) {
+			continue
+		}
+
+		p, ok := l.prefixes[q.Prefix]
+		if !ok {
+			continue // quotas have been reloaded since the caller read them
+		}
+		if q.MaxBytes > 0 && p.Bytes > q.MaxBytes {
+			return fmt.Errorf("%w: prefix %s is limited to %d bytes", ErrQuotaExceeded, q.Prefix, q.MaxBytes)
+		}
+		if q.MaxObjects > 0 && p.Objects > q.MaxObjects {
+			return fmt.Errorf("%w: prefix %s is limited to %d objects", ErrQuotaExceeded, q.Prefix, q.MaxObjects)
+		}
+	}
+
+	return nil
+}
+
+// Report usage as visible to the given role.
+//
+func (l *ledger) report(user *Role, quotas map[string]*Quota) *UsageReport {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	result := &UsageReport{
+		Role: user.Id,
+		Usage: &Usage{MaxBytes: user.MaxBytes, MaxObjects: user.MaxObjects},
+		Prefixes: map[string]*Usage{},
+	}
+
+	r, ok := l.roles[user.Id]
+	if ok {
+		result.Usage.Bytes = r.Bytes
+		result.Usage.Objects = r.Objects
+	}
+
+	for _, q := range quotas {
+		p := &Usage{MaxBytes: q.MaxBytes, MaxObjects: q.MaxObjects}
+		current, ok := l.prefixes[q.Prefix]
+		if ok {
+			p.Bytes = current.Bytes
+			p.Objects = current.Objects
+		}
+		result.Prefixes[q.Prefix] = p
+	}
+
+	return result
+}
+
+// Return the total objects & bytes recorded, across all roles.
+//
+func (l *ledger) totals() (int64, int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var objects, bytes int64
+	for _, r := range l.roles {
+		objects += r.Objects
+		bytes += r.Bytes
+	}
+	return objects, bytes
+}
+
+// Bring the ledger into line with the objects actually stored, given their sizes by key: objects it's missing
+// (written since it was last saved, or before there was a ledger) are added with no owner, & entries for objects
+// that no longer exist are dropped.
+//  Nb. the caller is expected to be the only user of the ledger.
+//
+func (l *ledger) reconcile(stored map[string]int64) {
+	for key := range l.Objects {
+		_, ok := stored[key]
+		if !ok {
+			delete(l.Objects, key)
+			l.dirty = true
+		}
+	}
+
+	for key, size := range stored {
+		e, ok := l.Objects[key]
+		if !ok {
+			l.Objects[key] = &ledgerEntry{Bytes: size}
+			l.dirty = true
+		} else if e.Bytes != size {
+			e.Bytes = size
+			l.dirty = true
+		}
+	}
+}
+
+// Marshal the ledger for saving, if it's changed since it was last saved (or clean is set, marking it as saved
+// on Close). Once marshalled the ledger is taken to be saved; call changed if saving it fails.
+//
+func (l *ledger) marshal(clean bool) ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.dirty && !clean {
+		return nil, nil
+	}
+	l.Clean = clean
+	data, err := json.Marshal(l)
+	if err == nil {
+		l.dirty = false
+	}
+	return data, err
+}
+
+// Mark the ledger as needing to be saved
+//
+func (l *ledger) changed() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.dirty = true
+}
@@ -0,0 +1,154 @@
+package silo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoleLimits(t *testing.T) {
+	r := testRole("limited", true, true, true)
+	r.MaxBytes = 10
+	r.MaxObjects = 2
+	s := openTestSilo(t, testConfig(t, r))
+
+	cases := []struct{
+		Key string
+		Data string
+		Err error
+	}{
+		{"/a", "12345", nil},
+		{"/b", "123456", ErrForbidden}, // 11 bytes
+		{"/b", "12345", nil},
+		{"/a", "1", nil}, // replacing frees what was there
+		{"/c", "1", ErrForbidden}, // 3 objects
+	}
+	for i, c := range cases {
+		err := s.Store(r, c.Key, []byte(c.Data))
+		if c.Err == nil && err != nil || c.Err != nil && !errors.Is(err, c.Err) {
+			t.Errorf("%d: expected %v, got %v", i, c.Err, err)
+		}
+	}
+
+	u := s.Usage(r).Usage
+	if u.Bytes != 6 || u.Objects != 2 {
+		t.Fatalf("expected 6 bytes in 2 objects, got %+v", u)
+	}
+
+	err := s.Remove(r, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u = s.Usage(r).Usage
+	if u.Bytes != 1 || u.Objects != 1 {
+		t.Fatalf("expected 1 byte in 1 object after remove, got %+v", u)
+	}
+}
+
+func TestPrefixQuota(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	c := testConfig(t, r)
+	c.Quota["logs"] = &Quota{Prefix: "/logs/", MaxBytes: 8}
+	s := openTestSilo(t, c)
+
+	err := s.Store(r, "/logs/a", []byte("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Store(r, "/logs/b", []byte("12345"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+	err = s.Store(r, "/other", []byte("12345"))
+	if err != nil {
+		t.Fatalf("other prefixes shouldn't be limited, got %v", err)
+	}
+
+	p := s.Usage(r).Prefixes["/logs/"]
+	if p.Bytes != 5 || p.Objects != 1 || p.MaxBytes != 8 {
+		t.Fatalf("unexpected prefix usage %+v", p)
+	}
+}
+
+func TestUsagePersisted(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	c := testConfig(t, r)
+
+	s, err := NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/a", "/b"} {
+		err = s.Store(r, key, []byte("1234"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestSilo(t, c)
+	u := s.Usage(r).Usage
+	if u.Bytes != 8 || u.Objects != 2 {
+		t.Fatalf("expected usage to survive a restart, got %+v", u)
+	}
+}
+
+func TestUsageReconciled(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	c := testConfig(t, r)
+	c.Quota["all"] = &Quota{Prefix: "/"}
+
+	// written without silo knowing, as if before there was a ledger
+	s := openTestSilo(t, c)
+	stored, err := s.encryptObject([]byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.store.Put("/old", stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// written, then killed before the ledger was saved
+	err = s.Store(r, "/new", []byte("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again := openTestSilo(t, c)
+	objects, bytes := again.Totals()
+	if objects != 2 || bytes != 8 {
+		t.Fatalf("expected 2 objects of 8 bytes, got %d of %d", objects, bytes)
+	}
+	p := again.Usage(r).Prefixes["/"]
+	if p.Objects != 2 || p.Bytes != 8 {
+		t.Fatalf("expected the prefix to count both objects, got %+v", p)
+	}
+}
+
+func TestLedgerSavedOnlyWhenChanged(t *testing.T) {
+	l := newLedger()
+	data, err := l.marshal(false)
+	if err != nil || data != nil {
+		t.Fatalf("expected nothing to save, got %q %v", data, err)
+	}
+
+	_, err = l.record(testRole("rw", true, true, true), "/a", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = l.marshal(false)
+	if err != nil || data == nil {
+		t.Fatalf("expected the change to be saved, got %q %v", data, err)
+	}
+	data, _ = l.marshal(false)
+	if data != nil {
+		t.Fatalf("expected nothing more to save")
+	}
+	data, _ = l.marshal(true)
+	if data == nil {
+		t.Fatalf("expected the ledger to be saved on close")
+	}
+}
@@ -1,7 +1,13 @@
 package silo
 
 import (
+	"fmt"
+	"strings"
+	"crypto/subtle"
+	"encoding/base64"
 	"github.com/gtank/cryptopasta"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // A silo user is someone (or something) that is allowed to read, write and/or delete
@@ -13,6 +19,22 @@ type Role struct {
 	CanGet bool
 	CanPut bool
 	CanRm bool
+
+	// permitted to append to keys (creating them if need be), without being able to overwrite them
+	CanAppend bool
+
+	// permitted to manage roles
+	CanAdmin bool
+
+	// disabled roles cannot authenticate
+	Disabled bool
+
+	// limits on the total this role may have stored at any one time (0 is unlimited)
+	MaxBytes int64
+	MaxObjects int64
+
+	// set on the well known roles created by NewConfig
+	isDefault bool
 }
 
 // build a user from a name / password.
@@ -29,8 +51,133 @@ func NewRole(name, password string) (*Role, error) {
 	}, nil
 }
 
+// build a user from a name / password, hashing with the given bcrypt cost.
+//
+func newRoleWithCost(name, password string, cost int) (*Role, error) {
+	hsh, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return nil, err
+	}
+	return &Role{
+		Id: name,
+		Password: hsh,
+	}, nil
+}
+
+// build a user from a name & an already computed password hash.
+//  Both bcrypt ($2a$, $2b$, $2y$) and argon2 ($argon2id$, $argon2i$) hashes in their usual
+//  encoded forms are accepted.
+//
+func NewRoleFromHash(name, hash string) (*Role, error) {
+	if strings.HasPrefix(hash, "$argon2") {
+		_, _, err := parseArgon2(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: role %s: %v", ErrBadRequest, name, err)
+		}
+	} else if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return nil, fmt.Errorf("%w: role %s: unsupported password hash: %v", ErrBadRequest, name, err)
+	}
+
+	return &Role{
+		Id: name,
+		Password: []byte(hash),
+	}, nil
+}
+
 // Check the user's recorded password hash against the given password.
 //
 func (u *Role) CheckPassword(given string) bool {
+	if strings.HasPrefix(string(u.Password), "$argon2") {
+		return checkArgon2(string(u.Password), given)
+	}
 	return cryptopasta.CheckPasswordHash(u.Password, []byte(given)) == nil
 }
+
+const (
+	// the most memory (in KiB) an argon2 hash may ask for; each login using it allocates this much
+	maxArgon2Memory = 256 * 1024
+
+	// the most passes an argon2 hash may ask for
+	maxArgon2Time = 64
+)
+
+// argon2 parameters, as encoded in a hash
+//
+type argon2Params struct {
+	variant string
+	memory uint32
+	time uint32
+	threads uint8
+	salt []byte
+}
+
+// Parse an encoded argon2 hash of the form
+//  $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+// where the salt & hash are unpadded base64.
+//  Parameters that argon2 can't use, or that would make checking a password too expensive, are rejected.
+//
+func parseArgon2(encoded string) (*argon2Params, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: expected 6 fields, got %d", len(parts))
+	}
+
+	p := &argon2Params{variant: parts[1]}
+	if p.variant != "argon2id" && p.variant != "argon2i" {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: unsupported variant %s", p.variant)
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: unsupported version %s", parts[2])
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: unable to parse parameters: %v", err)
+	}
+	if p.time < 1 || p.time > maxArgon2Time {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: t must be between 1 and %d", maxArgon2Time)
+	}
+	if p.threads < 1 {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: p must be at least 1")
+	}
+	if p.memory > maxArgon2Memory {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: m must be at most %d", maxArgon2Memory)
+	}
+
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: unable to decode salt: %v", err)
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid argon2 hash: unable to decode hash: %v", err)
+	}
+	if len(hash) == 0 {
+		// would match any password
+		return nil, nil, fmt.Errorf("invalid argon2 hash: hash is empty")
+	}
+
+	return p, hash, nil
+}
+
+// Check the given password against an encoded argon2 hash.
+//
+func checkArgon2(encoded, given string) bool {
+	p, expect, err := parseArgon2(encoded)
+	if err != nil {
+		return false
+	}
+
+	var actual []byte
+	if p.variant == "argon2id" {
+		actual = argon2.IDKey([]byte(given), p.salt, p.time, p.memory, p.threads, uint32(len(expect)))
+	} else {
+		actual = argon2.Key([]byte(given), p.salt, p.time, p.memory, p.threads, uint32(len(expect)))
+	}
+
+	return subtle.ConstantTimeCompare(actual, expect) == 1
+}
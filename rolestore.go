@@ -0,0 +1,326 @@
+package silo
+
+import (
+	"fmt"
+	"sort"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+const (
+	// where roles created at runtime are persisted in our own storage
+	rolesKey = systemKeyPrefix + "roles"
+
+	// name of the role created by Bootstrap
+	BootstrapRole = "admin"
+
+	// where we record that we've been bootstrapped, in our own storage
+	bootstrapKey = systemKeyPrefix + "bootstrapped"
+)
+
+// Recorded once we've been bootstrapped
+//
+type bootstrapRecord struct {
+	Role string
+	Time time.Time
+}
+
+// Look up a role by id. Roles held in our own storage take precedence over those in the config.
+//
+func (s *Silo) role(id string) (*Role, bool) {
+	s.roleLock.RLock()
+	defer s.roleLock.RUnlock()
+	return s.lookupRole(id)
+}
+
+// Look up a role by id.
+//  Nb. the caller is expected to hold the role lock.
+//
+func (s *Silo) lookupRole(id string) (*Role, bool) {
+	r, ok := s.roles[id]
+	if ok {
+		return r, true
+	}
+
+	r, ok = s.config().User[id]
+	return r, ok
+}
+
+// Read in any roles held in our own storage.
+//
+func (s *Silo) loadRoles() error {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+
+	_, err := s.readSystem(rolesKey, &s.roles)
+	if err != nil {
+		return err
+	}
+
+	bootstrapped, err := s.readSystem(bootstrapKey, &bootstrapRecord{})
+	s.bootstrapped.Store(bootstrapped)
+	return err
+}
+
+// Check a config is safe to use with us. Once we've been bootstrapped the default roles are removed from it
+// first, so a bootstrapped silo can be started without asking to bootstrap again.
+//
+func (s *Silo) checkConfig(config *Config) error {
+	if s.bootstrapped.Load() {
+		config.RemoveDefaultRoles()
+	}
+	return config.Validate()
+}
+
+// Write our stored roles back to storage.
+//  Nb. the caller is expected to hold the role lock.
+//
+func (s *Silo) saveRoles() error {
+	data, err := json.Marshal(s.roles)
+	if err != nil {
+		return err
+	}
+	return s.writeSystem(rolesKey, data)
+}
+
+// On first run, where there are no roles at all, create an admin role with a random password.
+// The password is returned so that it can be shown to the operator; it is only ever stored hashed
+// and so cannot be recovered later. We remember that we were bootstrapped, so from then on the default
+// roles are dropped from any config we're given & there's no need to ask to bootstrap again.
+//  If roles already exist this does nothing and returns an empty password.
+//
+func (s *Silo) Bootstrap() (string, string, error) {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+
+	if len(s.roles) > 0 || len(s.config().User) > 0 {
+		// eg. bootstrapped before we kept a record of it
+		if len(s.roles) > 0 && !s.bootstrapped.Load() {
+			return "", "", s.markBootstrapped("")
+		}
+		return "", "", nil
+	}
+
+	password, err := RandomPassword()
+	if err != nil {
+		return "", "", err
+	}
+
+	r, err := NewRole(BootstrapRole, password)
+	if err != nil {
+		return "", "", err
+	}
+	r.CanGet = true
+	r.CanPut = true
+	r.CanRm = true
+	r.CanAppend = true
+	r.CanAdmin = true
+
+	s.roles[r.Id] = r
+	err = s.saveRoles()
+	if err != nil {
+		delete(s.roles, r.Id)
+		return "", "", err
+	}
+
+	return r.Id, password, s.markBootstrapped(r.Id)
+}
+
+// Record that we've been bootstrapped
+//
+func (s *Silo) markBootstrapped(role string) error {
+	data, err := json.Marshal(&bootstrapRecord{Role: role, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	err = s.writeSystem(bootstrapKey, data)
+	if err != nil {
+		return err
+	}
+	s.bootstrapped.Store(true)
+	return nil
+}
+
+// List all roles, both those from the config & those held in our own storage.
+//
+func (s *Silo) Roles(user *Role) ([]*Role, error) {
+	if !user.CanAdmin {
+		return nil, fmt.Errorf("%w: user %s is not permitted to administer roles", ErrForbidden, user.Id)
+	}
+
+	s.roleLock.RLock()
+	defer s.roleLock.RUnlock()
+
+	result := []*Role{}
+	for id, r := range s.config().User {
+		_, ok := s.roles[id]
+		if !ok {
+			result = append(result, r)
+		}
+	}
+	for _, r := range s.roles {
+		result = append(result, r)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result, nil
+}
+
+// Fetch a single role by id.
+//
+func (s *Silo) Role(user *Role, id string) (*Role, error) {
+	if !user.CanAdmin {
+		return nil, fmt.Errorf("%w: user %s is not permitted to administer roles", ErrForbidden, user.Id)
+	}
+
+	r, ok := s.role(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: role %s", ErrNotFound, id)
+	}
+	return r, nil
+}
+
+// Create a new role, held in our own storage. The role must include a password hash (see NewRole).
+//
+func (s *Silo) CreateRole(user *Role, role *Role) error {
+	if !user.CanAdmin {
+		return fmt.Errorf("%w: user %s is not permitted to administer roles", ErrForbidden, user.Id)
+	}
+	if role.Id == "" || len(role.Password) == 0 {
+		return fmt.Errorf("%w: a role requires an id and password", ErrBadRequest)
+	}
+
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+
+	_, exists := s.lookupRole(role.Id)
+	if exists {
+		return fmt.Errorf("%w: role %s", ErrExists, role.Id)
+	}
+
+	return s.storeRole(role)
+}
+
+// Update the permissions, limits & disabled state of an existing role.
+//  If the role has no password set, the existing password is kept.
+//  Updating a role from the config stores an updated copy, which takes precedence from then on.
+//
+func (s *Silo) UpdateRole(user *Role, role *Role) error {
+	if !user.CanAdmin {
+		return fmt.Errorf("%w: user %s is not permitted to administer roles", ErrForbidden, user.Id)
+	}
+	if role.Id == user.Id && (role.Disabled || !role.CanAdmin) {
+		return fmt.Errorf("%w: user %s cannot disable or remove admin from their own role", ErrForbidden, user.Id)
+	}
+
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+
+	existing, ok := s.lookupRole(role.Id)
+	if !ok {
+		return fmt.Errorf("%w: role %s", ErrNotFound, role.Id)
+	}
+
+	updated := *role
+	if len(updated.Password) == 0 {
+		updated.Password = existing.Password
+	}
+
+	return s.storeRole(&updated)
+}
+
+// Set a new password for a role. If no password is given a random one is generated.
+//  The new password is returned.
+//
+func (s *Silo) RotatePassword(user *Role, id, password string) (string, error) {
+	if !user.CanAdmin {
+		return "", fmt.Errorf("%w: user %s is not permitted to administer roles", ErrForbidden, user.Id)
+	}
+
+	var err error
+	if password == "" {
+		password, err = RandomPassword()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+
+	existing, ok := s.lookupRole(id)
+	if !ok {
+		return "", fmt.Errorf("%w: role %s", ErrNotFound, id)
+	}
+
+	hashed, err := NewRole(id, password)
+	if err != nil {
+		return "", err
+	}
+
+	updated := *existing
+	updated.Password = hashed.Password
+	return password, s.storeRole(&updated)
+}
+
+// Delete a role held in our own storage. Roles defined in the config can't be deleted, though they can be disabled.
+//  Deleting a stored role that overrides a config role reverts it to the config version.
+//
+func (s *Silo) DeleteRole(user *Role, id string) error {
+	if !user.CanAdmin {
+		return fmt.Errorf("%w: user %s is not permitted to administer roles", ErrForbidden, user.Id)
+	}
+	if id == user.Id {
+		return fmt.Errorf("%w: user %s cannot delete their own role", ErrForbidden, user.Id)
+	}
+
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+
+	existing, ok := s.roles[id]
+	if !ok {
+		_, ok = s.config().User[id]
+		if ok {
+			return fmt.Errorf("%w: role %s is defined in the config, disable it instead", ErrForbidden, id)
+		}
+		return fmt.Errorf("%w: role %s", ErrNotFound, id)
+	}
+
+	delete(s.roles, id)
+	err := s.saveRoles()
+	if err != nil {
+		s.roles[id] = existing
+	}
+	return err
+}
+
+// Add or replace a role in our storage.
+//  Nb. the caller is expected to hold the role lock.
+//
+func (s *Silo) storeRole(role *Role) error {
+	previous, existed := s.roles[role.Id]
+
+	s.roles[role.Id] = role
+	err := s.saveRoles()
+	if err != nil {
+		if existed {
+			s.roles[role.Id] = previous
+		} else {
+			delete(s.roles, role.Id)
+		}
+	}
+	return err
+}
+
+// Generate a random password suitable for handing out.
+//
+func RandomPassword() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,164 @@
+package silo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDefaultsRefused(t *testing.T) {
+	c := NewConfig()
+	c.Store.Location = t.TempDir()
+	_, err := NewSilo(c)
+	if !errors.Is(err, ErrInsecure) {
+		t.Fatalf("expected the default key to be refused, got %v", err)
+	}
+
+	c.Misc.EncryptionKey = testEncryptionKey
+	_, err = NewSilo(c)
+	if !errors.Is(err, ErrInsecure) {
+		t.Fatalf("expected the default roles to be refused, got %v", err)
+	}
+
+	c.Misc.AllowInsecureDefaults = true
+	s := openTestSilo(t, c)
+	_, ok := s.role("read")
+	if !ok {
+		t.Fatalf("expected the default roles to be allowed with AllowInsecureDefaults")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	dir := t.TempDir()
+	config := func() *Config {
+		c := NewConfig()
+		c.Misc.EncryptionKey = testEncryptionKey
+		c.Store.Location = dir
+		return c
+	}
+
+	// first start, asked to bootstrap
+	c := config()
+	c.RemoveDefaultRoles()
+	s, err := NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, password, err := s.Bootstrap()
+	if err != nil || name != BootstrapRole || password == "" {
+		t.Fatalf("expected a bootstrapped admin, got %q %q %v", name, password, err)
+	}
+	_, again, err := s.Bootstrap()
+	if err != nil || again != "" {
+		t.Fatalf("expected bootstrapping twice to do nothing, got %q %v", again, err)
+	}
+	s.Close()
+
+	// later starts don't ask to bootstrap, so the config still has the default roles
+	s = openTestSilo(t, config())
+	admin, err := s.User(BootstrapRole, password)
+	if err != nil || admin == nil || !admin.CanAdmin {
+		t.Fatalf("expected the bootstrapped admin, got %+v %v", admin, err)
+	}
+	_, ok := s.role("readwrite")
+	if ok {
+		t.Fatalf("expected the default roles to be dropped")
+	}
+
+	// nor do reloads
+	_, err = s.Reload(config())
+	if err != nil {
+		t.Fatalf("expected reload to drop the default roles, got %v", err)
+	}
+	_, ok = s.role("read")
+	if ok {
+		t.Fatalf("expected the default roles to be dropped on reload")
+	}
+}
+
+func TestRoleAdmin(t *testing.T) {
+	admin := testRole("admin", true, true, true)
+	admin.CanAdmin = true
+	reader := testRole("reader", true, false, false)
+	c := testConfig(t, admin, reader)
+	s := openTestSilo(t, c)
+
+	created := testRole("created", true, false, false)
+	cases := []struct{
+		Name string
+		Err error
+		Fn func() error
+	}{
+		{"non admins can't list", ErrForbidden, func() error { _, err := s.Roles(reader); return err }},
+		{"non admins can't create", ErrForbidden, func() error { return s.CreateRole(reader, created) }},
+		{"a password is required", ErrBadRequest, func() error { return s.CreateRole(admin, &Role{Id: "nopw"}) }},
+		{"create", nil, func() error { return s.CreateRole(admin, created) }},
+		{"create twice", ErrExists, func() error { return s.CreateRole(admin, created) }},
+		{"config roles exist", ErrExists, func() error { return s.CreateRole(admin, testRole("reader", true, true, true)) }},
+		{"update a missing role", ErrNotFound, func() error { return s.UpdateRole(admin, &Role{Id: "missing"}) }},
+		{"admins can't demote themselves", ErrForbidden, func() error { return s.UpdateRole(admin, &Role{Id: "admin"}) }},
+		{"admins can't delete themselves", ErrForbidden, func() error { return s.DeleteRole(admin, "admin") }},
+		{"config roles can't be deleted", ErrForbidden, func() error { return s.DeleteRole(admin, "reader") }},
+		{"delete a missing role", ErrNotFound, func() error { return s.DeleteRole(admin, "missing") }},
+	}
+	for _, c := range cases {
+		err := c.Fn()
+		if c.Err == nil && err != nil || c.Err != nil && !errors.Is(err, c.Err) {
+			t.Errorf("%s: expected %v, got %v", c.Name, c.Err, err)
+		}
+	}
+
+	roles, err := s.Roles(admin)
+	if err != nil || len(roles) != 3 || roles[0].Id != "admin" || roles[1].Id != "created" || roles[2].Id != "reader" {
+		t.Fatalf("expected admin, created & reader, got %v %v", roles, err)
+	}
+
+	// updating keeps the password unless a new one is given, and overrides the config
+	err = s.UpdateRole(admin, &Role{Id: "reader", CanGet: true, CanPut: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.User("reader", testPassword)
+	if err != nil || u == nil || !u.CanPut {
+		t.Fatalf("expected reader to keep its password & be able to write, got %+v %v", u, err)
+	}
+
+	password, err := s.RotatePassword(admin, "created", "")
+	if err != nil || password == "" {
+		t.Fatalf("expected a generated password, got %q %v", password, err)
+	}
+	u, _ = s.User("created", testPassword)
+	if u != nil {
+		t.Fatalf("expected the old password to be refused")
+	}
+
+	// stored roles survive a restart
+	s.Close()
+	s = openTestSilo(t, c)
+	u, err = s.User("created", password)
+	if err != nil || u == nil {
+		t.Fatalf("expected the created role after a restart, got %v", err)
+	}
+	r, err := s.Role(admin, "reader")
+	if err != nil || !r.CanPut {
+		t.Fatalf("expected the updated reader after a restart, got %+v %v", r, err)
+	}
+
+	// deleting the stored copy of a config role reverts it
+	err = s.DeleteRole(admin, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = s.Role(admin, "reader")
+	if err != nil || r.CanPut {
+		t.Fatalf("expected reader to revert to the config version, got %+v %v", r, err)
+	}
+
+	err = s.DeleteRole(admin, "created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Role(admin, "created")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the deleted role to be gone, got %v", err)
+	}
+}
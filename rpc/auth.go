@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"github.com/voidshard/silo"
+)
+
+// Return the value of the "authorization" metadata for the given credentials, as for HTTP basic auth
+//
+func BasicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// Determine the role making a call, from the "authorization" metadata if given, else from a verified client
+// certificate, whose common name is the role.
+//
+func (s *service) authenticate(ctx context.Context) (*silo.Role, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		username, password, ok := parseBasicAuth(auth)
+		if !ok {
+			authFailures.Inc()
+			return nil, statusError(fmt.Errorf("%w: invalid authorization metadata", silo.ErrUnauthorized))
+		}
+
+		suser, err := s.repo.User(username, password)
+		if suser == nil || err != nil {
+			authFailures.Inc()
+			return nil, statusError(fmt.Errorf("%w: user unknown", silo.ErrUnauthorized))
+		}
+		return suser, nil
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+		if ok && len(tlsInfo.State.VerifiedChains) > 0 && len(tlsInfo.State.VerifiedChains[0]) > 0 {
+			name := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+			suser, err := s.repo.TrustedUser(name)
+			if suser == nil || err != nil {
+				authFailures.Inc()
+				return nil, statusError(fmt.Errorf("%w: user unknown", silo.ErrUnauthorized))
+			}
+			return suser, nil
+		}
+	}
+
+	authFailures.Inc()
+	return nil, statusError(fmt.Errorf("%w: no credentials given", silo.ErrUnauthorized))
+}
+
+func parseBasicAuth(values []string) (string, string, bool) {
+	if len(values) != 1 || !strings.HasPrefix(values[0], "Basic ") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(values[0], "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
@@ -0,0 +1,47 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"github.com/voidshard/silo"
+)
+
+// gRPC status codes for each of silo's errors
+//
+var errorCodes = []struct{
+	err error
+	code codes.Code
+}{
+	{silo.ErrForbidden, codes.PermissionDenied},
+	{silo.ErrUnauthorized, codes.Unauthenticated},
+	{silo.ErrNotFound, codes.NotFound},
+	{silo.ErrExists, codes.AlreadyExists},
+	{silo.ErrTooLarge, codes.ResourceExhausted},
+	{silo.ErrKeyTooLong, codes.InvalidArgument},
+	{silo.ErrQuotaExceeded, codes.ResourceExhausted},
+	{silo.ErrBadRequest, codes.InvalidArgument},
+	{silo.ErrRangeNotSatisfiable, codes.OutOfRange},
+	{silo.ErrUnsupported, codes.Unimplemented},
+	{silo.ErrAborted, codes.Aborted},
+	// committed, so not to be retried
+	{silo.ErrPending, codes.FailedPrecondition},
+	{context.Canceled, codes.Canceled},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+}
+
+// Return the given error as a gRPC status, with the code matching silo's error
+//
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return status.Error(e.code, err.Error())
+		}
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,59 @@
+package rpc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"github.com/voidshard/silo/metrics"
+)
+
+var (
+	grpcRequests = metrics.Default.NewCounterVec(
+		"silo_grpc_requests_total",
+		"gRPC calls served, by method & status code.",
+		"method", "code",
+	)
+	grpcLatency = metrics.Default.NewHistogramVec(
+		"silo_grpc_request_duration_seconds",
+		"Time taken to serve gRPC calls, by method & status code.",
+		metrics.DefaultBuckets,
+		"method", "code",
+	)
+	authFailures = metrics.Default.NewCounterVec(
+		"silo_grpc_auth_failures_total",
+		"gRPC calls that failed authentication.",
+	)
+)
+
+func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observe(ctx, info.FullMethod, err, time.Since(start))
+	return resp, err
+}
+
+func streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, stream)
+	observe(stream.Context(), info.FullMethod, err, time.Since(start))
+	return err
+}
+
+// Record metrics & write an access log line for a completed call
+//
+func observe(ctx context.Context, method string, err error, duration time.Duration) {
+	code := status.Code(err).String()
+	grpcRequests.Inc(method, code)
+	grpcLatency.Observe(duration.Seconds(), method, code)
+
+	slog.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"grpc request",
+		slog.String("method", method),
+		slog.String("code", code),
+		slog.Float64("duration_ms", float64(duration.Microseconds()) / 1000),
+	)
+}
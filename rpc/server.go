@@ -0,0 +1,237 @@
+/*
+Package rpc is silo's gRPC API (see silo.proto), with the generated client & server stubs.
+
+	conn, err := grpc.NewClient("silo.example.com:9151", grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	...
+	c := rpc.NewSiloClient(conn)
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", rpc.BasicAuth("someone", "password"))
+	info, err := c.Stat(ctx, &rpc.StatRequest{Key: "/some/key"})
+
+The service calls the same Silo methods as the HTTP API, so permissions, quotas & auditing are the same.
+*/
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"github.com/voidshard/silo"
+)
+
+const (
+	// Get sends data in messages of up to this size, well under gRPC's default 4MiB limit
+	getChunkBytes = 1024 * 1024
+)
+
+type service struct {
+	UnimplementedSiloServer
+	repo *silo.Silo
+}
+
+// Return the gRPC service for repo, to register with a grpc.Server of your own; see NewGRPCServer.
+//
+func NewServer(repo *silo.Silo) SiloServer {
+	return &service{repo: repo}
+}
+
+// Return a grpc.Server serving silo's API for repo, recording metrics & an access log line for every call.
+//
+func NewGRPCServer(repo *silo.Silo, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(unaryInterceptor), grpc.ChainStreamInterceptor(streamInterceptor))
+	s := grpc.NewServer(opts...)
+	RegisterSiloServer(s, NewServer(repo))
+	return s
+}
+
+// Fetch a key, in chunks. The object is opened once & every chunk read through it, so the chunks are all of one
+// version of the object even if it's replaced while being sent.
+//
+func (s *service) Get(req *GetRequest, stream grpc.ServerStreamingServer[GetResponse]) error {
+	user, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	obj, err := s.repo.Open(user, req.Key)
+	if err != nil {
+		return statusError(err)
+	}
+	defer obj.Close()
+	size := obj.Info().Size
+
+	for offset := int64(0); offset < size; offset += getChunkBytes {
+		err = stream.Context().Err()
+		if err != nil {
+			return statusError(err)
+		}
+
+		data, err := obj.ReadRange(offset, min(size - offset, getChunkBytes))
+		if err != nil {
+			return statusError(err)
+		}
+		err = stream.Send(&GetResponse{Data: data})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store a key. Data is buffered up to MaxDataBytes & stored at once; anything larger is sent as a multipart
+// upload, a part at a time, so it's limited by MaxUploadBytes instead.
+//
+func (s *service) Put(stream grpc.ClientStreamingServer[PutRequest, PutResponse]) (err error) {
+	user, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "no key given")
+	} else if err != nil {
+		return err
+	}
+	key := first.Key
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "no key given")
+	}
+
+	max := s.repo.MaxDataBytes()
+	buf := first.Data
+	size := int64(len(buf))
+
+	upload := ""
+	part := 0
+	defer func() {
+		if err != nil && upload != "" {
+			s.repo.AbortUpload(user, key, upload)
+		}
+	}()
+
+	for {
+		// the first message may hold more than fits in one part, too
+		for len(buf) > max {
+			if upload == "" {
+				upload, err = s.repo.CreateUpload(user, key)
+				if err != nil {
+					return statusError(err)
+				}
+			}
+			part++
+			_, err = s.repo.UploadPart(user, key, upload, part, buf[:max])
+			if err != nil {
+				return statusError(err)
+			}
+			buf = append([]byte(nil), buf[max:]...)
+		}
+
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		buf = append(buf, msg.Data...)
+		size += int64(len(msg.Data))
+	}
+
+	if upload == "" && first.Create {
+		err = s.repo.Create(user, key, buf)
+	} else if upload == "" {
+		err = s.repo.Store(user, key, buf)
+	} else {
+		if len(buf) > 0 {
+			part++
+			_, err = s.repo.UploadPart(user, key, upload, part, buf)
+		}
+		if err == nil && first.Create {
+			err = s.repo.CompleteCreate(user, key, upload)
+		} else if err == nil {
+			err = s.repo.CompleteUpload(user, key, upload)
+		}
+	}
+	if err != nil {
+		return statusError(err)
+	}
+	return stream.SendAndClose(&PutResponse{Size: size})
+}
+
+func (s *service) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	user, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.repo.Remove(user, req.Key)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+func (s *service) Stat(ctx context.Context, req *StatRequest) (*StatResponse, error) {
+	user, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.repo.Stat(user, req.Key)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &StatResponse{Size: info.Size, Etag: info.ETag}, nil
+}
+
+func (s *service) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	user, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, more, err := s.repo.List(user, req.Prefix, req.After, int(req.Limit))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &ListResponse{Keys: keys, More: more}, nil
+}
+
+// Stream changes until the call is cancelled, or the watcher falls behind
+//
+func (s *service) Watch(req *WatchRequest, stream grpc.ServerStreamingServer[WatchEvent]) error {
+	user, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	events, stop, err := s.repo.Watch(user, req.Prefix)
+	if err != nil {
+		return statusError(err)
+	}
+	defer stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return statusError(stream.Context().Err())
+		case e, ok := <-events:
+			if !ok {
+				return statusError(fmt.Errorf("%w: watcher fell behind & missed changes", silo.ErrAborted))
+			}
+			err = stream.Send(&WatchEvent{
+				Action: e.Action,
+				Key: e.Key,
+				From: e.From,
+				Size: e.Size,
+				Time: timestamppb.New(e.Time),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
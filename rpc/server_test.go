@@ -0,0 +1,334 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"github.com/voidshard/silo"
+)
+
+const (
+	testEncryptionKey = "a key used only by tests, long enough to be accepted"
+	testPassword = "pw"
+
+	// small, so puts of a few KB are sent as multipart uploads
+	testMaxDataBytes = 1000
+)
+
+// Build a role with the given permissions & testPassword, hashed cheaply.
+//
+func testRole(id string, get, put, rm bool) *silo.Role {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	r, err := silo.NewRoleFromHash(id, string(hash))
+	if err != nil {
+		panic(err)
+	}
+	r.CanGet = get
+	r.CanPut = put
+	r.CanRm = rm
+	return r
+}
+
+// Open a silo in a fresh temp dir with the given roles & serve it over an in memory connection until the test ends,
+// returning a client for it.
+//
+func testClient(t *testing.T, roles ...*silo.Role) (*silo.Silo, SiloClient) {
+	c := silo.NewConfig()
+	c.RemoveDefaultRoles()
+	c.Misc.EncryptionKey = testEncryptionKey
+	c.Misc.MaxDataBytes = testMaxDataBytes
+	c.Store.Location = t.TempDir()
+	for _, r := range roles {
+		c.User[r.Id] = r
+	}
+	repo, err := silo.NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewGRPCServer(repo)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return repo, NewSiloClient(conn)
+}
+
+// A context carrying the given role's credentials, or none if user is empty.
+//
+func as(user string) context.Context {
+	ctx := context.Background()
+	if user == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", BasicAuth(user, testPassword))
+}
+
+// Store data under key, sent in messages of up to chunk bytes.
+//
+func put(ctx context.Context, c SiloClient, key string, create bool, data []byte, chunk int) error {
+	stream, err := c.Put(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&PutRequest{Key: key, Create: create})
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := min(len(data), chunk)
+		err = stream.Send(&PutRequest{Data: data[:n]})
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// Fetch all of key.
+//
+func get(ctx context.Context, c SiloClient, key string) ([]byte, error) {
+	stream, err := c.Get(ctx, &GetRequest{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{}
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return data, nil
+		} else if err != nil {
+			return nil, err
+		}
+		data = append(data, msg.Data...)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	reader := testRole("reader", true, false, false)
+	_, c := testClient(t, rw, reader)
+
+	small := []byte("hello")
+	large := bytes.Repeat([]byte("0123456789"), 350) // sent as an upload of 4 parts
+	for key, data := range map[string][]byte{"/small": small, "/large": large} {
+		err := put(as("rw"), c, key, false, data, 300)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		got, err := get(as("reader"), c, key)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: expected %d bytes back, got %d %v", key, len(data), len(got), err)
+		}
+		info, err := c.Stat(as("reader"), &StatRequest{Key: key})
+		if err != nil || info.Size != int64(len(data)) {
+			t.Fatalf("%s: expected a size of %d, got %v %v", key, len(data), info, err)
+		}
+	}
+
+	// replacing
+	err := put(as("rw"), c, "/small", false, []byte("again"), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := get(as("reader"), c, "/small")
+	if err != nil || string(got) != "again" {
+		t.Fatalf("expected the key to be replaced, got %q %v", got, err)
+	}
+
+	list, err := c.List(as("reader"), &ListRequest{Prefix: "/"})
+	if err != nil || len(list.Keys) != 2 || list.Keys[0] != "/large" || list.Keys[1] != "/small" {
+		t.Fatalf("expected both keys listed, got %v %v", list, err)
+	}
+
+	_, err = c.Delete(as("rw"), &DeleteRequest{Key: "/small"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = get(as("reader"), c, "/small")
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected the deleted key to be gone, got %v", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	reader := testRole("reader", true, false, false)
+	_, c := testClient(t, rw, reader)
+
+	cases := []struct{
+		Name string
+		Code codes.Code
+		Fn func() error
+	}{
+		{"no credentials", codes.Unauthenticated, func() error { _, err := c.Stat(as(""), &StatRequest{Key: "/a"}); return err }},
+		{"unknown user", codes.Unauthenticated, func() error { _, err := c.Stat(as("nobody"), &StatRequest{Key: "/a"}); return err }},
+		{"missing key", codes.NotFound, func() error { _, err := get(as("reader"), c, "/a"); return err }},
+		{"forbidden", codes.PermissionDenied, func() error { return put(as("reader"), c, "/a", false, []byte("x"), 10) }},
+		{"no key", codes.InvalidArgument, func() error { return put(as("rw"), c, "", false, []byte("x"), 10) }},
+	}
+	for _, c := range cases {
+		err := c.Fn()
+		if status.Code(err) != c.Code {
+			t.Errorf("%s: expected %v, got %v", c.Name, c.Code, err)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	writer := testRole("writer", false, true, false)
+	_, c := testClient(t, rw, writer)
+
+	large := bytes.Repeat([]byte("x"), 2500)
+	cases := []struct{
+		Name string
+		User string
+		Data []byte
+		Code codes.Code
+	}{
+		{"create", "rw", []byte("one"), codes.OK},
+		{"exists", "rw", []byte("two"), codes.AlreadyExists},
+		{"exists, as an upload", "rw", large, codes.AlreadyExists},
+		{"exists & can't be replaced anyway", "writer", []byte("two"), codes.PermissionDenied},
+		{"nor as an upload", "writer", large, codes.PermissionDenied},
+	}
+	for _, tc := range cases {
+		err := put(as(tc.User), c, "/a", true, tc.Data, 300)
+		if status.Code(err) != tc.Code {
+			t.Errorf("%s: expected %v, got %v", tc.Name, tc.Code, err)
+		}
+	}
+	got, err := get(as("rw"), c, "/a")
+	if err != nil || string(got) != "one" {
+		t.Fatalf("expected the key to be unchanged, got %q %v", got, err)
+	}
+
+	// of concurrent creates, only one succeeds; all the data is sent before any of them finish
+	var wg, sent sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		sent.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := c.Put(as("rw"))
+			if err == nil {
+				err = stream.Send(&PutRequest{Key: "/b", Create: true, Data: large})
+			}
+			sent.Done()
+			sent.Wait()
+			if err == nil {
+				_, err = stream.CloseAndRecv()
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+		} else if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("expected creates that lose to fail with AlreadyExists, got %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected exactly one create to succeed, got %d", created)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	_, c := testClient(t, rw)
+
+	ctx, cancel := context.WithTimeout(as("rw"), 10 * time.Second)
+	defer cancel()
+	stream, err := c.Watch(ctx, &WatchRequest{Prefix: "/watched/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *WatchEvent, 100)
+	go func() {
+		defer close(events)
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+
+	// the watcher is registered some time after the call is made, so write until it's seen
+	var first *WatchEvent
+	for first == nil {
+		err = put(as("rw"), c, "/other", false, []byte("unwatched"), 100)
+		if err == nil {
+			err = put(as("rw"), c, "/watched/a", false, []byte("one"), 100)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case first = <-events:
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("no event seen")
+		}
+	}
+	if first.Action != silo.AuditStore || first.Key != "/watched/a" || first.Size != 3 {
+		t.Fatalf("expected the store to be seen, got %+v", first)
+	}
+
+	_, err = c.Delete(as("rw"), &DeleteRequest{Key: "/watched/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for e := range events {
+		if e.Key != "/watched/a" {
+			t.Fatalf("expected only watched keys, got %+v", e)
+		}
+		if e.Action == silo.AuditRemove {
+			cancel()
+			break
+		}
+	}
+
+	// the call ends when cancelled
+	for range events {
+	}
+	_, err = stream.Recv()
+	if status.Code(err) != codes.Canceled && !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the watch to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: silo.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Silo_Get_FullMethodName    = "/silo.v1.Silo/Get"
+	Silo_Put_FullMethodName    = "/silo.v1.Silo/Put"
+	Silo_Delete_FullMethodName = "/silo.v1.Silo/Delete"
+	Silo_Stat_FullMethodName   = "/silo.v1.Silo/Stat"
+	Silo_List_FullMethodName   = "/silo.v1.Silo/List"
+	Silo_Watch_FullMethodName  = "/silo.v1.Silo/Watch"
+)
+
+// SiloClient is the client API for Silo service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// silo's gRPC API, served on listeners with Protocol=grpc.
+//
+// Credentials are given in the "authorization" metadata as for HTTP basic auth ("Basic " + base64 of
+// "user:password"), or by a client certificate signed by the listener's ClientCA, whose common name is the role.
+// Errors are returned with the matching status code, eg. NOT_FOUND, PERMISSION_DENIED or UNAUTHENTICATED.
+type SiloClient interface {
+	// Fetch the data stored under a key, streamed in chunks.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetResponse], error)
+	// Store data under a key, replacing it if it exists (which requires permission to remove). The first message
+	// names the key; it & any following messages carry the data.
+	Put(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[PutRequest, PutResponse], error)
+	// Remove a key.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Return the size & etag of a key.
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
+	// List keys in order, a page at a time.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Stream changes to keys beginning with a prefix, until the call is cancelled. A watcher that falls too far
+	// behind is ended with ABORTED, as it has missed changes.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchEvent], error)
+}
+
+type siloClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSiloClient(cc grpc.ClientConnInterface) SiloClient {
+	return &siloClient{cc}
+}
+
+func (c *siloClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Silo_ServiceDesc.Streams[0], Silo_Get_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GetRequest, GetResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Silo_GetClient = grpc.ServerStreamingClient[GetResponse]
+
+func (c *siloClient) Put(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[PutRequest, PutResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Silo_ServiceDesc.Streams[1], Silo_Put_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[PutRequest, PutResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Silo_PutClient = grpc.ClientStreamingClient[PutRequest, PutResponse]
+
+func (c *siloClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, Silo_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *siloClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, Silo_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *siloClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, Silo_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *siloClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Silo_ServiceDesc.Streams[2], Silo_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, WatchEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Silo_WatchClient = grpc.ServerStreamingClient[WatchEvent]
+
+// SiloServer is the server API for Silo service.
+// All implementations must embed UnimplementedSiloServer
+// for forward compatibility.
+//
+// silo's gRPC API, served on listeners with Protocol=grpc.
+//
+// Credentials are given in the "authorization" metadata as for HTTP basic auth ("Basic " + base64 of
+// "user:password"), or by a client certificate signed by the listener's ClientCA, whose common name is the role.
+// Errors are returned with the matching status code, eg. NOT_FOUND, PERMISSION_DENIED or UNAUTHENTICATED.
+type SiloServer interface {
+	// Fetch the data stored under a key, streamed in chunks.
+	Get(*GetRequest, grpc.ServerStreamingServer[GetResponse]) error
+	// Store data under a key, replacing it if it exists (which requires permission to remove). The first message
+	// names the key; it & any following messages carry the data.
+	Put(grpc.ClientStreamingServer[PutRequest, PutResponse]) error
+	// Remove a key.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Return the size & etag of a key.
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	// List keys in order, a page at a time.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Stream changes to keys beginning with a prefix, until the call is cancelled. A watcher that falls too far
+	// behind is ended with ABORTED, as it has missed changes.
+	Watch(*WatchRequest, grpc.ServerStreamingServer[WatchEvent]) error
+	mustEmbedUnimplementedSiloServer()
+}
+
+// UnimplementedSiloServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSiloServer struct{}
+
+func (UnimplementedSiloServer) Get(*GetRequest, grpc.ServerStreamingServer[GetResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedSiloServer) Put(grpc.ClientStreamingServer[PutRequest, PutResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedSiloServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedSiloServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedSiloServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedSiloServer) Watch(*WatchRequest, grpc.ServerStreamingServer[WatchEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedSiloServer) mustEmbedUnimplementedSiloServer() {}
+func (UnimplementedSiloServer) testEmbeddedByValue()              {}
+
+// UnsafeSiloServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SiloServer will
+// result in compilation errors.
+type UnsafeSiloServer interface {
+	mustEmbedUnimplementedSiloServer()
+}
+
+func RegisterSiloServer(s grpc.ServiceRegistrar, srv SiloServer) {
+	// If the following call pancis, it indicates UnimplementedSiloServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Silo_ServiceDesc, srv)
+}
+
+func _Silo_Get_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SiloServer).Get(m, &grpc.GenericServerStream[GetRequest, GetResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Silo_GetServer = grpc.ServerStreamingServer[GetResponse]
+
+func _Silo_Put_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SiloServer).Put(&grpc.GenericServerStream[PutRequest, PutResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Silo_PutServer = grpc.ClientStreamingServer[PutRequest, PutResponse]
+
+func _Silo_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SiloServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Silo_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SiloServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Silo_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SiloServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Silo_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SiloServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Silo_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SiloServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Silo_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SiloServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Silo_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SiloServer).Watch(m, &grpc.GenericServerStream[WatchRequest, WatchEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Silo_WatchServer = grpc.ServerStreamingServer[WatchEvent]
+
+// Silo_ServiceDesc is the grpc.ServiceDesc for Silo service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Silo_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "silo.v1.Silo",
+	HandlerType: (*SiloServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Delete",
+			Handler:    _Silo_Delete_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _Silo_Stat_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Silo_List_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Get",
+			Handler:       _Silo_Get_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Put",
+			Handler:       _Silo_Put_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Silo_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "silo.proto",
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/voidshard/silo"
+)
+
+// Serve queries against the audit log. Only admins may read it; silo itself enforces that.
+//
+//  GET /_silo/audit?role=<id>&prefix=<key prefix>&since=<RFC3339>&until=<RFC3339>&limit=<n>
+//
+// All parameters are optional. Records are returned oldest first.
+//
+func (a *app) serveAudit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		a.writeMethodForbidden(w, req)
+		return
+	}
+
+	suser := a.authenticate(w, req)
+	if suser == nil {
+		return
+	}
+
+	q, err := parseAuditQuery(req)
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	records, err := a.repo.Audit(suser, q)
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+	a.writeJson(w, http.StatusOK, records)
+}
+
+func parseAuditQuery(req *http.Request) (*silo.AuditQuery, error) {
+	values := req.URL.Query()
+	q := &silo.AuditQuery{
+		Role: values.Get("role"),
+		Prefix: values.Get("prefix"),
+	}
+
+	var err error
+	if v := values.Get("since"); v != "" {
+		q.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: since: %v", silo.ErrBadRequest, err)
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		q.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: until: %v", silo.ErrBadRequest, err)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 0 {
+			return nil, fmt.Errorf("%w: limit must be a positive integer", silo.ErrBadRequest)
+		}
+	}
+
+	return q, nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"strings"
+	"encoding/base64"
+	"net/http"
+	"fmt"
+	"errors"
+	"github.com/voidshard/silo"
+)
+
+// Identifies the role making a request
+//
+type Authenticator interface {
+	// Return the role making the request, or nil if it carries no credentials we understand (so the next
+	// Authenticator is tried). Errors for credentials that aren't valid should wrap silo.ErrUnauthorized,
+	// anything else is a server error.
+	Authenticate(req *http.Request) (*silo.Role, error)
+}
+
+// Allows a plain function to be used as an Authenticator
+//
+type AuthenticatorFunc func(req *http.Request) (*silo.Role, error)
+
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*silo.Role, error) {
+	return f(req)
+}
+
+// Authenticate with basic auth, against the silo's roles. This is the default.
+//
+func BasicAuth(repo *silo.Silo) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*silo.Role, error) {
+		username, pass, err := getAuth(req)
+		if err != nil {
+			return nil, nil
+		}
+
+		suser, err := repo.User(username, pass)
+		if suser == nil || err != nil {
+			return nil, fmt.Errorf("%w: user unknown", silo.ErrUnauthorized)
+		}
+		return suser, nil
+	})
+}
+
+// Determine that a user is who they say they are
+//
+func (a *app) authenticate(w http.ResponseWriter, req *http.Request) *silo.Role {
+	for _, auth := range a.auth {
+		suser, err := auth.Authenticate(req)
+		if err != nil {
+			requestLogger(req).Warn("authentication failed", "error", err)
+			authFailures.Inc()
+			a.writeError(w, err)
+			return nil
+		}
+		if suser != nil {
+			requestLogger(req).Debug("authenticated", "role", suser.Id)
+			setRequestRole(w, suser.Id)
+			return suser
+		}
+	}
+
+	requestLogger(req).Warn("authentication failed", "error", "no credentials")
+	authFailures.Inc()
+	a.writeError(w, fmt.Errorf("%w: user unknown", silo.ErrUnauthorized))
+	return nil
+}
+
+// Determine that the given user can perform this request
+//
+func (a *app) authorize(w http.ResponseWriter, req *http.Request, usr *silo.Role) bool {
+	err := a.checkRequest(req, usr)
+	if errors.Is(err, silo.ErrForbidden) {
+		err = a.repo.Denied(usr, req.Method, req.URL.Path, err)
+	}
+	if err != nil {
+		a.writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// Check the request method is one the user is permitted & makes sense given whether the key exists
+//
+func (a *app) checkRequest(req *http.Request, usr *silo.Role) error {
+	action := req.Method
+	path := req.URL.Path
+
+	exists, err := a.repo.Exists(path)
+	if err != nil {
+		return err
+	}
+
+	if action == http.MethodDelete && usr.CanRm { // delete
+		if !exists {
+			return fmt.Errorf("%w: %s", silo.ErrNotFound, path)
+		}
+		return nil
+	} else if (action == http.MethodGet || action == http.MethodHead) && usr.CanGet { // read
+		if !exists {
+			return fmt.Errorf("%w: %s", silo.ErrNotFound, path)
+		}
+		return nil
+	} else if usr.CanPut && action == http.MethodPost { // write
+		// To write something, you must use POST and have WRITE.
+		// If the file exists, this is a conflict (you should use PUT) or forbidden if you can't overwrite
+		if exists {
+			if usr.CanRm {
+				return fmt.Errorf("%w: cannot overwrite with POST, use PUT", silo.ErrExists)
+			}
+			return fmt.Errorf("%w: already exists, cannot overwrite", silo.ErrForbidden)
+		}
+		return nil
+	} else if usr.CanPut && usr.CanRm && action == http.MethodPut { // overwrite
+		// To overwrite something, you must use PUT and have both RM and WRITE
+		if !exists {
+			return fmt.Errorf("%w: %s", silo.ErrNotFound, path)
+		}
+		return nil
+	} else if usr.CanGet && usr.CanPut && (action == MethodCopy || action == MethodMove) { // copy or move
+		// The source must exist; silo checks the rest, since it depends on the destination
+		if !exists {
+			return fmt.Errorf("%w: %s", silo.ErrNotFound, path)
+		}
+		return nil
+	} else if usr.CanAppend && action == http.MethodPatch { // append
+		// Appending creates the key if need be, & never changes what's already there
+		return nil
+	}
+
+	return fmt.Errorf("%w: method %s", silo.ErrForbidden, action)
+}
+
+
+// Given some http request, retrieve the username / password, if any.
+// At the moment we only support basic auth .. but we could support more things here.
+//
+func getAuth(req *http.Request) (string, string, error) {
+	auth, ok := req.Header["Authorization"]
+	if !ok {
+		return "", "", fmt.Errorf("require Authorization header")
+	}
+
+	if len(auth) != 1 {
+		return "", "", fmt.Errorf("multiple Authorization headers found")
+
+	}
+
+	token := strings.Replace(auth[0], "Basic ", "", 1)
+	authdata, err := base64.StdEncoding.DecodeString(token)
+
+	if err != nil {
+		return "", "", fmt.Errorf("invalid Authorization header: unable to decode bas64")
+	}
+
+	basicAuthdata := strings.SplitN(string(authdata), ":", 2)
+	if len(basicAuthdata) != 2 {
+		return "", "", fmt.Errorf("invalid Authorization header: unable to split on ';'")
+	}
+
+	return basicAuthdata[0], basicAuthdata[1], nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"github.com/voidshard/silo"
+)
+
+// A batch of operations, as sent to /_silo/batch
+//
+type batchMessage struct {
+	// all operations succeed or none take effect
+	Atomic bool
+	Ops []*silo.BatchOp
+}
+
+// The outcome of one operation in a batch. Status is the http status the operation would have had alone.
+//
+type batchResultMessage struct {
+	Op string
+	Key string
+	Status int
+	Code string `json:",omitempty"`
+	Message string `json:",omitempty"`
+	Data []byte `json:",omitempty"`
+	Exists *bool `json:",omitempty"`
+}
+
+type batchResponse struct {
+	Results []*batchResultMessage
+}
+
+// Serve a batch of get, put, delete & exists operations under a single authentication.
+//
+//  POST /_silo/batch  {"Atomic": false, "Ops": [{"Op": "put", "Key": "/a", "Data": "<base64>"}, {"Op": "get", "Key": "/b"}]}
+//
+// Each operation is permission checked as it would be alone, & has its own result. The response is only an error
+// if the batch as a whole is refused. An atomic batch that's committed but not yet applied is answered with 202
+// Accepted: it will be applied, & meanwhile its keys can't be written.
+//
+func (a *app) serveBatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		a.writeMethodForbidden(w, req)
+		return
+	}
+
+	suser := a.authenticate(w, req)
+	if suser == nil {
+		return
+	}
+
+	// data travels base64 encoded, so allow for that on top of the limit on the data itself
+	max := a.repo.MaxBatchBytes()
+	body, err := a.readLimited(w, req, max / 3 * 4 + 1024 * 1024, "maxbatchbytes")
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	batch := &batchMessage{}
+	err = json.Unmarshal(body, batch)
+	if err != nil {
+		a.writeError(w, fmt.Errorf("%w: %v", silo.ErrBadRequest, err))
+		return
+	}
+
+	// an atomic batch may be committed but not yet applied; it will be, so it mustn't be sent again
+	status := http.StatusOK
+	results, err := a.repo.Batch(suser, batch.Ops, batch.Atomic)
+	if errors.Is(err, silo.ErrPending) {
+		status = http.StatusAccepted
+	} else if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	resp := &batchResponse{Results: []*batchResultMessage{}}
+	size := int64(0)
+	for _, r := range results {
+		msg := &batchResultMessage{Op: r.Op, Key: r.Key, Status: http.StatusOK, Data: r.Data}
+		if r.Op == silo.BatchExists && r.Err == nil {
+			exists := r.Exists
+			msg.Exists = &exists
+		}
+		if r.Err != nil {
+			msg.Status = errorStatusCode(r.Err)
+			msg.Code = silo.ErrorCode(r.Err)
+			msg.Message = r.Err.Error()
+		}
+		size += int64(len(r.Data))
+		resp.Results = append(resp.Results, msg)
+	}
+
+	a.extendDeadlines(w, req, 0, size)
+	a.writeJson(w, status, resp)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchEndpoint(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	reader := testRole("reader", true, false, false)
+	repo := testSilo(t, rw, reader)
+	srv := testServer(t, repo)
+
+	cases := []struct{
+		Body string
+		Status int
+	}{
+		{`{"Ops":[null]}`, http.StatusBadRequest},
+		{`{"Ops":[{"Op":"copy","Key":"/a"}]}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+		{`{"Ops":[]}`, http.StatusOK},
+	}
+	for _, c := range cases {
+		status, body := request(t, srv, http.MethodPost, "/_silo/batch", "rw", strings.NewReader(c.Body))
+		if status != c.Status {
+			t.Errorf("%s: expected %d, got %d %s", c.Body, c.Status, status, body)
+		}
+	}
+
+	status, body := request(t, srv, http.MethodPost, "/_silo/batch", "reader", strings.NewReader(`{"Ops":[{"Op":"put","Key":"/a","Data":"b25l"},{"Op":"exists","Key":"/a"}]}`))
+	if status != http.StatusOK {
+		t.Fatalf("expected the batch to be accepted, got %d %s", status, body)
+	}
+	resp := &batchResponse{}
+	err := json.Unmarshal([]byte(body), resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Status != http.StatusForbidden || resp.Results[1].Status != http.StatusOK || *resp.Results[1].Exists {
+		t.Fatalf("expected the put to be forbidden & the key not to exist, got %s", body)
+	}
+}
+
+func TestBatchPending(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	c := testConfig(t, rw)
+	srv := testServer(t, openSilo(t, c))
+
+	// a directory where the key's file belongs can't be replaced, so the committed batch can't be applied
+	blocker := filepath.Join(c.Store.Location, base64.RawURLEncoding.EncodeToString([]byte("/a")), "x")
+	err := os.MkdirAll(blocker, 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := request(t, srv, http.MethodPost, "/_silo/batch", "rw", strings.NewReader(`{"Atomic":true,"Ops":[{"Op":"put","Key":"/a","Data":"b25l"}]}`))
+	resp := &batchResponse{}
+	err = json.Unmarshal([]byte(body), resp)
+	if status != http.StatusAccepted || err != nil || len(resp.Results) != 1 || resp.Results[0].Status != http.StatusOK {
+		t.Fatalf("expected the batch to be accepted with its results, got %d %s", status, body)
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"github.com/voidshard/silo"
+)
+
+// Body sent back with any error response
+//
+type errorMessage struct {
+	Code string
+	Message string
+}
+
+// http status codes for each of silo's errors
+//
+var errorStatus = []struct{
+	err error
+	status int
+}{
+	{silo.ErrForbidden, http.StatusForbidden},
+	{silo.ErrUnauthorized, http.StatusUnauthorized},
+	{silo.ErrNotFound, http.StatusNotFound},
+	{silo.ErrExists, http.StatusConflict},
+	{silo.ErrTooLarge, http.StatusRequestEntityTooLarge},
+	{silo.ErrKeyTooLong, http.StatusRequestURITooLong},
+	{silo.ErrQuotaExceeded, http.StatusInsufficientStorage},
+	{silo.ErrBadRequest, http.StatusBadRequest},
+	{silo.ErrRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable},
+	{silo.ErrUnsupported, http.StatusNotImplemented},
+	{silo.ErrAborted, http.StatusFailedDependency},
+	{silo.ErrPending, http.StatusAccepted},
+}
+
+// Return the http status code for the given error
+//
+func errorStatusCode(err error) int {
+	for _, e := range errorStatus {
+		if errors.Is(err, e.err) {
+			return e.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Write out the given error, with an appropriate status code & a json body giving a machine readable code.
+//
+func (a *app) writeError(w http.ResponseWriter, err error) {
+	a.writeJson(w, errorStatusCode(err), &errorMessage{
+		Code: silo.ErrorCode(err),
+		Message: err.Error(),
+	})
+}
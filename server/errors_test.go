@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"github.com/voidshard/silo"
+)
+
+func TestErrorResponses(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	writer := testRole("writer", false, true, false)
+	srv := testServer(t, testSilo(t, rw, writer))
+
+	status, _ := request(t, srv, http.MethodPost, "/exists", "rw", strings.NewReader("data"))
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+
+	cases := []struct{
+		Method string
+		Path string
+		User string
+		Status int
+		Code string
+	}{
+		{http.MethodGet, "/missing", "rw", http.StatusNotFound, "not_found"},
+		{http.MethodGet, "/exists", "", http.StatusUnauthorized, "unauthorized"},
+		{http.MethodGet, "/exists", "nobody", http.StatusUnauthorized, "unauthorized"},
+		{http.MethodGet, "/exists", "writer", http.StatusForbidden, "forbidden"},
+		{http.MethodPost, "/exists", "rw", http.StatusConflict, "exists"},
+		{http.MethodGet, "/" + strings.Repeat("x", 200), "rw", http.StatusRequestURITooLong, "key_too_long"},
+	}
+	for _, c := range cases {
+		status, body := request(t, srv, c.Method, c.Path, c.User, nil)
+		msg := &errorMessage{}
+		err := json.Unmarshal([]byte(body), msg)
+		if status != c.Status || err != nil || msg.Code != c.Code || msg.Message == "" {
+			t.Errorf("%s %s as %q: expected %d %s, got %d %s", c.Method, c.Path, c.User, c.Status, c.Code, status, body)
+		}
+	}
+}
+
+func TestErrorStatusCodes(t *testing.T) {
+	for _, e := range errorStatus {
+		if silo.ErrorCode(e.err) == silo.ErrorCodeInternal {
+			t.Errorf("%v has a status but no code", e.err)
+		}
+	}
+	if errorStatusCode(nil) != http.StatusInternalServerError {
+		t.Errorf("expected unknown errors to be internal server errors")
+	}
+}
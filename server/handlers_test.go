@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandlerGroups(t *testing.T) {
+	admin := testRole("admin", true, true, true)
+	admin.CanAdmin = true
+	repo := testSilo(t, admin)
+
+	paths := []struct{
+		Method string
+		Path string
+		Group string
+	}{
+		{http.MethodGet, "/", HandlerMetrics},
+		{http.MethodGet, "/_silo/metrics", HandlerMetrics},
+		{http.MethodGet, "/_silo/roles", HandlerAdmin},
+		{http.MethodGet, "/_silo/roles/admin", HandlerAdmin},
+		{http.MethodGet, "/_silo/usage", HandlerData},
+		{http.MethodPost, "/a/key", HandlerData},
+	}
+	for _, groups := range [][]string{{HandlerData}, {HandlerAdmin}, {HandlerMetrics}, {HandlerData, HandlerAdmin, HandlerMetrics}} {
+		srv := testServer(t, repo, WithHandlers(groups...), WithHealthPaths("/_silo/metrics", "", ""))
+		for _, p := range paths {
+			status, body := request(t, srv, p.Method, p.Path, "admin", strings.NewReader("data"))
+			served := status != http.StatusNotFound
+			expect := strings.Contains(strings.Join(groups, " "), p.Group)
+			if served != expect {
+				t.Errorf("%v %s %s: expected served %v, got %d %s", groups, p.Method, p.Path, expect, status, body)
+			}
+		}
+		repo.Remove(admin, "/a/key")
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderRequestId = "X-Request-Id"
+
+	// longest request id we'll accept from a client
+	maxRequestIdLength = 128
+)
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+)
+
+// Return the id of the given request, as set by the access log handler
+//
+func requestId(req *http.Request) string {
+	id, _ := req.Context().Value(requestIdKey).(string)
+	return id
+}
+
+// Return a logger that includes the id of the given request
+//
+func requestLogger(req *http.Request) *slog.Logger {
+	return slog.With("request_id", requestId(req))
+}
+
+// Use the client's request id if they sent a sensible one, otherwise make our own
+//
+func chooseRequestId(given string) string {
+	if given != "" && len(given) <= maxRequestIdLength && strings.IndexFunc(given, notPrintable) < 0 {
+		return given
+	}
+
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+func notPrintable(r rune) bool {
+	return r < 0x21 || r > 0x7e
+}
+
+// Return the client's IP from the request's remote address
+//
+func clientIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Write a structured access log line for a completed request.
+//  Nb. we deliberately log nothing from the request headers, so credentials never reach the logs.
+//
+func logRequest(req *http.Request, rec *responseRecorder, bytesIn int64, duration time.Duration) {
+	slog.LogAttrs(
+		req.Context(),
+		slog.LevelInfo,
+		"request",
+		slog.String("request_id", requestId(req)),
+		slog.String("role", rec.role),
+		slog.String("method", req.Method),
+		slog.String("key", req.URL.Path),
+		slog.Int("status", rec.status),
+		slog.Int64("bytes_in", bytesIn),
+		slog.Int64("bytes_out", rec.bytes),
+		slog.Float64("duration_ms", float64(duration.Microseconds()) / 1000),
+		slog.String("client_ip", clientIp(req)),
+	)
+}
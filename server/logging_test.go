@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Send log output to a buffer until the test ends
+//
+func captureLogs(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return buf
+}
+
+func TestAccessLog(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	h := New(testSilo(t, rw))
+	logs := captureLogs(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/some/key", strings.NewReader("data"))
+	req.SetBasicAuth("rw", testPassword)
+	req.Header.Set(HeaderRequestId, "given-id")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(HeaderRequestId) != "given-id" {
+		t.Fatalf("expected 200 & the given request id, got %d %q", w.Code, w.Header().Get(HeaderRequestId))
+	}
+
+	line := map[string]any{}
+	err := json.Unmarshal(logs.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("expected a single json log line, got %q: %v", logs.String(), err)
+	}
+	expect := map[string]any{
+		"msg": "request",
+		"request_id": "given-id",
+		"role": "rw",
+		"method": "POST",
+		"key": "/some/key",
+		"status": float64(200),
+		"bytes_in": float64(4),
+		"client_ip": "192.0.2.1",
+	}
+	for k, v := range expect {
+		if line[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, line[k])
+		}
+	}
+	if strings.Contains(logs.String(), req.Header.Get("Authorization")[len("Basic "):]) {
+		t.Errorf("expected credentials never to be logged, got %s", logs.String())
+	}
+}
+
+func TestChooseRequestId(t *testing.T) {
+	cases := []struct{
+		Given string
+		Kept bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"has space", false},
+		{"new\nline", false},
+		{strings.Repeat("x", maxRequestIdLength), true},
+		{strings.Repeat("x", maxRequestIdLength + 1), false},
+	}
+	for _, c := range cases {
+		id := chooseRequestId(c.Given)
+		if c.Kept && id != c.Given || !c.Kept && (id == c.Given || len(id) != 32) {
+			t.Errorf("%q: unexpected request id %q", c.Given, id)
+		}
+	}
+}
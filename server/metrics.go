@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/voidshard/silo/metrics"
+)
+
+var (
+	httpRequests = metrics.Default.NewCounterVec(
+		"silo_http_requests_total",
+		"HTTP requests served, by method & status code.",
+		"method", "status",
+	)
+	httpLatency = metrics.Default.NewHistogramVec(
+		"silo_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by method & status code.",
+		metrics.DefaultBuckets,
+		"method", "status",
+	)
+	httpBytesIn = metrics.Default.NewCounterVec(
+		"silo_http_request_bytes_total",
+		"Bytes read from HTTP request bodies, by method.",
+		"method",
+	)
+	httpBytesOut = metrics.Default.NewCounterVec(
+		"silo_http_response_bytes_total",
+		"Bytes written in HTTP response bodies, by method.",
+		"method",
+	)
+	authFailures = metrics.Default.NewCounterVec(
+		"silo_auth_failures_total",
+		"Requests that failed authentication.",
+	)
+)
+
+// methods we label metrics with, anything else is counted as "other" so clients can't create arbitrary labels
+//
+var knownMethods = map[string]bool{
+	http.MethodGet: true,
+	http.MethodHead: true,
+	http.MethodPost: true,
+	http.MethodPut: true,
+	http.MethodPatch: true,
+	http.MethodDelete: true,
+	http.MethodOptions: true,
+}
+
+// Wraps a ResponseWriter to record the status code & bytes written, along with the role that
+// made the request once it's known (for the access log; role ids aren't exposed in metrics).
+//
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes int64
+	role string
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Allows http.ResponseController to reach the underlying writer
+//
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Counts bytes read from a request body
+//
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// Note the role that made a request, for the access log. Middleware may have wrapped our writer in its own.
+//
+func setRequestRole(w http.ResponseWriter, role string) {
+	for {
+		rec, ok := w.(*responseRecorder)
+		if ok {
+			rec.role = role
+			return
+		}
+
+		wrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = wrapper.Unwrap()
+	}
+}
+
+// Wrap a handler, giving every request an id (passed back in X-Request-Id), recording metrics about
+// every request & writing an access log line for it.
+//
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := chooseRequestId(req.Header.Get(HeaderRequestId))
+		w.Header().Set(HeaderRequestId, id)
+		req = req.WithContext(context.WithValue(req.Context(), requestIdKey, id))
+
+		rec := &responseRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: req.Body}
+		req.Body = body
+
+		next.ServeHTTP(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		duration := time.Since(start)
+
+		method := req.Method
+		if !knownMethods[method] {
+			method = "other"
+		}
+		httpRequests.Inc(method, strconv.Itoa(rec.status))
+		httpLatency.Observe(duration.Seconds(), method, strconv.Itoa(rec.status))
+		httpBytesIn.Add(float64(body.bytes), method)
+		httpBytesOut.Add(float64(rec.bytes), method)
+
+		logRequest(req, rec, body.bytes, duration)
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	srv := testServer(t, testSilo(t, rw), WithHealthPaths("/_silo/metrics", "/_silo/live", "/_silo/ready"))
+
+	status, _ := request(t, srv, http.MethodGet, "/missing", "rw", nil)
+	if status != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", status)
+	}
+	request(t, srv, "BREW", "/missing", "rw", nil)
+	request(t, srv, http.MethodGet, "/missing", "nobody", nil)
+
+	status, body := request(t, srv, http.MethodGet, "/_silo/metrics", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("expected metrics without authentication, got %d", status)
+	}
+	for _, line := range []string{
+		`silo_http_requests_total{method="GET",status="404"}`,
+		`silo_http_requests_total{method="other",`,
+		`silo_http_request_duration_seconds_count{method="GET",status="404"}`,
+		`silo_auth_failures_total `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected metrics to include %s", line)
+		}
+	}
+	if strings.Contains(body, "role=") || strings.Contains(body, `"rw"`) || strings.Contains(body, "missing") {
+		t.Errorf("expected no roles or keys in metrics, got\n%s", body)
+	}
+
+	for _, path := range []string{"/_silo/live", "/_silo/ready"} {
+		status, _ = request(t, srv, http.MethodGet, path, "", nil)
+		if status != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", path, status)
+		}
+	}
+}
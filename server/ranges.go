@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"github.com/voidshard/silo"
+)
+
+const (
+	// requests for more ranges than this are served in full
+	maxRanges = 16
+
+	// objects larger than MaxDataBytes are read & sent in chunks of this size
+	getChunkBytes = 1024 * 1024
+)
+
+// A range of bytes requested from an object
+//
+type byteRange struct {
+	start int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start + r.length - 1, size)
+}
+
+// Serve a GET, honouring Range & If-Range headers, or a HEAD. The object is opened once & every read goes through
+// it, so a response is all of one version of the object even if it's replaced while being sent.
+//
+func (a *app) serveGet(w http.ResponseWriter, req *http.Request, suser *silo.Role, key string) {
+	obj, err := a.repo.Open(suser, key)
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+	defer obj.Close()
+	info := obj.Info()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", strconv.Quote(info.ETag))
+
+	if req.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var ranges []byteRange
+	if ifRangeMatches(req, info.ETag) {
+		ranges, err = parseRange(req.Header.Get("Range"), info.Size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			a.writeError(w, err)
+			return
+		}
+	}
+
+	if len(ranges) == 0 && info.Size <= int64(a.repo.MaxDataBytes()) {
+		data, err := obj.ReadRange(0, info.Size)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+
+		a.extendDeadlines(w, req, 0, int64(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+
+	// anything larger (ie. from a multipart upload) is sent a chunk at a time; the first chunk is read before any
+	// headers are sent, so that failing to read it can still be reported
+	send := ranges
+	if len(send) == 0 {
+		send = []byteRange{{start: 0, length: info.Size}}
+	}
+	total := int64(0)
+	for _, r := range send {
+		total += r.length
+	}
+
+	first, err := obj.ReadRange(send[0].start, min(send[0].length, getChunkBytes))
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+	a.extendDeadlines(w, req, 0, total)
+
+	if len(ranges) <= 1 {
+		status := http.StatusOK
+		if len(ranges) == 1 {
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", ranges[0].contentRange(info.Size))
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+		w.WriteHeader(status)
+		sendRange(w, obj, send[0], first)
+		return
+	}
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary=" + boundary)
+	w.WriteHeader(http.StatusPartialContent)
+
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(boundary)
+	for i, r := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/octet-stream"},
+			"Content-Range": {r.contentRange(info.Size)},
+		})
+		if err != nil {
+			return // the client has gone away
+		}
+		if i > 0 {
+			first = nil
+		}
+		err = sendRange(part, obj, r, first)
+		if err != nil {
+			return // too late to report it; the response is cut short
+		}
+	}
+	mw.Close()
+}
+
+// Write a range of obj to w, a chunk at a time. First, if given, is the range's first chunk, already read.
+//  Errors can only be returned, as the response has been started.
+//
+func sendRange(w io.Writer, obj *silo.Object, r byteRange, first []byte) error {
+	offset := r.start
+	end := r.start + r.length
+	if first != nil {
+		_, err := w.Write(first)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(first))
+	}
+
+	for offset < end {
+		data, err := obj.ReadRange(offset, min(end - offset, getChunkBytes))
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+	return nil
+}
+
+// Return if a Range header should be honoured given the request's If-Range (if any). We only give out strong
+// etags, so If-Range with a date never matches & the whole object is sent.
+//
+func ifRangeMatches(req *http.Request, etag string) bool {
+	ifRange := req.Header.Get("If-Range")
+	return ifRange == "" || ifRange == strconv.Quote(etag)
+}
+
+// Parse a Range header against an object of the given size, returning the satisfiable ranges.
+//  Returns no ranges if the header is missing, malformed or asks for more than we're willing to send, in which case
+//  the whole object should be sent. ErrRangeNotSatisfiable is returned if none of the ranges can be satisfied.
+//
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+
+	ranges := []byteRange{}
+	total := int64(0)
+	for _, s := range specs {
+		first, last, ok := strings.Cut(strings.TrimSpace(s), "-")
+		if !ok {
+			return nil, nil
+		}
+		first = strings.TrimSpace(first)
+		last = strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+
+			end := size - 1
+			if last != "" {
+				e, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || e < start {
+					return nil, nil
+				}
+				if e < end {
+					end = e
+				}
+			}
+			if start >= size {
+				continue // unsatisfiable, but others may not be
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+
+		if r.length > 0 {
+			ranges = append(ranges, r)
+			total += r.length
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%w: %s", silo.ErrRangeNotSatisfiable, header)
+	}
+	if total > size {
+		// overlapping ranges asking for more than the whole object, just send the object
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+func randomBoundary() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
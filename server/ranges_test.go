@@ -0,0 +1,192 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct{
+		Header string
+		Ranges []byteRange
+		Unsatisfiable bool
+	}{
+		{"", nil, false},
+		{"bytes=0-9", []byteRange{{0, 10}}, false},
+		{"bytes=90-", []byteRange{{90, 10}}, false},
+		{"bytes=-5", []byteRange{{95, 5}}, false},
+		{"bytes=-500", []byteRange{{0, 100}}, false},
+		{"bytes=95-200", []byteRange{{95, 5}}, false},
+		{"bytes=0-0, 10-19", []byteRange{{0, 1}, {10, 10}}, false},
+		{"bytes=200-300, 0-0", []byteRange{{0, 1}}, false},
+		{"bytes=100-", nil, true},
+		{"bytes=9-0", nil, false},
+		{"bytes=a-b", nil, false},
+		{"items=0-9", nil, false},
+		{"bytes=0-99, 0-99", nil, false},
+		{"bytes=" + strings.Repeat("0-0,", maxRanges) + "0-0", nil, false},
+	}
+	for _, c := range cases {
+		ranges, err := parseRange(c.Header, 100)
+		if c.Unsatisfiable != (err != nil) {
+			t.Errorf("%q: expected unsatisfiable %v, got %v", c.Header, c.Unsatisfiable, err)
+			continue
+		}
+		if len(ranges) != len(c.Ranges) {
+			t.Errorf("%q: expected %v, got %v", c.Header, c.Ranges, ranges)
+			continue
+		}
+		for i := range ranges {
+			if ranges[i] != c.Ranges[i] {
+				t.Errorf("%q: expected %v, got %v", c.Header, c.Ranges, ranges)
+			}
+		}
+	}
+}
+
+// Fetch a key with the given headers, returning the response (whose body has been read into the returned string)
+//
+func getWith(t *testing.T, url string, header ...string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("rw", testPassword)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestRangeRequests(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	repo := testSilo(t, rw)
+	srv := testServer(t, repo)
+
+	data := strings.Repeat("0123456789", 20000) // spans several chunks
+	err := repo.Store(rw, "/a", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/a"
+
+	resp, body := getWith(t, url)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || body != data || etag == "" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("expected the whole object with an etag, got %d %d bytes %q", resp.StatusCode, len(body), etag)
+	}
+
+	resp, body = getWith(t, url, "Range", "bytes=65530-65545")
+	if resp.StatusCode != http.StatusPartialContent || body != data[65530:65546] || resp.Header.Get("Content-Range") != "bytes 65530-65545/200000" {
+		t.Fatalf("expected a range across chunks, got %d %q %q", resp.StatusCode, body, resp.Header.Get("Content-Range"))
+	}
+
+	resp, body = getWith(t, url, "Range", "bytes=300000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */200000" {
+		t.Fatalf("expected 416, got %d %s", resp.StatusCode, body)
+	}
+
+	// If-Range must match the current etag for the range to be honoured
+	resp, body = getWith(t, url, "Range", "bytes=0-9", "If-Range", etag)
+	if resp.StatusCode != http.StatusPartialContent || body != data[:10] {
+		t.Fatalf("expected the range for a matching If-Range, got %d", resp.StatusCode)
+	}
+	resp, body = getWith(t, url, "Range", "bytes=0-9", "If-Range", `"stale"`)
+	if resp.StatusCode != http.StatusOK || body != data {
+		t.Fatalf("expected the whole object for a stale If-Range, got %d", resp.StatusCode)
+	}
+
+	resp, body = getWith(t, url, "Range", "bytes=0-4, 199995-")
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected multiple ranges, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, expect := range []string{data[:5], data[199995:]} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(part)
+		if string(got) != expect {
+			t.Errorf("expected part %q, got %q", expect, got)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodHead, url, nil)
+	req.SetBasicAuth("rw", testPassword)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Length") != strconv.Itoa(len(data)) {
+		t.Fatalf("expected HEAD to give the size, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestGetStreamsLargeObjects(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	c := testConfig(t, rw)
+	c.Misc.MaxDataBytes = 1000000
+	repo := openSilo(t, c)
+	srv := testServer(t, repo)
+
+	// larger than MaxDataBytes & a few chunks, so it can only be written as a multipart upload
+	data := strings.Repeat("0123456789", 350000)
+	id, err := repo.CreateUpload(rw, "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i*c.Misc.MaxDataBytes < len(data); i++ {
+		part := data[i*c.Misc.MaxDataBytes:min(len(data), (i+1)*c.Misc.MaxDataBytes)]
+		_, err = repo.UploadPart(rw, "/big", id, i+1, []byte(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = repo.CompleteUpload(rw, "/big", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/big"
+
+	resp, body := getWith(t, url)
+	if resp.StatusCode != http.StatusOK || body != data || resp.Header.Get("Content-Length") != strconv.Itoa(len(data)) {
+		t.Fatalf("expected the whole object, got %d %d bytes", resp.StatusCode, len(body))
+	}
+
+	start := getChunkBytes - 5
+	resp, body = getWith(t, url, "Range", "bytes=" + strconv.Itoa(start) + "-" + strconv.Itoa(start + 2*getChunkBytes))
+	if resp.StatusCode != http.StatusPartialContent || body != data[start:start + 2*getChunkBytes + 1] {
+		t.Fatalf("expected a range across chunks, got %d %d bytes", resp.StatusCode, len(body))
+	}
+
+	resp, body = getWith(t, url, "Range", "bytes=0-4, 2000000-")
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || err != nil {
+		t.Fatalf("expected multiple ranges, got %d %v", resp.StatusCode, err)
+	}
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, expect := range []string{data[:5], data[2000000:]} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(part)
+		if string(got) != expect {
+			t.Errorf("expected a part of %d bytes, got %d", len(expect), len(got))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"encoding/json"
+	"strings"
+	"github.com/voidshard/silo"
+)
+
+// A role as sent to / from the admin API. Password hashes are never sent out.
+//
+type roleMessage struct {
+	Id string
+	Password string `json:",omitempty"`
+	PasswordHash string `json:",omitempty"`
+
+	CanGet bool
+	CanPut bool
+	CanRm bool
+	CanAppend bool
+	CanAdmin bool
+	Disabled bool
+
+	MaxBytes int64
+	MaxObjects int64
+}
+
+func toRoleMessage(r *silo.Role) *roleMessage {
+	return &roleMessage{
+		Id: r.Id,
+		CanGet: r.CanGet,
+		CanPut: r.CanPut,
+		CanRm: r.CanRm,
+		CanAppend: r.CanAppend,
+		CanAdmin: r.CanAdmin,
+		Disabled: r.Disabled,
+		MaxBytes: r.MaxBytes,
+		MaxObjects: r.MaxObjects,
+	}
+}
+
+// Build a silo role from a message. The password (if any) is hashed, a given hash is used as is.
+//
+func (m *roleMessage) toRole() (*silo.Role, error) {
+	r := &silo.Role{Id: m.Id}
+	var err error
+
+	if m.PasswordHash != "" {
+		r, err = silo.NewRoleFromHash(m.Id, m.PasswordHash)
+	} else if m.Password != "" {
+		r, err = silo.NewRole(m.Id, m.Password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.CanGet = m.CanGet
+	r.CanPut = m.CanPut
+	r.CanRm = m.CanRm
+	r.CanAppend = m.CanAppend
+	r.CanAdmin = m.CanAdmin
+	r.Disabled = m.Disabled
+	r.MaxBytes = m.MaxBytes
+	r.MaxObjects = m.MaxObjects
+	return r, nil
+}
+
+// Serve the role management API.
+//
+//  GET    /_silo/roles              list roles
+//  POST   /_silo/roles              create a role (a random password is generated if none is given)
+//  GET    /_silo/roles/<id>         fetch a role
+//  PUT    /_silo/roles/<id>         update a role's permissions, limits or disabled state
+//  DELETE /_silo/roles/<id>         delete a role
+//  POST   /_silo/roles/<id>/password  rotate a role's password (a random password is generated if none is given)
+//
+// Only roles with the admin permission may use any of these; silo itself enforces that.
+//
+func (a *app) serveRoles(w http.ResponseWriter, req *http.Request) {
+	suser := a.authenticate(w, req)
+	if suser == nil {
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, UrlRoles), "/")
+	parts := strings.Split(path, "/")
+
+	if path == "" {
+		switch req.Method {
+		case http.MethodGet:
+			roles, err := a.repo.Roles(suser)
+			if err != nil {
+				a.writeError(w, err)
+				return
+			}
+
+			result := []*roleMessage{}
+			for _, r := range roles {
+				result = append(result, toRoleMessage(r))
+			}
+			a.writeJson(w, http.StatusOK, result)
+		case http.MethodPost:
+			a.createRole(w, req, suser)
+		default:
+			a.writeMethodForbidden(w, req)
+		}
+		return
+	}
+
+	id := parts[0]
+	if len(parts) == 2 && parts[1] == "password" && req.Method == http.MethodPost {
+		a.rotatePassword(w, req, suser, id)
+		return
+	} else if len(parts) != 1 {
+		a.writeError(w, fmt.Errorf("%w: %s", silo.ErrNotFound, req.URL.Path))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		r, err := a.repo.Role(suser, id)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		a.writeJson(w, http.StatusOK, toRoleMessage(r))
+	case http.MethodPut:
+		msg := &roleMessage{}
+		err := json.NewDecoder(req.Body).Decode(msg)
+		if err != nil {
+			a.writeError(w, fmt.Errorf("%w: %v", silo.ErrBadRequest, err))
+			return
+		}
+		msg.Id = id
+
+		r, err := msg.toRole()
+		if err == nil {
+			err = a.repo.UpdateRole(suser, r)
+		}
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		a.writeJson(w, http.StatusOK, toRoleMessage(r))
+	case http.MethodDelete:
+		err := a.repo.DeleteRole(suser, id)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Ok"))
+	default:
+		a.writeMethodForbidden(w, req)
+	}
+}
+
+// Create a new role. If no password is given we generate one and return it, once.
+//
+func (a *app) createRole(w http.ResponseWriter, req *http.Request, suser *silo.Role) {
+	msg := &roleMessage{}
+	err := json.NewDecoder(req.Body).Decode(msg)
+	if err != nil {
+		a.writeError(w, fmt.Errorf("%w: %v", silo.ErrBadRequest, err))
+		return
+	}
+
+	generated := msg.Password == "" && msg.PasswordHash == ""
+	if generated {
+		msg.Password, err = silo.RandomPassword()
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+	}
+
+	r, err := msg.toRole()
+	if err == nil {
+		err = a.repo.CreateRole(suser, r)
+	}
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	result := toRoleMessage(r)
+	if generated {
+		result.Password = msg.Password
+	}
+	a.writeJson(w, http.StatusCreated, result)
+}
+
+// Set a role's password, returning the new password if we generated it.
+//
+func (a *app) rotatePassword(w http.ResponseWriter, req *http.Request, suser *silo.Role, id string) {
+	msg := &roleMessage{}
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(req.Body).Decode(msg)
+		if err != nil {
+			a.writeError(w, fmt.Errorf("%w: %v", silo.ErrBadRequest, err))
+			return
+		}
+	}
+
+	password, err := a.repo.RotatePassword(suser, id, msg.Password)
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	result := &roleMessage{Id: id}
+	if msg.Password == "" {
+		result.Password = password
+	}
+	a.writeJson(w, http.StatusOK, result)
+}
@@ -0,0 +1,433 @@
+/*
+Package server is silo's HTTP API, as an http.Handler that can be mounted in any server or tested with httptest.
+
+	repo, err := silo.NewSilo(config)
+	...
+	http.Handle("/store/", server.New(repo, server.WithPrefix("/store")))
+
+The silo binary (cmd/silo) serves this on its listeners, adding config, TLS & reloading.
+*/
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"fmt"
+	"github.com/voidshard/silo"
+	"github.com/voidshard/silo/metrics"
+	"strings"
+	"slices"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const (
+	UrlStatus = "/"
+
+	// paths under here are reserved for the API, rather than being keys
+	UrlApi = "/_silo/"
+	UrlUsage = UrlApi + "usage"
+	UrlRoles = UrlApi + "roles"
+	UrlAudit = UrlApi + "audit"
+	UrlBatch = UrlApi + "batch"
+	UrlList = UrlApi + "list"
+
+	// server side copy & move, as in WebDAV; the destination key is given in the Destination header
+	MethodCopy = "COPY"
+	MethodMove = "MOVE"
+
+	// groups of handlers that can be served (see WithHandlers)
+	HandlerData = "data" // reading & writing keys, usage
+	HandlerAdmin = "admin" // role management & the audit log
+	HandlerMetrics = "metrics" // metrics & health checks
+)
+
+type app struct {
+	repo *silo.Silo
+
+	// where metrics & health checks are served, if anywhere
+	metricsPath string
+	livenessPath string
+	readinessPath string
+
+	// read & write deadlines, extended for large transfers
+	readTimeout time.Duration
+	writeTimeout time.Duration
+	minTransferRate int64
+
+	// served under this path, which is removed before routing
+	prefix string
+
+	// which handler groups are served, anything else is not found
+	groups []string
+
+	// tried in order until one recognises the request's credentials
+	auth []Authenticator
+
+	// wrapped around the api, first given outermost
+	middleware []func(http.Handler) http.Handler
+}
+
+type Option func(*app)
+
+// Serve under the given path prefix, eg. "/store", so the key /a is at /store/a. The prefix is removed
+// before routing & requests outside it are not found.
+//
+func WithPrefix(prefix string) Option {
+	return func(a *app) {
+		a.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// Serve only the given handler groups (HandlerData, HandlerAdmin or HandlerMetrics); the default is all of
+// them.
+//
+func WithHandlers(groups ...string) Option {
+	return func(a *app) {
+		a.groups = groups
+	}
+}
+
+// Authenticate requests with the given providers, tried in order until one recognises the request's
+// credentials. The default is BasicAuth against the silo's roles.
+//
+func WithAuth(providers ...Authenticator) Option {
+	return func(a *app) {
+		a.auth = providers
+	}
+}
+
+// Wrap the api in the given middleware, the first given outermost. Middleware sees requests after the prefix
+// is removed & they're given a request id, but before they're authenticated.
+//
+func WithMiddleware(middleware ...func(http.Handler) http.Handler) Option {
+	return func(a *app) {
+		a.middleware = append(a.middleware, middleware...)
+	}
+}
+
+// Serve metrics & the liveness & readiness checks at the given paths, without authentication. An empty path
+// isn't served. The defaults are none, though UrlStatus always answers liveness checks.
+//
+func WithHealthPaths(metricsPath, livenessPath, readinessPath string) Option {
+	return func(a *app) {
+		a.metricsPath = metricsPath
+		a.livenessPath = livenessPath
+		a.readinessPath = readinessPath
+	}
+}
+
+// Extend the server's read & write timeouts for large transfers, so they can be sent at minTransferRate bytes per
+// second. The timeouts should match those of the http.Server; a zero timeout or rate is never extended.
+//
+func WithTransferTimeouts(readTimeout, writeTimeout time.Duration, minTransferRate int64) Option {
+	return func(a *app) {
+		a.readTimeout = readTimeout
+		a.writeTimeout = writeTimeout
+		a.minTransferRate = minTransferRate
+	}
+}
+
+// Return a handler serving silo's http api for repo. Every request is given an id (passed back in X-Request-Id),
+// counted in metrics.Default & written to the access log.
+//
+func New(repo *silo.Silo, opts ...Option) http.Handler {
+	a := &app{
+		repo: repo,
+		groups: []string{HandlerData, HandlerAdmin, HandlerMetrics},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if len(a.auth) == 0 {
+		a.auth = []Authenticator{BasicAuth(repo)}
+	}
+
+	var h http.Handler = a
+	for i := len(a.middleware) - 1; i >= 0; i-- {
+		h = a.middleware[i](h)
+	}
+	return instrumentHandler(a.stripPrefix(h))
+}
+
+// Remove our prefix from requests, before passing them on
+//
+func (a *app) stripPrefix(next http.Handler) http.Handler {
+	if a.prefix == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Path, a.prefix)
+		if len(path) == len(req.URL.Path) || !strings.HasPrefix(path, "/") {
+			a.writeError(w, fmt.Errorf("%w: %s", silo.ErrNotFound, req.URL.Path))
+			return
+		}
+
+		r := new(http.Request)
+		*r = *req
+		r.URL = new(url.URL)
+		*r.URL = *req.URL
+		r.URL.Path = path
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serve metrics in prometheus text format
+//
+func (a *app) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	metrics.Default.Handler().ServeHTTP(w, req)
+}
+
+// Serve a liveness check; if we can answer, we're alive
+//
+func (a *app) serveLiveness(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Ok"))
+}
+
+// Serve a readiness check; we're ready if storage is writable
+//
+func (a *app) serveReadiness(w http.ResponseWriter, req *http.Request) {
+	err := a.repo.Ready()
+	if err != nil {
+		requestLogger(req).Warn("readiness check failed", "error", err)
+		a.writeJson(w, http.StatusServiceUnavailable, &errorMessage{Code: silo.ErrorCode(err), Message: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Ok"))
+}
+
+// Do the actual work of the request
+//  - We'll first authenticate & then authorize the client & request.
+//
+func (a *app) serveRequest(w http.ResponseWriter, req *http.Request) {
+	suser := a.authenticate(w, req)
+	if suser == nil {
+		return // no idea who they are
+	}
+
+	if isUploadRequest(req) {
+		a.serveUpload(w, req, suser)
+		return
+	}
+
+	authorized := a.authorize(w, req, suser)
+	if !authorized {
+		return // user / action combination not permitted -- we don't need to attempt anything
+	}
+
+	action := req.Method
+	data := []byte("Ok")
+	key := req.URL.Path
+	var err error
+
+	if action == http.MethodDelete {
+		err = a.repo.Remove(suser, key)
+	} else if action == http.MethodPost || action == http.MethodPut {
+		var in []byte
+		in, err = a.readBody(w, req)
+		if err == nil && action == http.MethodPost {
+			// checked before reading the body, but someone else may have created it since
+			err = a.repo.Create(suser, key, in)
+		} else if err == nil {
+			err = a.repo.Store(suser, key, in)
+		}
+	} else if action == MethodCopy || action == MethodMove {
+		var dst string
+		dst, err = a.destination(req)
+		if err == nil && action == MethodCopy {
+			err = a.repo.Copy(suser, key, dst)
+		} else if err == nil {
+			err = a.repo.Rename(suser, key, dst)
+		}
+	} else if action == http.MethodPatch {
+		var in []byte
+		in, err = a.readBody(w, req)
+		if err == nil {
+			err = a.repo.Append(suser, key, in)
+		}
+	} else if action == http.MethodGet || action == http.MethodHead {
+		a.serveGet(w, req, suser, key)
+		return
+	}
+
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Return the destination key of a copy or move, from the Destination header. As in WebDAV this may be a
+// full URL, of which we only use the path. It's under our prefix, like the request's own path.
+//
+func (a *app) destination(req *http.Request) (string, error) {
+	given := req.Header.Get("Destination")
+	if given == "" {
+		return "", fmt.Errorf("%w: Destination header is required", silo.ErrBadRequest)
+	}
+
+	u, err := url.Parse(given)
+	if err != nil || u.Path == "" {
+		return "", fmt.Errorf("%w: invalid Destination %s", silo.ErrBadRequest, given)
+	}
+
+	path := u.Path
+	if a.prefix != "" {
+		path = strings.TrimPrefix(u.Path, a.prefix)
+		if len(path) == len(u.Path) || !strings.HasPrefix(path, "/") {
+			return "", fmt.Errorf("%w: Destination must be under %s", silo.ErrBadRequest, a.prefix)
+		}
+	}
+	if strings.HasPrefix(path, UrlApi) {
+		return "", fmt.Errorf("%w: paths under %s can't be used as keys", silo.ErrBadRequest, UrlApi)
+	}
+	return path, nil
+}
+
+// Serve current storage usage & quotas, as visible to the authenticated user
+//
+func (a *app) serveUsage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		a.writeMethodForbidden(w, req)
+		return
+	}
+
+	suser := a.authenticate(w, req)
+	if suser == nil {
+		return
+	}
+
+	a.writeJson(w, http.StatusOK, a.repo.Usage(suser))
+}
+
+// A page of keys, as returned by /_silo/list
+//
+type listMessage struct {
+	Keys []string
+
+	// there are more keys; fetch them with after set to the last key here
+	More bool
+}
+
+// List keys, a page at a time
+//
+//  GET /_silo/list?prefix=/logs/&after=/logs/b&limit=100
+//
+func (a *app) serveList(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		a.writeMethodForbidden(w, req)
+		return
+	}
+
+	suser := a.authenticate(w, req)
+	if suser == nil {
+		return
+	}
+
+	q := req.URL.Query()
+	limit := 0
+	if q.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil {
+			a.writeError(w, fmt.Errorf("%w: limit must be an integer", silo.ErrBadRequest))
+			return
+		}
+	}
+
+	keys, more, err := a.repo.List(suser, q.Get("prefix"), q.Get("after"), limit)
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+	a.writeJson(w, http.StatusOK, &listMessage{Keys: keys, More: more})
+}
+
+// Write out the given struct as json
+//
+func (a *app) writeJson(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		a.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Reject a request with a method we don't support on this path
+//
+func (a *app) writeMethodForbidden(w http.ResponseWriter, req *http.Request) {
+	a.writeError(w, fmt.Errorf("%w: method %s", silo.ErrForbidden, req.Method))
+}
+
+// Return which handler group serves the given path
+//
+func (a *app) handlerGroup(path string) string {
+	switch {
+	case path == UrlStatus, path == a.livenessPath, path == a.readinessPath, path == a.metricsPath:
+		return HandlerMetrics
+	case path == UrlAudit, path == UrlRoles, strings.HasPrefix(path, UrlRoles + "/"):
+		return HandlerAdmin
+	}
+	return HandlerData
+}
+
+// Main serve function
+// Required to implement http.Handler
+//
+func (a *app) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !slices.Contains(a.groups, a.handlerGroup(req.URL.Path)) {
+		a.writeError(w, fmt.Errorf("%w: %s", silo.ErrNotFound, req.URL.Path))
+		return
+	}
+
+	switch req.URL.Path {
+	case UrlStatus, a.livenessPath, a.readinessPath, a.metricsPath:
+		if req.Method != http.MethodGet {
+			a.writeMethodForbidden(w, req)
+			return
+		}
+	}
+
+	if req.URL.Path == UrlStatus || req.URL.Path == a.livenessPath {
+		a.serveLiveness(w, req)
+		return
+	} else if req.URL.Path == a.readinessPath {
+		a.serveReadiness(w, req)
+		return
+	} else if req.URL.Path == a.metricsPath {
+		a.serveMetrics(w, req)
+		return
+	} else if req.URL.Path == UrlUsage {
+		a.serveUsage(w, req)
+		return
+	} else if req.URL.Path == UrlList {
+		a.serveList(w, req)
+		return
+	} else if req.URL.Path == UrlBatch {
+		a.serveBatch(w, req)
+		return
+	} else if req.URL.Path == UrlAudit {
+		a.serveAudit(w, req)
+		return
+	} else if req.URL.Path == UrlRoles || strings.HasPrefix(req.URL.Path, UrlRoles + "/") {
+		a.serveRoles(w, req)
+		return
+	} else if strings.HasPrefix(req.URL.Path, UrlApi) {
+		a.writeError(w, fmt.Errorf("%w: %s", silo.ErrNotFound, req.URL.Path))
+		return
+	}
+
+	a.serveRequest(w, req)
+	return
+}
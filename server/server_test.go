@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/voidshard/silo"
+)
+
+const (
+	testEncryptionKey = "a key used only by tests, long enough to be accepted"
+	testPassword = "pw"
+)
+
+// Build a role with the given permissions & testPassword, hashed cheaply.
+//
+func testRole(id string, get, put, rm bool) *silo.Role {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	r, err := silo.NewRoleFromHash(id, string(hash))
+	if err != nil {
+		panic(err)
+	}
+	r.CanGet = get
+	r.CanPut = put
+	r.CanRm = rm
+	return r
+}
+
+// Return a config for a silo stored in a fresh temp dir, with the given roles.
+//
+func testConfig(t *testing.T, roles ...*silo.Role) *silo.Config {
+	c := silo.NewConfig()
+	c.RemoveDefaultRoles()
+	c.Misc.EncryptionKey = testEncryptionKey
+	c.Store.Location = t.TempDir()
+	for _, r := range roles {
+		c.User[r.Id] = r
+	}
+	return c
+}
+
+// Open a silo with the given config, closed when the test ends.
+//
+func openSilo(t *testing.T, c *silo.Config) *silo.Silo {
+	repo, err := silo.NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// Open a silo stored in a fresh temp dir with the given roles, closed when the test ends.
+//
+func testSilo(t *testing.T, roles ...*silo.Role) *silo.Silo {
+	return openSilo(t, testConfig(t, roles...))
+}
+
+// Serve repo over http until the test ends.
+//
+func testServer(t *testing.T, repo *silo.Silo, opts ...Option) *httptest.Server {
+	srv := httptest.NewServer(New(repo, opts...))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Make a request as the given role (or anonymously, if user is empty), returning the status & body.
+//
+func request(t *testing.T, srv *httptest.Server, method, path, user string, body io.Reader, header ...string) (int, string) {
+	req, err := http.NewRequest(method, srv.URL + path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "" {
+		req.SetBasicAuth(user, testPassword)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestDataEndpoints(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	reader := testRole("reader", true, false, false)
+	writer := testRole("writer", false, true, false)
+	srv := testServer(t, testSilo(t, rw, reader, writer))
+
+	cases := []struct{
+		Method string
+		Path string
+		User string
+		Body string
+		Status int
+		Expect string
+	}{
+		{http.MethodPost, "/a", "", "one", http.StatusUnauthorized, ""},
+		{http.MethodPost, "/a", "reader", "one", http.StatusForbidden, ""},
+		{http.MethodPut, "/a", "rw", "one", http.StatusNotFound, ""}, // PUT only replaces
+		{http.MethodPost, "/a", "writer", "one", http.StatusOK, ""},
+		{http.MethodPost, "/a", "writer", "two", http.StatusForbidden, ""}, // can't overwrite
+		{http.MethodPost, "/a", "rw", "two", http.StatusConflict, ""}, // should use PUT
+		{http.MethodGet, "/a", "writer", "", http.StatusForbidden, ""},
+		{http.MethodGet, "/a", "reader", "", http.StatusOK, "one"},
+		{http.MethodPut, "/a", "rw", "two", http.StatusOK, ""},
+		{http.MethodGet, "/a", "reader", "", http.StatusOK, "two"},
+		{http.MethodDelete, "/a", "reader", "", http.StatusForbidden, ""},
+		{http.MethodDelete, "/a", "rw", "", http.StatusOK, ""},
+		{http.MethodGet, "/a", "reader", "", http.StatusNotFound, ""},
+		{http.MethodDelete, "/a", "rw", "", http.StatusNotFound, ""},
+	}
+	for i, c := range cases {
+		status, body := request(t, srv, c.Method, c.Path, c.User, strings.NewReader(c.Body))
+		if status != c.Status || c.Expect != "" && body != c.Expect {
+			t.Errorf("%d %s %s as %q: expected %d %q, got %d %q", i, c.Method, c.Path, c.User, c.Status, c.Expect, status, body)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	repo := testSilo(t, rw)
+	srv := testServer(t, repo, WithPrefix("/store/"))
+
+	status, _ := request(t, srv, http.MethodPost, "/store/a", "rw", strings.NewReader("one"))
+	if status != http.StatusOK {
+		t.Fatalf("expected to write under the prefix, got %d", status)
+	}
+	data, err := repo.Get(rw, "/a")
+	if err != nil || string(data) != "one" {
+		t.Fatalf("expected the prefix to be removed from the key, got %q %v", data, err)
+	}
+
+	paths := []struct{
+		Path string
+		Status int
+	}{
+		{"/store/a", http.StatusOK},
+		{"/a", http.StatusNotFound},
+		{"/storea", http.StatusNotFound},
+		{"/store/_silo/usage", http.StatusOK},
+		{"/_silo/usage", http.StatusNotFound},
+	}
+	for _, p := range paths {
+		status, body := request(t, srv, http.MethodGet, p.Path, "rw", nil)
+		if status != p.Status {
+			t.Errorf("%s: expected %d, got %d %s", p.Path, p.Status, status, body)
+		}
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	repo := testSilo(t, rw)
+
+	// a token in a header, falling back to basic auth without one
+	token := AuthenticatorFunc(func(req *http.Request) (*silo.Role, error) {
+		switch req.Header.Get("X-Token") {
+		case "":
+			return nil, nil
+		case "secret":
+			return rw, nil
+		}
+		return nil, fmt.Errorf("%w: bad token", silo.ErrUnauthorized)
+	})
+	srv := testServer(t, repo, WithAuth(token, BasicAuth(repo)))
+
+	err := repo.Store(rw, "/a", []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{
+		Name string
+		User string
+		Header []string
+		Status int
+	}{
+		{"token", "", []string{"X-Token", "secret"}, http.StatusOK},
+		{"bad token", "", []string{"X-Token", "wrong"}, http.StatusUnauthorized},
+		{"a bad token isn't rescued by basic auth", "rw", []string{"X-Token", "wrong"}, http.StatusUnauthorized},
+		{"basic auth", "rw", nil, http.StatusOK},
+		{"unknown user", "nobody", nil, http.StatusUnauthorized},
+		{"no credentials", "", nil, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		status, body := request(t, srv, http.MethodGet, "/a", c.User, nil, c.Header...)
+		if status != c.Status {
+			t.Errorf("%s: expected %d, got %d %s", c.Name, c.Status, status, body)
+		}
+	}
+
+	// without basic auth, its credentials aren't understood
+	srv = testServer(t, repo, WithAuth(token))
+	status, _ := request(t, srv, http.MethodGet, "/a", "rw", nil)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected basic auth to be replaced, got %d", status)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	repo := testSilo(t, rw)
+
+	seen := []string{}
+	var lock sync.Mutex
+	record := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				lock.Lock()
+				seen = append(seen, name + " " + req.URL.Path)
+				lock.Unlock()
+				if req.Header.Get("X-Block") == name {
+					w.WriteHeader(http.StatusTeapot)
+					return
+				}
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	srv := testServer(t, repo, WithPrefix("/store"), WithMiddleware(record("outer")), WithMiddleware(record("inner")))
+
+	status, _ := request(t, srv, http.MethodPost, "/store/a", "rw", strings.NewReader("one"))
+	if status != http.StatusOK {
+		t.Fatalf("expected the request through the middleware, got %d", status)
+	}
+	if strings.Join(seen, ", ") != "outer /a, inner /a" {
+		t.Fatalf("expected the middleware in order, after the prefix is removed, got %v", seen)
+	}
+
+	// middleware can answer requests itself, before authentication
+	seen = nil
+	status, _ = request(t, srv, http.MethodGet, "/store/a", "", nil, "X-Block", "outer")
+	if status != http.StatusTeapot || len(seen) != 1 {
+		t.Fatalf("expected the outer middleware to answer, got %d %v", status, seen)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+	"github.com/voidshard/silo"
+)
+
+// Read the body of an upload, refusing anything over MaxDataBytes without reading all of it.
+//
+func (a *app) readBody(w http.ResponseWriter, req *http.Request) ([]byte, error) {
+	return a.readLimited(w, req, int64(a.repo.MaxDataBytes()), "maxdatabytes")
+}
+
+// Read the body of a request, refusing anything over max bytes without reading all of it. The limit is named
+// in the error.
+//
+func (a *app) readLimited(w http.ResponseWriter, req *http.Request, max int64, limit string) ([]byte, error) {
+	if req.ContentLength > max {
+		return nil, fmt.Errorf("%w: %s is currently %d", silo.ErrTooLarge, limit, max)
+	}
+
+	// the client may be sending up to max bytes, so give them time to do so
+	size := req.ContentLength
+	if size < 0 {
+		size = max
+	}
+	a.extendDeadlines(w, req, size, 0)
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, max))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, fmt.Errorf("%w: %s is currently %d", silo.ErrTooLarge, limit, max)
+	}
+	return data, err
+}
+
+// Extend the connection's read & write deadlines so that the given number of bytes can be read & written at
+// MinTransferRate, on top of the configured timeouts. Deadlines are only ever set if the matching timeout is.
+//  The write deadline runs from when the request arrived, so it also allows for reading the request body.
+//
+func (a *app) extendDeadlines(w http.ResponseWriter, req *http.Request, readBytes, writeBytes int64) {
+	if a.minTransferRate <= 0 {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	now := time.Now()
+	if a.readTimeout > 0 && readBytes > 0 {
+		err := rc.SetReadDeadline(now.Add(a.readTimeout + a.transferTime(readBytes)))
+		if err != nil {
+			requestLogger(req).Debug("unable to extend read deadline", "error", err)
+		}
+	}
+	if a.writeTimeout > 0 && readBytes + writeBytes > 0 {
+		err := rc.SetWriteDeadline(now.Add(a.writeTimeout + a.transferTime(readBytes + writeBytes)))
+		if err != nil {
+			requestLogger(req).Debug("unable to extend write deadline", "error", err)
+		}
+	}
+}
+
+// How long it takes to send size bytes at MinTransferRate
+//
+func (a *app) transferTime(size int64) time.Duration {
+	return time.Duration(float64(size) / float64(a.minTransferRate) * float64(time.Second))
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends its data without saying how long it is
+//
+type unsizedReader struct {
+	io.Reader
+}
+
+func TestBodyLimits(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	c := testConfig(t, rw)
+	c.Misc.MaxDataBytes = 10
+	srv := testServer(t, openSilo(t, c))
+
+	cases := []struct{
+		Name string
+		Body io.Reader
+		Status int
+	}{
+		{"at the limit", strings.NewReader("0123456789"), http.StatusOK},
+		{"over the limit", strings.NewReader("0123456789x"), http.StatusRequestEntityTooLarge},
+		{"over the limit, without a length", unsizedReader{strings.NewReader("0123456789x")}, http.StatusRequestEntityTooLarge},
+		{"under the limit, without a length", unsizedReader{strings.NewReader("012")}, http.StatusOK},
+	}
+	for i, c := range cases {
+		key := "/" + string(rune('a' + i))
+		status, body := request(t, srv, http.MethodPost, key, "rw", c.Body)
+		if status != c.Status {
+			t.Errorf("%s: expected %d, got %d %s", c.Name, c.Status, status, body)
+		}
+		if status == http.StatusRequestEntityTooLarge && !strings.Contains(body, "maxdatabytes") {
+			t.Errorf("%s: expected the limit to be named, got %s", c.Name, body)
+		}
+	}
+}
+
+func TestTransferTime(t *testing.T) {
+	a := &app{minTransferRate: 1024}
+	cases := map[int64]time.Duration{
+		0: 0,
+		512: 500 * time.Millisecond,
+		10 * 1024: 10 * time.Second,
+	}
+	for size, expect := range cases {
+		if a.transferTime(size) != expect {
+			t.Errorf("%d bytes: expected %v, got %v", size, expect, a.transferTime(size))
+		}
+	}
+}
+
+func TestDeadlinesExtended(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	repo := testSilo(t, rw)
+	err := repo.Store(rw, "/a", []byte(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the response is only sent once the handler returns, after the write timeout
+	slow := WithMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req)
+			time.Sleep(100 * time.Millisecond)
+		})
+	})
+
+	cases := []struct{
+		Rate int64
+		Ok bool
+	}{
+		{0, false}, // never extended
+		{10, true}, // 100 bytes at 10 bytes per second, so 10s more
+	}
+	for _, c := range cases {
+		srv := httptest.NewUnstartedServer(New(repo, slow, WithTransferTimeouts(time.Second, 50 * time.Millisecond, c.Rate)))
+		srv.Config.WriteTimeout = 50 * time.Millisecond
+		srv.Start()
+		defer srv.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL + "/a", nil)
+		req.SetBasicAuth("rw", testPassword)
+		resp, err := srv.Client().Do(req)
+		if err == nil {
+			var data []byte
+			data, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && len(data) != 100 {
+				t.Errorf("rate %d: expected 100 bytes, got %d", c.Rate, len(data))
+			}
+		}
+		if c.Ok != (err == nil) {
+			t.Errorf("rate %d: expected ok %v, got %v", c.Rate, c.Ok, err)
+		}
+	}
+}
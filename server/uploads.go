@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"github.com/voidshard/silo"
+)
+
+// Response to starting a multipart upload
+//
+type uploadMessage struct {
+	Key string
+	UploadId string
+}
+
+// Return if the request is part of a multipart upload
+//
+func isUploadRequest(req *http.Request) bool {
+	q := req.URL.Query()
+	return q.Has("uploads") || q.Has("uploadId")
+}
+
+// Serve the multipart upload API, in the style of S3.
+//
+//  POST   /<key>?uploads                        start an upload, returning its id
+//  PUT    /<key>?uploadId=<id>&partNumber=<n>   upload (or replace) part n, numbered from 1
+//  GET    /<key>?uploadId=<id>                  list the parts uploaded so far
+//  POST   /<key>?uploadId=<id>                  complete the upload, joining the parts in order of part number
+//  DELETE /<key>?uploadId=<id>                  abandon the upload
+//
+// Only the role that started an upload can use it; silo itself enforces that & the usual permissions.
+//
+func (a *app) serveUpload(w http.ResponseWriter, req *http.Request, suser *silo.Role) {
+	q := req.URL.Query()
+	key := req.URL.Path
+	id := q.Get("uploadId")
+
+	if q.Has("uploads") {
+		if req.Method != http.MethodPost {
+			a.writeMethodForbidden(w, req)
+			return
+		}
+
+		id, err := a.repo.CreateUpload(suser, key)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		a.writeJson(w, http.StatusOK, &uploadMessage{Key: key, UploadId: id})
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil {
+			a.writeError(w, fmt.Errorf("%w: partNumber must be an integer", silo.ErrBadRequest))
+			return
+		}
+
+		data, err := a.readBody(w, req)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+
+		part, err := a.repo.UploadPart(suser, key, id, number, data)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		w.Header().Set("ETag", strconv.Quote(part.ETag))
+		a.writeJson(w, http.StatusOK, part)
+	case http.MethodGet:
+		parts, err := a.repo.ListParts(suser, key, id)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		a.writeJson(w, http.StatusOK, parts)
+	case http.MethodPost:
+		parts, err := a.repo.ListParts(suser, key, id)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+
+		// assembling a large object takes a while, so allow for it
+		total := int64(0)
+		for _, p := range parts {
+			total += p.Size
+		}
+		a.extendDeadlines(w, req, 0, total)
+
+		err = a.repo.CompleteUpload(suser, key, id)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Ok"))
+	case http.MethodDelete:
+		err := a.repo.AbortUpload(suser, key, id)
+		if err != nil {
+			a.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Ok"))
+	default:
+		a.writeMethodForbidden(w, req)
+	}
+}
@@ -7,22 +7,91 @@ package silo
 
 import (
 	"fmt"
+	"bytes"
+	"errors"
+	"time"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"github.com/gtank/cryptopasta"
 )
 
 const (
-	ForbiddenPrefix = "denied"
+	// keys used by silo itself to store internal data begin with this. They're not reachable by users.
+	systemKeyPrefix = "\x00silo/"
+
+	// written & removed to check storage is usable
+	readyKey = systemKeyPrefix + "ready/"
+
+	// writes to the same key are serialised by one of this many locks
+	keyLockCount = 64
+
+	// the most keys List returns at once
+	MaxListKeys = 1000
 )
 
+// The size & current version of a stored item.
+//  ETag changes whenever the item is written to.
+//
+type ObjectInfo struct {
+	Size int64
+	ETag string
+}
+
 type Silo struct {
 	conf *Config
+	confLock sync.RWMutex
 	store Storage
 	key *[32]byte
+
+	usage *ledger
+	usageLock sync.Mutex
+
+	// nil if no audit log is configured
+	auditor *auditLog
+
+	// roles persisted in our own storage, in addition to those in the config
+	roles map[string]*Role
+	roleLock sync.RWMutex
+
+	// set once we've been bootstrapped (see Bootstrap), after which the default roles are never used
+	bootstrapped atomic.Bool
+
+	// held while writing a key, so appends don't race each other or other writes; keys share locks by hash
+	keyLocks [keyLockCount]sync.Mutex
+
+	// multipart uploads in progress, by id
+	uploads map[string]*Upload
+	uploadLock sync.Mutex
+	// signalled (with uploadLock held) whenever a part finishes being written
+	partWritten *sync.Cond
+	// held while the ids of uploads in progress are saved
+	uploadIdsLock sync.Mutex
+
+	// keys being changed by transactions as they're committed, which reads wait on; true while a commit that
+	// couldn't be applied straight away is retried in the background
+	commits map[string]bool
+	commitLock sync.Mutex
+	// signalled (with commitLock held) whenever a commit finishes
+	commitDone *sync.Cond
+
+	// told of every successful write
+	watchers watchers
+
+	// background work (eg. reapers) stops when this is closed
+	stop chan struct{}
+	background sync.WaitGroup
+	closeOnce sync.Once
 }
 
 // Build a new Silo instance from a config
 //
-func NewSilo(config *Config) (*Silo, error) {
+func NewSilo(config *Config) (_ *Silo, err error) {
 	key, err := toKey(config.Misc.EncryptionKey)
 	if err != nil {
 		return nil, err
@@ -33,12 +102,142 @@ func NewSilo(config *Config) (*Silo, error) {
 	if err != nil {
 		return nil, err
 	}
+	sConn = instrument("filesystem", sConn)
 
-	return &Silo{
+	s := &Silo{
 		conf: config,
 		store: sConn,
 		key: key,
-	}, nil
+		usage: newLedger(),
+		roles: map[string]*Role{},
+		uploads: map[string]*Upload{},
+		commits: map[string]bool{},
+		stop: make(chan struct{}),
+	}
+	s.partWritten = sync.NewCond(&s.uploadLock)
+	s.commitDone = sync.NewCond(&s.commitLock)
+
+	// close whatever we've opened if we can't start
+	defer func() {
+		if err == nil {
+			return
+		}
+		if s.auditor != nil {
+			s.auditor.close()
+		}
+		sConn.Close()
+	}()
+
+	err = s.loadRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	// checked once we know if we were bootstrapped, since then the default roles are dropped
+	err = s.checkConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.loadUploads()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Audit != nil && config.Audit.File != "" {
+		s.auditor, err = openAuditLog(config.Audit, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.loadUsage()
+	if err != nil {
+		return nil, err
+	}
+	s.usage.restage(s.stagedParts(), config.Quota)
+
+	s.every(uploadReapInterval, s.reapUploads)
+	s.every(usageSaveInterval, s.flushUsage)
+	return s, nil
+}
+
+// Run fn in the background every interval, until we're closed.
+//
+func (s *Silo) every(interval time.Duration, fn func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-tick.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// Return the current config.
+//
+func (s *Silo) config() *Config {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.conf
+}
+
+// Swap in a new config, returning a description of what changed.
+//  Roles, limits & quotas take effect immediately; in flight requests finish with the config they started with.
+//  The encryption key & storage settings can't be changed without a restart, so a config changing them is rejected.
+//
+func (s *Silo) Reload(config *Config) ([]string, error) {
+	err := s.checkConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+
+	if config.Misc.EncryptionKey != s.conf.Misc.EncryptionKey {
+		return nil, fmt.Errorf("the encryption key cannot be changed without a restart")
+	}
+	if *config.Store != *s.conf.Store {
+		return nil, fmt.Errorf("storage settings cannot be changed without a restart")
+	}
+	if !sameAuditSettings(config.Audit, s.conf.Audit) {
+		return nil, fmt.Errorf("audit settings cannot be changed without a restart")
+	}
+
+	changes := diffConfig(s.conf, config)
+	s.conf = config
+	s.usage.retally(config.Quota)
+
+	return changes, nil
+}
+
+// Stop background work, flush anything outstanding & close the audit log & storage.
+//  The caller should make sure nothing else is using the Silo first (eg. by draining the HTTP server); it can't be
+//  used afterwards. Calling Close more than once is harmless.
+//
+func (s *Silo) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.background.Wait()
+
+		errs := []error{s.saveUsage(true)}
+		if s.auditor != nil {
+			errs = append(errs, s.auditor.close())
+		}
+		errs = append(errs, s.store.Close())
+		err = errors.Join(errs...)
+	})
+	return err
 }
 
 // Turn the given string into a key we can use to encrypt with.
@@ -60,82 +259,707 @@ func toKey(in string) (*[32]byte, error) {
 // Fetch the given user, assuming the user is found and the passwords match.
 //
 func (s *Silo) User(username, password string) (*Role, error) {
-	u, ok := s.conf.User[username]
+	u, ok := s.role(username)
 	if !ok {
 		return nil, nil
 	}
 
 	if !u.CheckPassword(password) {
-		return nil, fmt.Errorf("password mismatch")
+		return nil, fmt.Errorf("%w: password mismatch", ErrUnauthorized)
+	}
+	if u.Disabled {
+		return nil, fmt.Errorf("%w: role %s is disabled", ErrUnauthorized, username)
 	}
 
 	return u, nil
 }
 
+// Fetch the given user without checking a password, for callers that have authenticated them some other way
+// (eg. by a client certificate).
+//
+func (s *Silo) TrustedUser(username string) (*Role, error) {
+	u, ok := s.role(username)
+	if !ok {
+		return nil, nil
+	}
+
+	if u.Disabled {
+		return nil, fmt.Errorf("%w: role %s is disabled", ErrUnauthorized, username)
+	}
+	return u, nil
+}
+
 // Store some data in the storage, using the given key as a unique reference.
 //
 func (s *Silo) Store(user *Role, key string, data []byte) error {
+	return s.storeObject(user, key, data, false)
+}
+
+// Store some data under a key that must not already exist. If it does this fails with ErrExists, or ErrForbidden if
+// the user couldn't have replaced it anyway; the check is made under the key's lock, so of two concurrent creates
+// only one succeeds.
+//
+func (s *Silo) Create(user *Role, key string, data []byte) error {
+	return s.storeObject(user, key, data, true)
+}
+
+func (s *Silo) storeObject(user *Role, key string, data []byte, create bool) (err error) {
+	defer func() {
+		size, checksum := auditDigest(data)
+		err = s.recordAudit(user, &AuditRecord{Action: AuditStore, Key: key, Size: size, Checksum: checksum}, err)
+	}()
+
 	if !user.CanPut {
-		return fmt.Errorf("%s: user %s is not permitted to write", ForbiddenPrefix, user.Id)
+		return fmt.Errorf("%w: user %s is not permitted to write", ErrForbidden, user.Id)
+	}
+
+	conf := s.config()
+	if len(data) > conf.Misc.MaxDataBytes {
+		return fmt.Errorf("%w: maxdatabytes is currently %d", ErrTooLarge, conf.Misc.MaxDataBytes)
+	}
+	err = s.checkKey(key)
+	if err != nil {
+		return err
 	}
 
-	if len(data) > s.conf.Misc.MaxDataBytes {
-		return fmt.Errorf("%s: maxdatabytes is currently %d", ForbiddenPrefix, s.conf.Misc.MaxDataBytes)
+	unlock := s.lockKeys(key)
+	defer unlock()
+
+	err = s.checkReplace(user, key, create)
+	if err != nil {
+		return err
 	}
-	if len([]byte(key)) > s.conf.Misc.MaxKeyBytes {
-		return fmt.Errorf("%s: maxkeybytes is currently %d", ForbiddenPrefix, s.conf.Misc.MaxKeyBytes)
+
+	// We encrypt data give to us with our own key. Note it could well be encrypted already, this doesn't actually
+	// matter to us.
+	cyphertext, err := s.encryptObject(data)
+	if err != nil {
+		return err
 	}
 
+	// Account for the write before we make it, so concurrent writers can't sneak in over quota
+	undo, err := s.usage.record(user, key, int64(len(data)), conf.Quota)
+	if err != nil {
+		return err
+	}
+
+	err = s.store.Put(key, cyphertext)
+	if err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// Check the user may write key, given whether it exists & whether they mean only to create it. The caller holds
+// the key's lock.
+//
+func (s *Silo) checkReplace(user *Role, key string, create bool) error {
 	exists, err := s.Exists(key)
 	if err != nil {
 		return err
 	}
 
 	if exists && !user.CanRm {
-		return fmt.Errorf("%s: file exists and user %s is not permitted to remove", ForbiddenPrefix, user.Id)
+		return fmt.Errorf("%w: file exists and user %s is not permitted to remove", ErrForbidden, user.Id)
 	}
+	if exists && create {
+		return fmt.Errorf("%w: %s", ErrExists, key)
+	}
+	return nil
+}
 
-	// We encrypt data give to us with our own key. Note it could well be encrypted already, this doesn't actually
-	// matter to us.
-	cyphertext, err := cryptopasta.Encrypt(data, s.key)
+// Append data to the item with the given key, creating it if it doesn't exist. Appending requires the append
+// permission only, since nothing already stored is changed.
+//  Only the last chunk of the stored item is encrypted again, & appends to the same key are applied one at a time.
+//
+func (s *Silo) Append(user *Role, key string, data []byte) (err error) {
+	defer func() {
+		size, checksum := auditDigest(data)
+		err = s.recordAudit(user, &AuditRecord{Action: AuditAppend, Key: key, Size: size, Checksum: checksum}, err)
+	}()
+
+	if !user.CanAppend {
+		return fmt.Errorf("%w: user %s is not permitted to append", ErrForbidden, user.Id)
+	}
+
+	conf := s.config()
+	if len(data) > conf.Misc.MaxDataBytes {
+		return fmt.Errorf("%w: maxdatabytes is currently %d", ErrTooLarge, conf.Misc.MaxDataBytes)
+	}
+	err = s.checkKey(key)
 	if err != nil {
 		return err
 	}
-	return s.store.Put(key, cyphertext)
+
+	unlock := s.lockKeys(key)
+	defer unlock()
+
+	info, layout, err := s.stat(key)
+	exists := err == nil
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	total := int64(len(data))
+	if exists {
+		total += info.Size
+	}
+
+	undo, err := s.usage.record(user, key, total, conf.Quota)
+	if err != nil {
+		return err
+	}
+
+	err = s.appendObject(key, exists, layout, data)
+	if err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// Hold the write locks for the given keys, returning a func to release them.
+//  Locks are always taken in the same order, so writers holding several can't deadlock.
+//
+func (s *Silo) lockKeys(keys ...string) func() {
+	indices := []int{}
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		indices = append(indices, int(h.Sum32() % keyLockCount))
+	}
+	sort.Ints(indices)
+	indices = slices.Compact(indices)
+
+	for _, i := range indices {
+		s.keyLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range indices {
+			s.keyLocks[i].Unlock()
+		}
+	}
+}
+
+// Copy the item with the given key to another key, replacing it if it exists. This requires permission to read,
+// to write & (if the destination exists) to remove, as reading the item & storing it would.
+//  Where the storage driver can, the stored data is copied without being read, else it's copied as is (it needn't
+// be decrypted, as encrypted items don't depend on their key).
+//
+func (s *Silo) Copy(user *Role, src, dst string) (err error) {
+	var size int64
+	defer func() {
+		err = s.recordAudit(user, &AuditRecord{Action: AuditCopy, Key: dst, Size: size, Detail: "from " + src}, err)
+	}()
+
+	size, err = s.transfer(user, src, dst, false)
+	return err
+}
+
+// Move the item with the given key to another key, replacing it if it exists. This requires permission to read,
+// write & remove.
+//
+func (s *Silo) Rename(user *Role, src, dst string) (err error) {
+	var size int64
+	defer func() {
+		err = s.recordAudit(user, &AuditRecord{Action: AuditRename, Key: dst, Size: size, Detail: "from " + src}, err)
+	}()
+
+	if !user.CanRm {
+		return fmt.Errorf("%w: user %s is not permitted to delete", ErrForbidden, user.Id)
+	}
+	size, err = s.transfer(user, src, dst, true)
+	return err
+}
+
+// Copy or move an item between keys, returning its size.
+//
+func (s *Silo) transfer(user *Role, src, dst string, move bool) (int64, error) {
+	if !user.CanGet {
+		return 0, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, user.Id)
+	}
+	if !user.CanPut {
+		return 0, fmt.Errorf("%w: user %s is not permitted to write", ErrForbidden, user.Id)
+	}
+	for _, key := range []string{src, dst} {
+		err := s.checkKey(key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if src == dst {
+		return 0, fmt.Errorf("%w: source & destination are the same", ErrBadRequest)
+	}
+
+	unlock := s.lockKeys(src, dst)
+	defer unlock()
+
+	info, _, err := s.stat(src)
+	if err != nil {
+		return 0, err
+	}
+
+	exists, err := s.Exists(dst)
+	if err != nil {
+		return 0, err
+	}
+	if exists && !user.CanRm {
+		return 0, fmt.Errorf("%w: file exists and user %s is not permitted to remove", ErrForbidden, user.Id)
+	}
+
+	// A moved item no longer counts where it was, so forget it first or a move could be refused as over quota
+	conf := s.config()
+	undoSrc := func() {}
+	if move {
+		undoSrc = s.usage.forget(src)
+	}
+	undo, err := s.usage.record(user, dst, info.Size, conf.Quota)
+	if err != nil {
+		undoSrc()
+		return 0, err
+	}
+
+	err = s.copyObject(src, dst, move)
+	if err != nil {
+		undo()
+		undoSrc()
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Copy or move the stored data of an item, using the storage driver's own operations where it has them.
+//  Nb. the caller is expected to hold both keys' locks.
+//
+func (s *Silo) copyObject(src, dst string, move bool) error {
+	err := errNotSupported
+	if move {
+		renaming, ok := s.store.(RenamingStorage)
+		if ok {
+			err = renaming.Rename(src, dst)
+		}
+	} else {
+		copying, ok := s.store.(CopyingStorage)
+		if ok {
+			err = copying.Copy(src, dst)
+		}
+	}
+	if err != errNotSupported {
+		return err
+	}
+
+	data, err := s.store.Get(src)
+	if err != nil {
+		return err
+	}
+	err = s.store.Put(dst, data)
+	if err != nil || !move {
+		return err
+	}
+	return s.store.Delete(src)
+}
+
+// List keys beginning with prefix, in order, starting after the given key (if any) & returning at most limit keys
+// (or MaxListKeys, if less). Also returns whether there are more keys to come, in which case the next page starts
+// after the last key returned.
+//
+func (s *Silo) List(user *Role, prefix, after string, limit int) ([]string, bool, error) {
+	if !user.CanGet {
+		return nil, false, s.Denied(user, "list", prefix, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, user.Id))
+	}
+	if limit <= 0 || limit > MaxListKeys {
+		limit = MaxListKeys
+	}
+
+	listing, ok := s.store.(ListingStorage)
+	if !ok {
+		return nil, false, fmt.Errorf("%w: storage driver can't list keys", ErrUnsupported)
+	}
+	keys, err := listing.List(prefix)
+	if err == errNotSupported {
+		return nil, false, fmt.Errorf("%w: storage driver can't list keys", ErrUnsupported)
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	result := []string{}
+	for _, key := range keys {
+		if isSystemKey(key) || (after != "" && key <= after) {
+			continue
+		}
+		if len(result) == limit {
+			return result, true, nil
+		}
+		result = append(result, key)
+	}
+	return result, false, nil
 }
 
 // Remove some item by it's key
 //
-func (s *Silo) Remove(user *Role, key string) error {
+func (s *Silo) Remove(user *Role, key string) (err error) {
+	defer func() { err = s.recordAudit(user, &AuditRecord{Action: AuditRemove, Key: key}, err) }()
+
 	if !user.CanRm {
-		return fmt.Errorf("%s: user %s is not permitted to delete", ForbiddenPrefix, user.Id)
+		return fmt.Errorf("%w: user %s is not permitted to delete", ErrForbidden, user.Id)
 	}
-	if len([]byte(key)) > s.conf.Misc.MaxKeyBytes {
-		return fmt.Errorf("%s: maxkeybytes is currently %d", ForbiddenPrefix, s.conf.Misc.MaxKeyBytes)
+	err = s.checkKey(key)
+	if err != nil {
+		return err
 	}
 
-	return s.store.Delete(key)
+	unlock := s.lockKeys(key)
+	defer unlock()
+
+	undo := s.usage.forget(key)
+	err = s.store.Delete(key)
+	if err != nil {
+		undo()
+		return err
+	}
+	return nil
 }
 
 // Get the stored item given it's unique key
 //
 func (s *Silo) Get(user *Role, key string) ([]byte, error) {
 	if !user.CanGet {
-		return nil, fmt.Errorf("%s: user %s is not permitted to read", ForbiddenPrefix, user.Id)
+		return nil, s.Denied(user, "get", key, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, user.Id))
 	}
-	if len([]byte(key)) > s.conf.Misc.MaxKeyBytes {
-		return nil, fmt.Errorf("%s: maxkeybytes is currently %d", ForbiddenPrefix, s.conf.Misc.MaxKeyBytes)
+	err := s.checkKey(key)
+	if err == nil {
+		err = s.waitForCommit(key)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	cyphertext, err := s.store.Get(key)
 	if err != nil {
 		return nil, err
 	}
-	return cryptopasta.Decrypt(cyphertext, s.key)
+	return s.decryptObject(cyphertext)
+}
+
+// Return the size & etag of the stored item with the given key
+//
+func (s *Silo) Stat(user *Role, key string) (*ObjectInfo, error) {
+	if !user.CanGet {
+		return nil, s.Denied(user, "get", key, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, user.Id))
+	}
+	err := s.checkKey(key)
+	if err == nil {
+		err = s.waitForCommit(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, _, err := s.stat(key)
+	return info, err
+}
+
+// Get length bytes of the stored item with the given key, starting at offset.
+//  Only the chunks holding the range are read & decrypted.
+//
+func (s *Silo) GetRange(user *Role, key string, offset, length int64) ([]byte, error) {
+	obj, err := s.Open(user, key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return obj.ReadRange(offset, length)
+}
+
+// A stored item opened for reading, so that it can be read in several ranges. Where the storage can open objects
+// (see OpeningStorage) every read sees the item as it was when opened, even if it's replaced meanwhile.
+//
+type Object struct {
+	s *Silo
+	key string
+	r ObjectReader
+	info *ObjectInfo
+	// nil for objects in the old format, which are decrypted in full on first read
+	layout *chunkLayout
+	plaintext []byte
+}
+
+// Open the stored item with the given key for reading. It should be closed when done with.
+//
+func (s *Silo) Open(user *Role, key string) (*Object, error) {
+	if !user.CanGet {
+		return nil, s.Denied(user, "get", key, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, user.Id))
+	}
+	err := s.checkKey(key)
+	if err == nil {
+		err = s.waitForCommit(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := s.open(key)
+	if err != nil {
+		return nil, err
+	}
+	info, layout, err := statObject(key, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &Object{s: s, key: key, r: r, info: info, layout: layout}, nil
+}
+
+// Return the size & etag of the item as it was opened
+//
+func (o *Object) Info() *ObjectInfo {
+	return &ObjectInfo{Size: o.info.Size, ETag: o.info.ETag}
+}
+
+// Read length bytes starting at offset. Only the chunks holding the range are read & decrypted.
+//
+func (o *Object) ReadRange(offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 || offset + length > o.info.Size {
+		return nil, fmt.Errorf("%w: range %d+%d is outside object of %d bytes", ErrRangeNotSatisfiable, offset, length, o.info.Size)
+	}
+
+	if o.layout == nil {
+		if o.plaintext == nil {
+			cyphertext, err := readAt(o.r, 0, o.r.Size())
+			if err != nil {
+				return nil, err
+			}
+			o.plaintext, err = cryptopasta.Decrypt(cyphertext, o.s.key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return o.plaintext[offset:offset + length], nil
+	}
+
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	first, start, size := o.layout.span(offset, length)
+	stored, err := readAt(o.r, start, size)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := o.layout.cipher(o.s.key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.decrypt(o.layout, first, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := offset - first * o.layout.chunkSize
+	return data[skip:skip + length], nil
+}
+
+func (o *Object) Close() error {
+	return o.r.Close()
 }
 
 // Return if something with the given key has been stored here already
 //
 func (s *Silo) Exists(key string) (bool, error) {
+	if isSystemKey(key) {
+		return false, nil
+	}
+	err := s.checkKey(key)
+	if err == nil {
+		err = s.waitForCommit(key)
+	}
+	if err != nil {
+		return false, err
+	}
 	return s.store.Exists(key)
 }
+
+// Return the largest object that can currently be stored, in bytes.
+//
+func (s *Silo) MaxDataBytes() int {
+	return s.config().Misc.MaxDataBytes
+}
+
+// Return the current maximum data a batch may carry
+//
+func (s *Silo) MaxBatchBytes() int64 {
+	return s.config().Misc.MaxBatchBytes
+}
+
+// Return the total number of objects & bytes stored, as recorded in the usage ledger.
+//
+func (s *Silo) Totals() (int64, int64) {
+	return s.usage.totals()
+}
+
+// Check that storage is usable, by writing, reading back & removing a small object.
+//
+func (s *Silo) Ready() error {
+	probe := []byte(time.Now().String())
+	key := fmt.Sprintf("%s%d", readyKey, time.Now().UnixNano())
+
+	err := s.writeSystem(key, probe)
+	if err != nil {
+		return err
+	}
+
+	cyphertext, err := s.store.Get(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := cryptopasta.Decrypt(cyphertext, s.key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, probe) {
+		return fmt.Errorf("storage returned unexpected data")
+	}
+
+	return s.store.Delete(key)
+}
+
+// Return current storage usage, as visible to the given user.
+//
+func (s *Silo) Usage(user *Role) *UsageReport {
+	return s.usage.report(user, s.config().Quota)
+}
+
+// Check that the given key is one a user is allowed to reference.
+//
+func (s *Silo) checkKey(key string) error {
+	max := s.config().Misc.MaxKeyBytes
+	if len([]byte(key)) > max {
+		return fmt.Errorf("%w: maxkeybytes is currently %d", ErrKeyTooLong, max)
+	}
+	if isSystemKey(key) {
+		return fmt.Errorf("%w: key is reserved", ErrForbidden)
+	}
+	return nil
+}
+
+// Return if the key is one used internally by silo.
+//
+func isSystemKey(key string) bool {
+	return strings.HasPrefix(key, systemKeyPrefix)
+}
+
+// Read in the persisted usage ledger, if there is one. Unless it was saved on Close it may be missing recent
+// writes (or predate the ledger altogether), so it's reconciled with what's stored. Either way it's saved again
+// straight away, as no longer clean, since it won't be exact once we're written to.
+//
+func (s *Silo) loadUsage() error {
+	_, err := s.readSystem(usageKey, s.usage)
+	if err != nil {
+		return err
+	}
+
+	if !s.usage.Clean {
+		stored, err := s.storedSizes()
+		if err != nil && err != errNotSupported {
+			return err
+		} else if err == nil {
+			s.usage.reconcile(stored)
+		}
+	}
+
+	s.usage.tally(s.config().Quota)
+	s.usage.changed()
+	return s.saveUsage(false)
+}
+
+// Return the size of every object stored, by key.
+//
+func (s *Silo) storedSizes() (map[string]int64, error) {
+	listing, ok := s.store.(ListingStorage)
+	if !ok {
+		return nil, errNotSupported
+	}
+	keys, err := listing.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, key := range keys {
+		if isSystemKey(key) {
+			continue
+		}
+
+		info, _, err := s.stat(key)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sizes[key] = info.Size
+	}
+	return sizes, nil
+}
+
+// Persist the usage ledger to our own storage, if it's changed. Clean marks it as exact, which is only true once
+// nothing else will be written.
+//
+func (s *Silo) saveUsage(clean bool) error {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	data, err := s.usage.marshal(clean)
+	if err != nil || data == nil {
+		return err
+	}
+
+	err = s.writeSystem(usageKey, data)
+	if err != nil {
+		s.usage.changed()
+	}
+	return err
+}
+
+// Save the usage ledger if it's changed, run in the background.
+//
+func (s *Silo) flushUsage() {
+	err := s.saveUsage(false)
+	if err != nil {
+		slog.Warn("unable to save usage ledger", "error", err)
+	}
+}
+
+// Read some of silo's internal data from storage & unmarshal it into the given struct.
+//  Returns false if nothing has been stored under the key.
+//
+func (s *Silo) readSystem(key string, into interface{}) (bool, error) {
+	exists, err := s.store.Exists(key)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	cyphertext, err := s.store.Get(key)
+	if err != nil {
+		return true, err
+	}
+
+	data, err := cryptopasta.Decrypt(cyphertext, s.key)
+	if err != nil {
+		return true, err
+	}
+
+	return true, json.Unmarshal(data, into)
+}
+
+// Write some of silo's internal data to storage, encrypted like everything else.
+//
+func (s *Silo) writeSystem(key string, data []byte) error {
+	cyphertext, err := cryptopasta.Encrypt(data, s.key)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(key, cyphertext)
+}
@@ -0,0 +1,190 @@
+package silo
+
+import (
+	"errors"
+	"testing"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testEncryptionKey = "a key used only by tests, long enough to be accepted"
+	testPassword = "pw"
+)
+
+// Return a config for a silo stored in a fresh temp dir, with the given roles.
+//
+func testConfig(t *testing.T, roles ...*Role) *Config {
+	c := NewConfig()
+	c.RemoveDefaultRoles()
+	c.Misc.EncryptionKey = testEncryptionKey
+	c.Store.Location = t.TempDir()
+	for _, r := range roles {
+		c.User[r.Id] = r
+	}
+	return c
+}
+
+// Open a silo with the given config, closed when the test ends.
+//
+func openTestSilo(t *testing.T, c *Config) *Silo {
+	s, err := NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Build a role with the given permissions & testPassword, hashed cheaply.
+//
+func testRole(id string, get, put, rm bool) *Role {
+	r, err := newRoleWithCost(id, testPassword, bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	r.CanGet = get
+	r.CanPut = put
+	r.CanRm = rm
+	return r
+}
+
+func TestStoreGetRemove(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	reader := testRole("reader", true, false, false)
+	writer := testRole("writer", false, true, false)
+	s := openTestSilo(t, testConfig(t, rw, reader, writer))
+
+	err := s.Store(writer, "/a", []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{
+		Name string
+		Err error
+		Fn func() error
+	}{
+		{"reader can't write", ErrForbidden, func() error { return s.Store(reader, "/b", []byte("x")) }},
+		{"writer can't overwrite", ErrForbidden, func() error { return s.Store(writer, "/a", []byte("x")) }},
+		{"writer can't read", ErrForbidden, func() error { _, err := s.Get(writer, "/a"); return err }},
+		{"reader can't remove", ErrForbidden, func() error { return s.Remove(reader, "/a") }},
+		{"system keys are reserved", ErrForbidden, func() error { return s.Store(rw, systemKeyPrefix + "x", nil) }},
+		{"missing keys aren't found", ErrNotFound, func() error { _, err := s.Get(rw, "/missing"); return err }},
+		{"overwrite", nil, func() error { return s.Store(rw, "/a", []byte("two")) }},
+	}
+	for _, c := range cases {
+		err := c.Fn()
+		if c.Err == nil && err != nil || c.Err != nil && !errors.Is(err, c.Err) {
+			t.Errorf("%s: expected %v, got %v", c.Name, c.Err, err)
+		}
+	}
+
+	data, err := s.Get(reader, "/a")
+	if err != nil || string(data) != "two" {
+		t.Fatalf("expected two, got %q %v", data, err)
+	}
+
+	err = s.Remove(rw, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Get(rw, "/a")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found after remove, got %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	writer := testRole("writer", false, true, false)
+	s := openTestSilo(t, testConfig(t, rw, writer))
+
+	cases := []struct{
+		Name string
+		Err error
+		Fn func() error
+	}{
+		{"create", nil, func() error { return s.Create(writer, "/a", []byte("one")) }},
+		{"exists", ErrExists, func() error { return s.Create(rw, "/a", []byte("two")) }},
+		{"exists & can't be replaced anyway", ErrForbidden, func() error { return s.Create(writer, "/a", []byte("two")) }},
+	}
+	for _, c := range cases {
+		err := c.Fn()
+		if c.Err == nil && err != nil || c.Err != nil && !errors.Is(err, c.Err) {
+			t.Errorf("%s: expected %v, got %v", c.Name, c.Err, err)
+		}
+	}
+
+	data, err := s.Get(rw, "/a")
+	if err != nil || string(data) != "one" {
+		t.Fatalf("expected the key to be unchanged, got %q %v", data, err)
+	}
+	if u := s.Usage(writer).Usage; u.Bytes != 3 || u.Objects != 1 {
+		t.Fatalf("expected only the first create to be counted, got %+v", u)
+	}
+}
+
+// Storage implementing none of the optional interfaces
+//
+type plainStorage struct {
+	Storage
+}
+
+func TestCopyRename(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		rw := testRole("rw", true, true, true)
+		reader := testRole("reader", true, false, false)
+		s := openTestSilo(t, testConfig(t, rw, reader))
+		if plain {
+			s.store = &plainStorage{Storage: s.store}
+		}
+
+		err := s.Store(rw, "/a", []byte("one"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct{
+			Name string
+			Err error
+			Fn func() error
+		}{
+			{"readers can't copy", ErrForbidden, func() error { return s.Copy(reader, "/a", "/b") }},
+			{"missing keys can't be copied", ErrNotFound, func() error { return s.Copy(rw, "/missing", "/b") }},
+			{"copy", nil, func() error { return s.Copy(rw, "/a", "/b") }},
+			{"rename", nil, func() error { return s.Rename(rw, "/b", "/c") }},
+		}
+		for _, c := range cases {
+			err := c.Fn()
+			if c.Err == nil && err != nil || c.Err != nil && !errors.Is(err, c.Err) {
+				t.Errorf("plain %v, %s: expected %v, got %v", plain, c.Name, c.Err, err)
+			}
+		}
+
+		for key, expect := range map[string]string{"/a": "one", "/c": "one"} {
+			data, err := s.Get(rw, key)
+			if err != nil || string(data) != expect {
+				t.Errorf("plain %v: expected %s to hold %q, got %q %v", plain, key, expect, data, err)
+			}
+		}
+		_, err = s.Get(rw, "/b")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("plain %v: expected the renamed key to be gone, got %v", plain, err)
+		}
+	}
+}
+
+func TestUnsupportedStorage(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, rw))
+	s.store = &plainStorage{Storage: s.store}
+
+	_, _, err := s.List(rw, "/", "", 0)
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected listing to be unsupported, got %v", err)
+	}
+	_, err = s.Batch(rw, []*BatchOp{{Op: BatchPut, Key: "/a"}}, true)
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected atomic batches to be unsupported, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package silofs
+
+import (
+	"context"
+	"github.com/voidshard/silo"
+)
+
+// A Source reading from an embedded silo, with the permissions of user. The contexts passed to it are ignored,
+// as silo's methods don't take one.
+//
+func Embedded(s *silo.Silo, user *silo.Role) Source {
+	return &embedded{s: s, user: user}
+}
+
+type embedded struct {
+	s *silo.Silo
+	user *silo.Role
+}
+
+func (e *embedded) Get(ctx context.Context, key string) ([]byte, error) {
+	return e.s.Get(e.user, key)
+}
+
+func (e *embedded) Stat(ctx context.Context, key string) (*silo.ObjectInfo, error) {
+	return e.s.Stat(e.user, key)
+}
+
+// Lists a page of keys at a time, until there are no more
+//
+func (e *embedded) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	after := ""
+	for {
+		page, more, err := e.s.List(e.user, prefix, after, silo.MaxListKeys)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if !more || len(page) == 0 {
+			return keys, nil
+		}
+		after = page[len(page) - 1]
+	}
+}
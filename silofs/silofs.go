@@ -0,0 +1,393 @@
+/*
+Package silofs exposes keys in silo as an io/fs.FS, so they can be served with http.FileServer, parsed with
+template.ParseFS or walked with fs.WalkDir, without copying them to disk.
+
+	fsys := silofs.New(c, silofs.WithPrefix("/static/"))          // c is a *client.Client
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(fsys))))
+
+	fsys = silofs.New(silofs.Embedded(s, role))                    // or an embedded *silo.Silo
+	tmpl, err := template.ParseFS(fsys, "templates/*.html")
+
+Keys are split into directories on "/". Silo has no directories as such, so a directory exists if any key begins
+with its name followed by "/"; listing one lists keys by prefix. Keys that aren't valid fs paths (eg. containing
+".." or "//") aren't visible. Silo doesn't record modification times, so files report the zero time.
+*/
+package silofs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+	"github.com/voidshard/silo"
+)
+
+// The silo keys are read from. A *client.Client is a Source; use Embedded for a *silo.Silo.
+//
+type Source interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Stat(ctx context.Context, key string) (*silo.ObjectInfo, error)
+
+	// every key beginning with prefix, in order
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// An io/fs.FS over keys in silo. It's safe for concurrent use.
+//
+type FS struct {
+	src Source
+	ctx context.Context
+	prefix string
+}
+
+type Option func(*FS)
+
+// Only expose keys beginning with prefix, which is removed from their names; eg. with the prefix "/static/",
+// the key "/static/css/site.css" is the file "css/site.css". The default is "/", as keys stored over http
+// begin with "/".
+//
+func WithPrefix(prefix string) Option {
+	return func(f *FS) {
+		f.prefix = prefix
+	}
+}
+
+// Make requests with ctx, eg. to give them a deadline or cancel them. The default is context.Background().
+//
+func WithContext(ctx context.Context) Option {
+	return func(f *FS) {
+		f.ctx = ctx
+	}
+}
+
+// Return a filesystem reading keys from src.
+//
+func New(src Source, opts ...Option) *FS {
+	f := &FS{src: src, ctx: context.Background(), prefix: "/"}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Open the named file or directory. Files' contents are fetched when first read or seeked past; files can seek
+// & read at offsets, as http.FileServer requires.
+//
+func (f *FS) Open(name string) (fs.File, error) {
+	info, entries, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dir{name: name, info: info, entries: entries}, nil
+	}
+	return &file{fsys: f, name: name, info: info}, nil
+}
+
+// Return information on the named file or directory.
+//
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	info, _, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Return the entries of the named directory, sorted by name.
+//
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, entries, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return entries, nil
+}
+
+// Return the contents of the named file.
+//
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	data, err := f.src.Get(f.ctx, f.prefix + name)
+	if err != nil {
+		return nil, pathError("read", name, err)
+	}
+	return data, nil
+}
+
+var (
+	errNotDir = errors.New("not a directory")
+	errIsDir = errors.New("is a directory")
+)
+
+// Find the named file or directory, returning the entries if it's a directory. A key is a file, even if there
+// are also keys beneath it.
+//
+func (f *FS) lookup(op, name string) (*fileInfo, []fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	dirPrefix := f.prefix
+	if name != "." {
+		obj, err := f.src.Stat(f.ctx, f.prefix + name)
+		if err == nil {
+			return &fileInfo{name: base(name), size: obj.Size, etag: obj.ETag}, nil, nil
+		}
+		if !errors.Is(err, silo.ErrNotFound) {
+			return nil, nil, pathError(op, name, err)
+		}
+		dirPrefix += name + "/"
+	}
+
+	keys, err := f.src.List(f.ctx, dirPrefix)
+	if err != nil {
+		return nil, nil, pathError(op, name, err)
+	}
+	entries := f.entries(name, dirPrefix, keys)
+	if len(entries) == 0 && name != "." {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &fileInfo{name: base(name), dir: true}, entries, nil
+}
+
+// Group the keys under a directory into its entries
+//
+func (f *FS) entries(name, dirPrefix string, keys []string) []fs.DirEntry {
+	seen := map[string]bool{}
+	entries := []fs.DirEntry{}
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, dirPrefix)
+		child, _, isDir := strings.Cut(rest, "/")
+		if child == "" || child == "." || !fs.ValidPath(child) || seen[child] {
+			continue
+		}
+		if isDir && !fs.ValidPath(rest) {
+			continue
+		}
+		seen[child] = true
+
+		path := child
+		if name != "." {
+			path = name + "/" + child
+		}
+		entries = append(entries, &dirEntry{fsys: f, path: path, dir: isDir})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// Map silo's errors to their io/fs equivalents
+//
+func pathError(op, name string, err error) error {
+	switch {
+	case errors.Is(err, silo.ErrNotFound):
+		err = fs.ErrNotExist
+	case errors.Is(err, silo.ErrForbidden), errors.Is(err, silo.ErrUnauthorized):
+		err = fs.ErrPermission
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func base(name string) string {
+	return name[strings.LastIndex(name, "/") + 1:]
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	etag string
+	dir bool
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.dir
+}
+
+// The object's silo.ObjectInfo, or nil for directories
+//
+func (i *fileInfo) Sys() interface{} {
+	if i.dir {
+		return nil
+	}
+	return &silo.ObjectInfo{Size: i.size, ETag: i.etag}
+}
+
+type dirEntry struct {
+	fsys *FS
+	path string
+	dir bool
+}
+
+func (e *dirEntry) Name() string {
+	return base(e.path)
+}
+
+func (e *dirEntry) IsDir() bool {
+	return e.dir
+}
+
+func (e *dirEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+// Stats the key, for files
+//
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	if e.dir {
+		return &fileInfo{name: e.Name(), dir: true}, nil
+	}
+	return e.fsys.Stat(e.path)
+}
+
+// An open file. The key is fetched in full when first read.
+//
+type file struct {
+	fsys *FS
+	name string
+	info *fileInfo
+	data *bytes.Reader
+	offset int64
+	closed bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) load(op string) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.data != nil {
+		return nil
+	}
+
+	data, err := f.fsys.src.Get(f.fsys.ctx, f.fsys.prefix + f.name)
+	if err != nil {
+		return pathError(op, f.name, err)
+	}
+	f.data = bytes.NewReader(data)
+	return nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	err := f.load("read")
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.data.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, offset int64) (int, error) {
+	err := f.load("read")
+	if err != nil {
+		return 0, err
+	}
+	return f.data.ReadAt(b, offset)
+}
+
+// Seeking doesn't fetch the key; the size is known from when it was opened.
+//
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	f.data = nil
+	return nil
+}
+
+// An open directory; its entries are listed when it's opened.
+//
+type dir struct {
+	name string
+	info *fileInfo
+	entries []fs.DirEntry
+	offset int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,223 @@
+package silofs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/voidshard/silo"
+	"github.com/voidshard/silo/client"
+	"github.com/voidshard/silo/server"
+)
+
+const (
+	testEncryptionKey = "a key used only by tests, long enough to be accepted"
+	testPassword = "pw"
+)
+
+// What's stored, & which of it the filesystem should show under the prefix "/static/"
+//
+var (
+	testObjects = map[string]string{
+		"/static/index.html": "<html></html>",
+		"/static/css/site.css": "body {}",
+		"/static/css/print.css": "@media print {}",
+		"/static/img/icons/a.png": "png",
+		"/other/secret.txt": "not under the prefix",
+	}
+	testFiles = []string{"index.html", "css/site.css", "css/print.css", "img/icons/a.png"}
+)
+
+// Build a role with the given permissions & testPassword, hashed cheaply.
+//
+func testRole(id string, get, put, rm bool) *silo.Role {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	r, err := silo.NewRoleFromHash(id, string(hash))
+	if err != nil {
+		panic(err)
+	}
+	r.CanGet = get
+	r.CanPut = put
+	r.CanRm = rm
+	return r
+}
+
+// Open a silo in a fresh temp dir holding testObjects, closed when the test ends.
+//
+func testSilo(t *testing.T, roles ...*silo.Role) *silo.Silo {
+	c := silo.NewConfig()
+	c.RemoveDefaultRoles()
+	c.Misc.EncryptionKey = testEncryptionKey
+	c.Store.Location = t.TempDir()
+	for _, r := range roles {
+		c.User[r.Id] = r
+	}
+
+	s, err := silo.NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	writer := testRole("writer", true, true, true)
+	for key, data := range testObjects {
+		err = s.Store(writer, key, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestEmbedded(t *testing.T) {
+	reader := testRole("reader", true, false, false)
+	s := testSilo(t, reader)
+
+	err := fstest.TestFS(New(Embedded(s, reader), WithPrefix("/static/")), testFiles...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	reader := testRole("reader", true, false, false)
+	srv := httptest.NewServer(server.New(testSilo(t, reader)))
+	t.Cleanup(srv.Close)
+	c, err := client.New(srv.URL, "reader", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fstest.TestFS(New(c, WithPrefix("/static/")), testFiles...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	reader := testRole("reader", true, false, false)
+	writer := testRole("writeonly", false, true, false)
+	s := testSilo(t, reader, writer)
+	fsys := New(Embedded(s, reader), WithPrefix("/static/"))
+	denied := New(Embedded(s, writer), WithPrefix("/static/"))
+
+	cases := []struct{
+		Name string
+		Err error
+		Fn func() error
+	}{
+		{"missing files don't exist", fs.ErrNotExist, func() error { _, err := fsys.Open("missing.txt"); return err }},
+		{"nor missing dirs", fs.ErrNotExist, func() error { _, err := fsys.ReadDir("missing"); return err }},
+		{"keys outside the prefix aren't visible", fs.ErrNotExist, func() error { _, err := fsys.Stat("other/secret.txt"); return err }},
+		{"nor can paths escape it", fs.ErrInvalid, func() error { _, err := fsys.Stat("../other/secret.txt"); return err }},
+		{"invalid paths", fs.ErrInvalid, func() error { _, err := fsys.ReadFile("css//site.css"); return err }},
+		{"files aren't dirs", errNotDir, func() error { _, err := fsys.ReadDir("index.html"); return err }},
+		{"without read permission", fs.ErrPermission, func() error { _, err := denied.Stat("index.html"); return err }},
+		{"nor reading", fs.ErrPermission, func() error { _, err := denied.ReadFile("index.html"); return err }},
+	}
+	for _, c := range cases {
+		err := c.Fn()
+		if !errors.Is(err, c.Err) {
+			t.Errorf("%s: expected %v, got %v", c.Name, c.Err, err)
+		}
+		var pathErr *fs.PathError
+		if !errors.As(err, &pathErr) {
+			t.Errorf("%s: expected a *fs.PathError, got %T", c.Name, err)
+		}
+	}
+}
+
+func TestFileSeek(t *testing.T) {
+	reader := testRole("reader", true, false, false)
+	s := testSilo(t, reader)
+	fsys := New(Embedded(s, reader), WithPrefix("/static/"))
+
+	f, err := fsys.Open("css/print.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := f.(io.ReadSeeker)
+	end, err := rs.Seek(-3, io.SeekEnd)
+	if err != nil || end != int64(len("@media print {}")) - 3 {
+		t.Fatalf("expected to seek from the end, got %d %v", end, err)
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil || string(data) != " {}" {
+		t.Fatalf("expected the last 3 bytes, got %q %v", data, err)
+	}
+
+	_, err = rs.Seek(-1, io.SeekStart)
+	if !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("expected seeking before the start to be refused, got %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Read(make([]byte, 1))
+	if !errors.Is(err, fs.ErrClosed) {
+		t.Fatalf("expected reading a closed file to fail, got %v", err)
+	}
+}
+
+// A Source over a map, for keys silo's storage may not hold as given
+//
+type mapSource map[string]string
+
+func (m mapSource) Get(ctx context.Context, key string) ([]byte, error) {
+	data, ok := m[key]
+	if !ok {
+		return nil, silo.ErrNotFound
+	}
+	return []byte(data), nil
+}
+
+func (m mapSource) Stat(ctx context.Context, key string) (*silo.ObjectInfo, error) {
+	data, ok := m[key]
+	if !ok {
+		return nil, silo.ErrNotFound
+	}
+	return &silo.ObjectInfo{Size: int64(len(data))}, nil
+}
+
+func (m mapSource) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func TestInvalidKeysHidden(t *testing.T) {
+	src := mapSource{
+		"/ok.txt": "ok",
+		"/dir/ok.txt": "ok",
+		"/dir/../escape.txt": "hidden",
+		"/dir//double.txt": "hidden",
+		"/./dot.txt": "hidden",
+		"/trailing/": "hidden",
+	}
+
+	err := fstest.TestFS(New(src), "ok.txt", "dir/ok.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := New(src).ReadDir("dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "ok.txt" {
+		t.Fatalf("expected only dir/ok.txt, got %v %v", entries, err)
+	}
+}
@@ -1,21 +1,113 @@
 package silo
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"encoding/base64"
 	"io/ioutil"
 	"fmt"
+	"io"
 )
 
 
-// interface for some storage backend
+// interface for some storage backend.
+//  Get & Delete of a key that doesn't exist should return ErrNotFound.
+//  Put should be atomic; a reader sees either the old data or the new, never part of a write.
+//  GetRange returns up to length bytes from offset, fewer if the data ends first.
+//  Close is called once nothing else is using the storage.
 //
 type Storage interface {
 	Put(string, []byte) error
 	Exists(string) (bool, error)
 	Get(string) ([]byte, error)
+	GetRange(key string, offset, length int64) ([]byte, error)
+	Size(string) (int64, error)
 	Delete(string) error
+	Close() error
+}
+
+// Optionally implemented by storage that can write an object incrementally, so large objects needn't be
+// held in memory.
+//
+type StreamingStorage interface {
+	Create(string) (ObjectWriter, error)
+}
+
+// Optionally implemented by storage that can rewrite the end of an object, so appending to an object needn't
+// re-encrypt all of it.
+//  ReplaceTail replaces everything from offset onwards with data, which must reach at least the current end. It
+//  should be atomic, as with Put.
+//
+type AppendingStorage interface {
+	ReplaceTail(key string, offset int64, data []byte) error
+}
+
+// Optionally implemented by storage that can open an object for reading, so that several reads of it are
+// consistent: they all see the object as it was when opened, even if it's replaced meanwhile.
+//
+type OpeningStorage interface {
+	Open(string) (ObjectReader, error)
+}
+
+// An object opened for reading. As with any io.ReaderAt, reads past the end return io.EOF.
+//
+type ObjectReader interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// Optionally implemented by storage that can copy an object without it passing through silo.
+//  The destination is replaced if it exists, & should be replaced atomically, as with Put.
+//
+type CopyingStorage interface {
+	Copy(src, dst string) error
+}
+
+// Optionally implemented by storage that can move an object to another key without copying it.
+//  The destination is replaced if it exists, & should be replaced atomically, as with Put.
+//
+type RenamingStorage interface {
+	Rename(src, dst string) error
+}
+
+// Optionally implemented by storage that can list the keys it holds.
+//  List returns every key beginning with prefix, in order.
+//
+type ListingStorage interface {
+	List(prefix string) ([]string, error)
+}
+
+// Optionally implemented by storage that can change several keys atomically.
+//
+type TransactionalStorage interface {
+	Begin() (Transaction, error)
+}
+
+// A set of changes made by a transaction. Nothing is visible until Commit, after which all the changes are,
+// even if we crash part way through; Rollback discards them. Reads aren't part of the transaction, & may see the
+// changes part made while Commit is applying them; Silo's own readers wait for commits to finish.
+//  Delete of a key that doesn't exist should return ErrNotFound. If Commit can't make the changes visible after
+//  the point they're committed, it should return an error wrapping errNotApplied; calling Commit again should try
+//  applying them again, & failing that they must be applied on startup.
+//
+type Transaction interface {
+	Put(string, []byte) error
+	Delete(string) error
+	Commit() error
+	Rollback() error
+}
+
+// An object being written. Nothing written is visible until Commit; Abort discards it.
+//
+type ObjectWriter interface {
+	io.Writer
+	Commit() error
+	Abort() error
 }
 
 // the most trivial kind of storage implementation
@@ -24,6 +116,11 @@ type filesystem struct {
 	root string
 }
 
+const (
+	// partially written files are named with this prefix, which never appears in an encoded key
+	tempFilePrefix = ".tmp-"
+)
+
 type storageSettings struct {
 	Driver string
 	Location string
@@ -33,7 +130,33 @@ func newFilesystemStorge(settings *storageSettings) (Storage, error) {
 	if settings.Location == "" {
 		return nil, fmt.Errorf("filesystem storage requires setting Location")
 	}
-	return &filesystem{root: settings.Location}, os.MkdirAll(settings.Location, os.ModePerm)
+	err := os.MkdirAll(settings.Location, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &filesystem{root: settings.Location}
+	err = f.removeTempFiles()
+	if err != nil {
+		return nil, err
+	}
+	return f, f.recoverTransactions()
+}
+
+// Remove any partially written files, left behind if we were killed mid write.
+//
+func (f *filesystem) removeTempFiles() error {
+	leftover, err := filepath.Glob(filepath.Join(f.root, tempFilePrefix + "*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range leftover {
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 // Return if the given key has been stored here.
@@ -57,20 +180,265 @@ func (f *filesystem) storagePath(key string) string {
 	return filepath.Join(f.root, base64.RawURLEncoding.EncodeToString([]byte(key)))
 }
 
-// Write the given data to disk, using the given key
+// Write the given data to disk, using the given key.
+//  The data is written to a temp file & renamed into place, so an interrupted write never leaves a partial object.
 //
 func (f *filesystem) Put(key string, data []byte) error {
-	return ioutil.WriteFile(f.storagePath(key), data, 0644)
+	w, err := f.Create(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// Start writing an object to disk. The data goes to a temp file, renamed into place on Commit.
+//
+func (f *filesystem) Create(key string) (ObjectWriter, error) {
+	tmp, err := ioutil.TempFile(f.root, tempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: tmp, path: f.storagePath(key)}, nil
+}
+
+// An object being written to disk
+//
+type fileWriter struct {
+	*os.File
+	path string
+}
+
+func (w *fileWriter) Commit() error {
+	err := w.Sync()
+	if err == nil {
+		err = w.Chmod(0644)
+	}
+	closeErr := w.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), w.path)
+	}
+
+	if err != nil {
+		os.Remove(w.Name())
+	}
+	return err
+}
+
+func (w *fileWriter) Abort() error {
+	w.Close()
+	return os.Remove(w.Name())
 }
 
 // Fetch the data indicated by the given key from disk
 //
 func (f *filesystem) Get(key string) ([]byte, error) {
-	return ioutil.ReadFile(f.storagePath(key))
+	data, err := ioutil.ReadFile(f.storagePath(key))
+	return data, notFound(err, key)
+}
+
+// Fetch part of the data indicated by the given key from disk
+//
+func (f *filesystem) GetRange(key string, offset, length int64) ([]byte, error) {
+	file, err := os.Open(f.storagePath(key))
+	if err != nil {
+		return nil, notFound(err, key)
+	}
+	defer file.Close()
+
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// Return the size of the data indicated by the given key
+//
+func (f *filesystem) Size(key string) (int64, error) {
+	info, err := os.Stat(f.storagePath(key))
+	if err != nil {
+		return 0, notFound(err, key)
+	}
+	return info.Size(), nil
+}
+
+// Rewrite the end of the data indicated by the given key.
+//  The start of the object is copied to a temp file, followed by data, & renamed into place, so as with Put readers
+//  never see part of a write & a crash leaves the object as it was. This also gives a key copied with a hard link
+//  its own data, & leaves objects already opened (see Open) as they were. Where the filesystem supports it (eg.
+//  copy_file_range) the start isn't copied through memory.
+//  Nb. the copy still costs time in proportion to the object's size, so appending to a large object n times is
+//  O(n * size); writing the tail in place would be cheaper but would change the data under open readers & copies.
+//
+func (f *filesystem) ReplaceTail(key string, offset int64, data []byte) error {
+	in, err := os.Open(f.storagePath(key))
+	if err != nil {
+		return notFound(err, key)
+	}
+	defer in.Close()
+
+	w, err := f.Create(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(w, in, offset)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// Open the data indicated by the given key for reading. Once open, the file is read even if it's replaced.
+//
+func (f *filesystem) Open(key string) (ObjectReader, error) {
+	file, err := os.Open(f.storagePath(key))
+	if err != nil {
+		return nil, notFound(err, key)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileReader{File: file, size: info.Size()}, nil
+}
+
+// An object opened from disk
+//
+type fileReader struct {
+	*os.File
+	size int64
+}
+
+func (r *fileReader) Size() int64 {
+	return r.size
+}
+
+// Copy the data indicated by src to dst. Where the filesystem supports hard links the copy shares the original's
+// data, so costs nothing; otherwise the data is copied.
+//
+func (f *filesystem) Copy(src, dst string) error {
+	if hardlinks {
+		tmp, err := f.tempPath()
+		if err != nil {
+			return err
+		}
+
+		// link to a temp name & rename into place, so an existing dst is replaced atomically
+		err = os.Link(f.storagePath(src), tmp)
+		if err == nil {
+			err = os.Rename(tmp, f.storagePath(dst))
+			if err != nil {
+				os.Remove(tmp)
+			}
+			return err
+		} else if os.IsNotExist(err) {
+			return notFound(err, src)
+		}
+		// eg. the filesystem doesn't support links, so copy instead
+	}
+
+	return f.copyFile(f.storagePath(src), dst)
+}
+
+// Move the data indicated by src to dst
+//
+func (f *filesystem) Rename(src, dst string) error {
+	return notFound(os.Rename(f.storagePath(src), f.storagePath(dst)), src)
+}
+
+// Copy the file at the given path to key, via a temp file renamed into place
+//
+func (f *filesystem) copyFile(path, key string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return notFound(err, key)
+	}
+	defer in.Close()
+
+	w, err := f.Create(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, in)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// Return an unused temp file path
+//
+func (f *filesystem) tempPath() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(f.root, tempFilePrefix + hex.EncodeToString(b)), nil
+}
+
+// List the keys stored on disk beginning with prefix. Files that aren't encoded keys (eg. temp files) are skipped.
+//
+func (f *filesystem) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(f.root)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		key, err := base64.RawURLEncoding.DecodeString(e.Name())
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(string(key), prefix) {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
 }
 
 // Remove the data indicated by the given key from disk
 //
 func (f *filesystem) Delete(key string) error {
-	return os.Remove(f.storagePath(key))
+	return notFound(os.Remove(f.storagePath(key)), key)
+}
+
+// Nothing is held open between operations, so there's nothing to do
+//
+func (f *filesystem) Close() error {
+	return nil
+}
+
+// Translate filesystem 'not exist' errors into our own ErrNotFound
+//
+func notFound(err error, key string) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return err
 }
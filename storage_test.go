@@ -0,0 +1,182 @@
+package silo
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Open filesystem storage in a fresh temp dir
+//
+func testFilesystem(t *testing.T) (*filesystem, string) {
+	dir := t.TempDir()
+	store, err := newFilesystemStorge(&storageSettings{Location: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store.(*filesystem), dir
+}
+
+// Return the names of temp files left in dir
+//
+func tempFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, tempFilePrefix + "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestFilesystemPut(t *testing.T) {
+	f, dir := testFilesystem(t)
+
+	for _, data := range []string{"first", "second, which is longer", ""} {
+		err := f.Put("/a/key", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f.Get("/a/key")
+		if err != nil || string(got) != data {
+			t.Fatalf("expected %q, got %q %v", data, got, err)
+		}
+	}
+	if len(tempFiles(t, dir)) != 0 {
+		t.Fatalf("expected no temp files after writing")
+	}
+
+	w, err := f.Create("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("never committed"))
+	exists, _ := f.Exists("/b")
+	if exists {
+		t.Fatalf("expected nothing to be visible before commit")
+	}
+	err = w.Abort()
+	if err != nil || len(tempFiles(t, dir)) != 0 {
+		t.Fatalf("expected abort to remove the temp file, got %v", err)
+	}
+
+	_, err = f.Get("/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	err = f.Delete("/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestFilesystemReplaceTail(t *testing.T) {
+	f, dir := testFilesystem(t)
+	err := f.Put("/a", []byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Copy("/a", "/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := f.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	err = f.ReplaceTail("/a", 6, []byte("there, world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := f.Get("/a")
+	if err != nil || string(got) != "hello there, world" {
+		t.Fatalf("expected the tail replaced, got %q %v", got, err)
+	}
+
+	// what was already open, & copies sharing the data, are untouched
+	old := make([]byte, r.Size())
+	_, err = r.ReadAt(old, 0)
+	if err != nil || string(old) != "hello world" {
+		t.Fatalf("expected the open object to be unchanged, got %q %v", old, err)
+	}
+	got, err = f.Get("/copy")
+	if err != nil || string(got) != "hello world" {
+		t.Fatalf("expected the copy to be unchanged, got %q %v", got, err)
+	}
+
+	// the start is copied with ReadFrom, so by the kernel where it can be
+	w, err := f.Create("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := w.(io.ReaderFrom)
+	w.Abort()
+	if !ok {
+		t.Fatalf("expected objects being written to take their data with ReadFrom")
+	}
+
+	err = f.ReplaceTail("/missing", 0, nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if len(tempFiles(t, dir)) != 0 {
+		t.Fatalf("expected no temp files after replacing tails")
+	}
+}
+
+func TestFilesystemRemovesTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, tempFilePrefix + "123")
+	err := os.WriteFile(leftover, []byte("half written"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newFilesystemStorge(&storageSettings{Location: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if len(tempFiles(t, dir)) != 0 {
+		t.Fatalf("expected temp files from before to be removed")
+	}
+	keys, err := store.(ListingStorage).List("")
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("expected temp files never to be listed, got %v %v", keys, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	c := testConfig(t, r)
+	s, err := NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Store(r, "/a", []byte(strings.Repeat("x", 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("expected closing twice to be harmless, got %v", err)
+	}
+
+	// everything was flushed, so a new silo starts where we left off
+	s = openTestSilo(t, c)
+	data, err := s.Get(r, "/a")
+	if err != nil || len(data) != 10 {
+		t.Fatalf("expected the data after a restart, got %q %v", data, err)
+	}
+}
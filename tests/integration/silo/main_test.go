@@ -89,7 +89,7 @@ func TestWrite(t *testing.T) {
 			Method: http.MethodPost,
 			Data: []byte("some data about ponies"),
 			User: AllRole(users),
-			ExpectOnWrite: http.StatusBadRequest,  // we've written this already, we have RM, so should get "use PUT"
+			ExpectOnWrite: http.StatusConflict,  // we've written this already, we have RM, so should get "use PUT"
 			ExpectOnRead: http.StatusOK,
 			ExpectEcho: true,
 		},
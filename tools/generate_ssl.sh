@@ -3,6 +3,7 @@
 #
 # Script to generate some SSL certs, self signed with garbage data.
 #  It is suggested you used *actual* SSL certs ..
+#  `silo certs generate` does the same without needing openssl, and also creates a CA to verify against.
 #
 #
 
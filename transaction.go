@@ -0,0 +1,594 @@
+package silo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"crypto/rand"
+	"time"
+)
+
+// The filesystem driver emulates transactions with a write ahead intent log. Each transaction has a directory
+// under txnDir, where data written is staged. On commit the intended changes are written out & synced (the commit
+// point), then applied by renaming staged files into place & removing deleted keys. If we're killed part way
+// through, transactions with an intent log are applied again on startup & those without are discarded.
+//
+const (
+	// never appears in an encoded key
+	txnDir = ".txn"
+
+	// the intent log, within a transaction's directory
+	txnIntentFile = "intent"
+
+	// how many times applying a committed transaction is tried before Commit gives up, for now
+	txnApplyAttempts = 5
+
+	// how often Silo tries again to apply a transaction Commit gave up on, doubling up to the max
+	txnRetryInterval = time.Second
+	txnMaxRetryInterval = time.Minute
+)
+
+// A change to a single key. Staged is the name of the staged data, or empty for a delete.
+//
+type txnIntent struct {
+	Key string
+	Staged string `json:",omitempty"`
+}
+
+type fileTxn struct {
+	f *filesystem
+	dir string
+
+	// the last change to each key, in the order keys were first changed
+	intents map[string]*txnIntent
+	order []string
+	staged int
+	done bool
+
+	// the intent log written by Commit, until it's applied
+	committed []*txnIntent
+}
+
+// Start a transaction
+//
+func (f *filesystem) Begin() (Transaction, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(f.root, txnDir, hex.EncodeToString(b))
+	err = os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTxn{f: f, dir: dir, intents: map[string]*txnIntent{}}, nil
+}
+
+func (t *fileTxn) record(intent *txnIntent) {
+	_, ok := t.intents[intent.Key]
+	if !ok {
+		t.order = append(t.order, intent.Key)
+	}
+	t.intents[intent.Key] = intent
+}
+
+// Stage data to be written to key on commit
+//
+func (t *fileTxn) Put(key string, data []byte) error {
+	if t.done {
+		return fmt.Errorf("transaction is finished")
+	}
+
+	t.staged++
+	name := strconv.Itoa(t.staged)
+	err := writeSynced(filepath.Join(t.dir, name), data)
+	if err != nil {
+		return err
+	}
+
+	t.record(&txnIntent{Key: key, Staged: name})
+	return nil
+}
+
+// Mark key to be removed on commit
+//
+func (t *fileTxn) Delete(key string) error {
+	if t.done {
+		return fmt.Errorf("transaction is finished")
+	}
+
+	prev, ok := t.intents[key]
+	if ok && prev.Staged == "" {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	} else if !ok {
+		_, err := os.Stat(t.f.storagePath(key))
+		if err != nil {
+			return notFound(err, key)
+		}
+	}
+
+	t.record(&txnIntent{Key: key})
+	return nil
+}
+
+// Write the intent log & apply it. Once the intent log is written the transaction is committed, so any error
+// after that is only in applying it. That's retried a few times, & failing that an error wrapping errNotApplied
+// is returned; calling Commit again tries applying it again, & if we're stopped first it's applied on startup.
+//
+func (t *fileTxn) Commit() error {
+	if t.committed == nil {
+		if t.done {
+			return fmt.Errorf("transaction is finished")
+		}
+		t.done = true
+
+		intents, err := t.writeIntents()
+		if err != nil {
+			t.discard()
+			return err
+		}
+		t.committed = intents
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := t.f.applyIntents(t.dir, t.committed)
+		if err == nil {
+			t.committed = nil
+			return nil
+		}
+		if attempt == txnApplyAttempts {
+			return fmt.Errorf("%w: %v", errNotApplied, err)
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+}
+
+// Write out & sync the intent log, the transaction's commit point.
+//
+func (t *fileTxn) writeIntents() ([]*txnIntent, error) {
+	intents := []*txnIntent{}
+	for _, key := range t.order {
+		intents = append(intents, t.intents[key])
+	}
+	data, err := json.Marshal(intents)
+	if err != nil {
+		return nil, err
+	}
+
+	// written under another name & renamed, so a partial intent log is never mistaken for a committed one
+	partial := filepath.Join(t.dir, txnIntentFile + ".partial")
+	err = writeSynced(partial, data)
+	if err == nil {
+		err = os.Rename(partial, filepath.Join(t.dir, txnIntentFile))
+	}
+	if err == nil {
+		err = syncDir(t.dir)
+	}
+	return intents, err
+}
+
+// Discard the transaction's changes
+//
+func (t *fileTxn) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	return t.discard()
+}
+
+func (t *fileTxn) discard() error {
+	return os.RemoveAll(t.dir)
+}
+
+// Apply a committed transaction's intent log, then remove the transaction. Applying the same intents again has
+// no further effect, so this is safe to repeat if we were interrupted.
+//
+func (f *filesystem) applyIntents(dir string, intents []*txnIntent) error {
+	for _, intent := range intents {
+		path := f.storagePath(intent.Key)
+		var err error
+		if intent.Staged == "" {
+			err = os.Remove(path)
+		} else {
+			err = os.Rename(filepath.Join(dir, intent.Staged), path)
+		}
+		// already applied
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := syncDir(f.root)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Finish transactions interrupted by us being killed: those that committed are applied, the rest discarded.
+//
+func (f *filesystem) recoverTransactions() error {
+	dirs, err := filepath.Glob(filepath.Join(f.root, txnDir, "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, txnIntentFile))
+		if os.IsNotExist(err) {
+			err = os.RemoveAll(dir)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		intents := []*txnIntent{}
+		err = json.Unmarshal(data, &intents)
+		if err != nil {
+			return fmt.Errorf("unable to read transaction log %s: %v", dir, err)
+		}
+
+		err = f.applyIntents(dir, intents)
+		if err != nil {
+			return fmt.Errorf("unable to apply transaction log %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Write a file & sync it to disk
+//
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Sync a directory, so renames & removals within it are on disk
+//
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	closeErr := dir.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// A transaction: changes to several keys made atomically, so either all of them take effect or none do. Each change
+// is checked as if it were made alone, & recorded in the audit log once committed.
+//  The keys a transaction may change are given to Begin, & nothing else can write them until it's committed or
+//  rolled back, so it should be finished promptly. Readers never see it part applied, as reads of its keys wait
+//  while it's being applied.
+//
+type Txn struct {
+	s *Silo
+	user *Role
+	conf *Config
+	txn Transaction
+	keys []string
+	unlock func()
+	done bool
+
+	// plaintext written so far, by key; nil if the key was deleted
+	written map[string][]byte
+
+	// reverse our usage records, should the transaction fail
+	undos []func()
+
+	// the audit records to write once the transaction is committed
+	audits []*AuditRecord
+}
+
+// Start a transaction for the given user, which may change only the given keys. This requires transactional
+// storage.
+//
+func (s *Silo) Begin(user *Role, keys ...string) (*Txn, error) {
+	return s.begin(user, keys, s.config())
+}
+
+func (s *Silo) begin(user *Role, keys []string, conf *Config) (*Txn, error) {
+	transactional, ok := s.store.(TransactionalStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage driver can't apply changes atomically", ErrUnsupported)
+	}
+	txn, err := transactional.Begin()
+	if err == errNotSupported {
+		return nil, fmt.Errorf("%w: storage driver can't apply changes atomically", ErrUnsupported)
+	} else if err != nil {
+		return nil, err
+	}
+
+	unlock := s.lockKeys(keys...)
+	return &Txn{s: s, user: user, conf: conf, txn: txn, keys: keys, unlock: unlock, written: map[string][]byte{}}, nil
+}
+
+// Return an error if the transaction can't be used for key
+//
+func (t *Txn) check(key string) error {
+	if t.done {
+		return fmt.Errorf("%w: transaction is finished", ErrBadRequest)
+	}
+	if !slices.Contains(t.keys, key) {
+		return fmt.Errorf("%w: %s wasn't given when the transaction began", ErrBadRequest, key)
+	}
+	return t.s.checkKey(key)
+}
+
+// Return if the key exists, as of the changes made so far
+//
+func (t *Txn) exists(key string) (bool, error) {
+	data, ok := t.written[key]
+	if ok {
+		return data != nil, nil
+	}
+	return t.s.Exists(key)
+}
+
+// Get the item with the given key, as of the changes made so far
+//
+func (t *Txn) Get(key string) ([]byte, error) {
+	err := t.check(key)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := t.written[key]
+	if !ok {
+		return t.s.Get(t.user, key)
+	}
+
+	if !t.user.CanGet {
+		return nil, t.s.Denied(t.user, BatchGet, key, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, t.user.Id))
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return data, nil
+}
+
+// Return if the item with the given key exists, as of the changes made so far
+//
+func (t *Txn) Exists(key string) (bool, error) {
+	// existence is itself something only readers may know
+	if !t.user.CanGet {
+		return false, t.s.Denied(t.user, BatchExists, key, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, t.user.Id))
+	}
+	err := t.check(key)
+	if err != nil {
+		return false, err
+	}
+	return t.exists(key)
+}
+
+// Write data to key in the transaction, with the same checks as Store
+//
+func (t *Txn) Put(key string, data []byte) error {
+	if !t.user.CanPut {
+		return t.s.Denied(t.user, BatchPut, key, fmt.Errorf("%w: user %s is not permitted to write", ErrForbidden, t.user.Id))
+	}
+	if len(data) > t.conf.Misc.MaxDataBytes {
+		return fmt.Errorf("%w: maxdatabytes is currently %d", ErrTooLarge, t.conf.Misc.MaxDataBytes)
+	}
+	err := t.check(key)
+	if err != nil {
+		return err
+	}
+
+	exists, err := t.exists(key)
+	if err != nil {
+		return err
+	}
+	if exists && !t.user.CanRm {
+		return t.s.Denied(t.user, BatchPut, key, fmt.Errorf("%w: file exists and user %s is not permitted to remove", ErrForbidden, t.user.Id))
+	}
+
+	cyphertext, err := t.s.encryptObject(data)
+	if err != nil {
+		return err
+	}
+
+	undo, err := t.s.usage.record(t.user, key, int64(len(data)), t.conf.Quota)
+	if err != nil {
+		return err
+	}
+	t.undos = append(t.undos, undo)
+
+	err = t.txn.Put(key, cyphertext)
+	if err != nil {
+		return err
+	}
+
+	// a nil slice would read as deleted
+	t.written[key] = append([]byte{}, data...)
+	size, checksum := auditDigest(data)
+	t.audits = append(t.audits, &AuditRecord{Action: AuditStore, Key: key, Size: size, Checksum: checksum})
+	return nil
+}
+
+// Remove key in the transaction, with the same checks as Remove
+//
+func (t *Txn) Delete(key string) error {
+	if !t.user.CanRm {
+		return t.s.Denied(t.user, BatchDelete, key, fmt.Errorf("%w: user %s is not permitted to delete", ErrForbidden, t.user.Id))
+	}
+	err := t.check(key)
+	if err != nil {
+		return err
+	}
+
+	exists, err := t.exists(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	t.undos = append(t.undos, t.s.usage.forget(key))
+	err = t.txn.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	t.written[key] = nil
+	t.audits = append(t.audits, &AuditRecord{Action: AuditRemove, Key: key})
+	return nil
+}
+
+// Make the transaction's changes, all at once. Either way the transaction is finished.
+//  If the changes are committed but can't be applied yet, an error wrapping ErrPending is returned: they'll be
+//  applied in the background (or on restart), & until then the keys can't be written & reads of them fail. The
+//  changes shouldn't be made again.
+//
+func (t *Txn) Commit() error {
+	if t.done {
+		return fmt.Errorf("%w: transaction is finished", ErrBadRequest)
+	}
+	t.done = true
+
+	t.s.startCommit(t.keys)
+	err := t.txn.Commit()
+	if errors.Is(err, errNotApplied) {
+		// the changes will be made, so they're recorded as if they had been
+		slog.Warn("transaction committed but not yet applied", "error", err)
+		t.record()
+		t.s.applyLater(t.txn, t.keys, t.unlock)
+		return fmt.Errorf("%w: %v", ErrPending, err)
+	}
+
+	t.s.finishCommit(t.keys)
+	defer t.unlock()
+	if err != nil {
+		t.undo()
+		return err
+	}
+	t.record()
+	return nil
+}
+
+// Discard the transaction's changes. Harmless if it's already finished.
+//
+func (t *Txn) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	defer t.unlock()
+
+	t.undo()
+	return t.txn.Rollback()
+}
+
+func (t *Txn) record() {
+	for _, rec := range t.audits {
+		t.s.recordAudit(t.user, rec, nil)
+	}
+}
+
+// Reverse the usage records made by the transaction, newest first
+//
+func (t *Txn) undo() {
+	for i := len(t.undos) - 1; i >= 0; i-- {
+		t.undos[i]()
+	}
+}
+
+// Mark keys as being changed by a commit, so reads of them wait until it's applied.
+//
+func (s *Silo) startCommit(keys []string) {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	for _, key := range keys {
+		s.commits[key] = false
+	}
+}
+
+func (s *Silo) finishCommit(keys []string) {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	for _, key := range keys {
+		delete(s.commits, key)
+	}
+	s.commitDone.Broadcast()
+}
+
+// Wait for any commit changing key to be applied, so that a transaction is never seen part applied. Returns an
+// error if the commit is being retried in the background, rather than wait for it.
+//
+func (s *Silo) waitForCommit(key string) error {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	for {
+		stuck, ok := s.commits[key]
+		if !ok {
+			return nil
+		} else if stuck {
+			return fmt.Errorf("%s has changes committed but not yet applied", key)
+		}
+		s.commitDone.Wait()
+	}
+}
+
+// Keep trying to apply a committed transaction in the background, holding its keys' locks until it's applied, so
+// nothing is written to them meanwhile. If we're closed first it's applied on startup.
+//
+func (s *Silo) applyLater(txn Transaction, keys []string, unlock func()) {
+	s.commitLock.Lock()
+	for _, key := range keys {
+		s.commits[key] = true
+	}
+	s.commitDone.Broadcast()
+	s.commitLock.Unlock()
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer unlock()
+		defer s.finishCommit(keys)
+
+		for wait := txnRetryInterval; ; wait = min(2 * wait, txnMaxRetryInterval) {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(wait):
+			}
+
+			err := txn.Commit()
+			if err == nil {
+				slog.Info("committed transaction applied", "keys", len(keys))
+				return
+			}
+			slog.Warn("transaction committed but still not applied", "error", err)
+		}
+	}()
+}
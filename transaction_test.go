@@ -0,0 +1,281 @@
+package silo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Reopen filesystem storage in dir, as if after a restart
+//
+func reopenFilesystem(t *testing.T, dir string) *filesystem {
+	store, err := newFilesystemStorge(&storageSettings{Location: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store.(*filesystem)
+}
+
+// Return the transactions left in dir
+//
+func transactions(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, txnDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestTransaction(t *testing.T) {
+	f, dir := testFilesystem(t)
+	err := f.Put("/a", []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := f.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Put("/b", []byte("two"))
+	txn.Put("/b", []byte("three"))
+	err = txn.Delete("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Delete("/a")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected deleting twice to be not found, got %v", err)
+	}
+
+	exists, _ := f.Exists("/b")
+	if exists {
+		t.Fatalf("expected nothing to be visible before commit")
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := f.Get("/b")
+	if err != nil || string(data) != "three" {
+		t.Fatalf("expected the last write, got %q %v", data, err)
+	}
+	exists, _ = f.Exists("/a")
+	if exists || len(transactions(t, dir)) != 0 {
+		t.Fatalf("expected /a removed & the transaction cleaned up")
+	}
+}
+
+func TestTransactionRecovery(t *testing.T) {
+	f, dir := testFilesystem(t)
+
+	// killed before the commit point
+	uncommitted, err := f.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncommitted.Put("/a", []byte("never"))
+
+	// killed after the commit point, before being applied
+	committed, err := f.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed.Put("/b", []byte("applied on restart"))
+	_, err = committed.(*fileTxn).writeIntents()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f = reopenFilesystem(t, dir)
+	exists, _ := f.Exists("/a")
+	if exists {
+		t.Fatalf("expected the uncommitted transaction to be discarded")
+	}
+	data, err := f.Get("/b")
+	if err != nil || string(data) != "applied on restart" {
+		t.Fatalf("expected the committed transaction to be applied, got %q %v", data, err)
+	}
+	if len(transactions(t, dir)) != 0 {
+		t.Fatalf("expected both transactions to be cleaned up")
+	}
+}
+
+// Block applying changes to key in s, by putting a directory where its file belongs, returning a func to unblock it
+//
+func blockApplying(t *testing.T, s *Silo, key string) func() {
+	f := s.store.(*instrumented).Storage.(*filesystem)
+	blocker := f.storagePath(key)
+	err := os.MkdirAll(filepath.Join(blocker, "x"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		err := os.RemoveAll(blocker)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBatchNotApplied(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	c := testConfig(t, rw)
+	s, err := NewSilo(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unblock := blockApplying(t, s, "/a")
+	results, err := s.Batch(rw, []*BatchOp{{Op: BatchPut, Key: "/a", Data: []byte("12345")}}, true)
+	if !errors.Is(err, ErrPending) || len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("expected the batch to be committed but not applied, got %v %v", results, err)
+	}
+	if u := s.Usage(rw).Usage; u.Bytes != 5 || u.Objects != 1 {
+		t.Fatalf("expected the committed write to be counted, got %+v", u)
+	}
+
+	// what was there before isn't read meanwhile
+	_, err = s.Get(rw, "/a")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected reading a key with changes pending to fail, got %v", err)
+	}
+	s.Close()
+
+	// applied on restart, once it can be
+	unblock()
+	s = openTestSilo(t, c)
+	data, err := s.Get(rw, "/a")
+	if err != nil || string(data) != "12345" {
+		t.Fatalf("expected the batch applied on restart, got %q %v", data, err)
+	}
+	if u := s.Usage(rw).Usage; u.Bytes != 5 || u.Objects != 1 {
+		t.Fatalf("expected usage to match after the restart, got %+v", u)
+	}
+}
+
+func TestBatchAppliedLater(t *testing.T) {
+	rw := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, rw))
+
+	unblock := blockApplying(t, s, "/a")
+	_, err := s.Batch(rw, []*BatchOp{{Op: BatchPut, Key: "/a", Data: []byte("batch")}, {Op: BatchPut, Key: "/b", Data: []byte("batch")}}, true)
+	if !errors.Is(err, ErrPending) {
+		t.Fatalf("expected the batch to be committed but not applied, got %v", err)
+	}
+
+	// the keys stay locked until the batch is applied, so a later write isn't overwritten by it
+	stored := make(chan error, 1)
+	go func() {
+		stored <- s.Store(rw, "/a", []byte("later"))
+	}()
+	select {
+	case err = <-stored:
+		t.Fatalf("expected writes to wait for the batch to be applied, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unblock()
+	select {
+	case err = <-stored:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the batch to be applied in the background")
+	}
+
+	for key, expect := range map[string]string{"/a": "later", "/b": "batch"} {
+		data, err := s.Get(rw, key)
+		if err != nil || string(data) != expect {
+			t.Fatalf("%s: expected %q, got %q %v", key, expect, data, err)
+		}
+	}
+}
+
+func TestTxn(t *testing.T) {
+	r := testRole("rw", true, true, true)
+	s := openTestSilo(t, testConfig(t, r))
+	err := s.Store(r, "/manifest", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := s.Begin(r, "/manifest", "/data", "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Put("/data", []byte("v2 data"))
+	if err == nil {
+		err = txn.Put("/manifest", []byte("v2"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{
+		Name string
+		Err error
+		Fn func() error
+	}{
+		{"keys not given to Begin", ErrBadRequest, func() error { return txn.Put("/other", []byte("x")) }},
+		{"nor deleted", ErrBadRequest, func() error { return txn.Delete("/other") }},
+		{"deleting what isn't there", ErrNotFound, func() error { return txn.Delete("/missing") }},
+	}
+	for _, c := range cases {
+		err := c.Fn()
+		if !errors.Is(err, c.Err) {
+			t.Errorf("%s: expected %v, got %v", c.Name, c.Err, err)
+		}
+	}
+
+	// the transaction sees its own changes, nothing else does until it's committed
+	data, err := txn.Get("/manifest")
+	if err != nil || string(data) != "v2" {
+		t.Fatalf("expected the transaction's write, got %q %v", data, err)
+	}
+	data, err = s.Get(r, "/manifest")
+	if err != nil || string(data) != "v1" {
+		t.Fatalf("expected nothing visible before commit, got %q %v", data, err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expect := range map[string]string{"/manifest": "v2", "/data": "v2 data"} {
+		data, err := s.Get(r, key)
+		if err != nil || string(data) != expect {
+			t.Fatalf("%s: expected %q, got %q %v", key, expect, data, err)
+		}
+	}
+	if !errors.Is(txn.Commit(), ErrBadRequest) || txn.Rollback() != nil {
+		t.Fatalf("expected a finished transaction to refuse a second commit")
+	}
+
+	// rolled back, nothing changes & the keys can be written again
+	txn, err = s.Begin(r, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Delete("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Store(r, "/data", []byte("v3 data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = s.Get(r, "/data")
+	if err != nil || string(data) != "v3 data" {
+		t.Fatalf("expected the rollback to change nothing, got %q %v", data, err)
+	}
+}
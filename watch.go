@@ -0,0 +1,92 @@
+package silo
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// events a watcher can fall behind by before it's dropped
+	watchBuffer = 256
+)
+
+// A change to a key, as seen by Watch.
+//
+type WatchEvent struct {
+	Action string // AuditStore, AuditAppend, AuditRemove, AuditCopy or AuditRename
+	Key string
+	From string // for copies & renames, the key copied or renamed from
+	Size int64 // the size of the data written, except for removals
+	Time time.Time
+}
+
+type watcher struct {
+	prefix string
+	events chan *WatchEvent
+}
+
+// Everyone watching for changes
+//
+type watchers struct {
+	all map[*watcher]bool
+	lock sync.Mutex
+}
+
+// Watch for changes to keys beginning with prefix. Events are sent on the returned channel until stop is called.
+//  Events aren't waited for: a watcher that falls too far behind has its channel closed without stop being called,
+//  as it has missed changes. Renames are seen by watchers of either key.
+//
+func (s *Silo) Watch(user *Role, prefix string) (<-chan *WatchEvent, func(), error) {
+	if !user.CanGet {
+		return nil, nil, s.Denied(user, "watch", prefix, fmt.Errorf("%w: user %s is not permitted to read", ErrForbidden, user.Id))
+	}
+
+	w := &watcher{prefix: prefix, events: make(chan *WatchEvent, watchBuffer)}
+	s.watchers.lock.Lock()
+	if s.watchers.all == nil {
+		s.watchers.all = map[*watcher]bool{}
+	}
+	s.watchers.all[w] = true
+	s.watchers.lock.Unlock()
+
+	stop := func() {
+		s.watchers.lock.Lock()
+		defer s.watchers.lock.Unlock()
+		if s.watchers.all[w] {
+			delete(s.watchers.all, w)
+			close(w.events)
+		}
+	}
+	return w.events, stop, nil
+}
+
+// Tell watchers about a successful write, from its audit record
+//
+func (s *Silo) notify(rec *AuditRecord) {
+	if isSystemKey(rec.Key) {
+		return
+	}
+
+	e := &WatchEvent{Action: rec.Action, Key: rec.Key, Size: rec.Size, Time: time.Now()}
+	if rec.Action == AuditCopy || rec.Action == AuditRename {
+		e.From = strings.TrimPrefix(rec.Detail, "from ")
+	}
+
+	s.watchers.lock.Lock()
+	defer s.watchers.lock.Unlock()
+	for w := range s.watchers.all {
+		if !strings.HasPrefix(e.Key, w.prefix) && (e.From == "" || !strings.HasPrefix(e.From, w.prefix)) {
+			continue
+		}
+
+		select {
+		case w.events <- e:
+		default:
+			// it's fallen behind
+			delete(s.watchers.all, w)
+			close(w.events)
+		}
+	}
+}